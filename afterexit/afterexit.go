@@ -0,0 +1,84 @@
+package afterexit
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+)
+
+// The values of the afterExit runner option
+const (
+	None                  = "none"
+	Shutdown              = "shutdown"
+	Reboot                = "reboot"
+	ShutdownOnSuccessOnly = "shutdown-on-success-only"
+)
+
+// Host represents the operations that can be performed on the host after the
+// worker exits.
+type Host interface {
+	Shutdown() error
+	Reboot() error
+}
+
+// An object to handle the afterExit runner option
+type AfterExit struct {
+	action string
+	host   Host
+}
+
+func New(runnercfg *cfg.RunnerConfig) (*AfterExit, error) {
+	return new(runnercfg, nil)
+}
+
+// Run the configured action, given the result of the run so far.  If runCached
+// is true, the run's state was loaded from cacheOverRestarts, meaning that the
+// worker restarted the host on purpose and is managing restarts itself, so the
+// action is skipped.  This should only be called after the worker has exited
+// and all shutdown processing is complete, as it may not return.
+func (ae *AfterExit) Run(runErr error, runCached bool) error {
+	if ae.action == None {
+		return nil
+	}
+
+	if runCached {
+		log.Printf("Worker restarted the host using cacheOverRestarts; not performing afterExit action %s", ae.action)
+		return nil
+	}
+
+	switch ae.action {
+	case Shutdown:
+		log.Println("Worker has exited; shutting down")
+		return ae.host.Shutdown()
+	case Reboot:
+		log.Println("Worker has exited; rebooting")
+		return ae.host.Reboot()
+	case ShutdownOnSuccessOnly:
+		if runErr != nil {
+			log.Println("Worker failed; not shutting down")
+			return nil
+		}
+		log.Println("Worker has exited successfully; shutting down")
+		return ae.host.Shutdown()
+	}
+	return nil
+}
+
+// New takes its dependencies as optional arguments, allowing injection of fake dependencies for testing.
+func new(runnercfg *cfg.RunnerConfig, host Host) (*AfterExit, error) {
+	action := runnercfg.AfterExit
+	switch action {
+	case "":
+		action = None
+	case None, Shutdown, Reboot, ShutdownOnSuccessOnly:
+	default:
+		return nil, fmt.Errorf("afterExit must be one of %s, %s, %s, or %s", None, Shutdown, Reboot, ShutdownOnSuccessOnly)
+	}
+
+	if host == nil {
+		host = realHost{}
+	}
+
+	return &AfterExit{action, host}, nil
+}
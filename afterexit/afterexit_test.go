@@ -0,0 +1,75 @@
+package afterexit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+)
+
+type fakeHost struct {
+	actions []string
+}
+
+func (h *fakeHost) Shutdown() error {
+	h.actions = append(h.actions, "shutdown")
+	return nil
+}
+
+func (h *fakeHost) Reboot() error {
+	h.actions = append(h.actions, "reboot")
+	return nil
+}
+
+func TestActions(t *testing.T) {
+	for _, tc := range []struct {
+		action   string
+		runErr   error
+		expected []string
+	}{
+		{"", nil, nil},
+		{None, nil, nil},
+		{Shutdown, nil, []string{"shutdown"}},
+		{Shutdown, errors.New("uhoh"), []string{"shutdown"}},
+		{Reboot, nil, []string{"reboot"}},
+		{Reboot, errors.New("uhoh"), []string{"reboot"}},
+		{ShutdownOnSuccessOnly, nil, []string{"shutdown"}},
+		{ShutdownOnSuccessOnly, errors.New("uhoh"), nil},
+	} {
+		t.Run(tc.action, func(t *testing.T) {
+			host := &fakeHost{}
+			ae, err := new(&cfg.RunnerConfig{AfterExit: tc.action}, host)
+			require.NoError(t, err)
+
+			require.NoError(t, ae.Run(tc.runErr, false))
+			assert.Equal(t, tc.expected, host.actions)
+		})
+	}
+}
+
+func TestInvalidAction(t *testing.T) {
+	_, err := new(&cfg.RunnerConfig{AfterExit: "explode"}, &fakeHost{})
+	require.Error(t, err)
+}
+
+func TestCacheOverRestarts(t *testing.T) {
+	for _, action := range []string{Shutdown, Reboot, ShutdownOnSuccessOnly} {
+		t.Run(action, func(t *testing.T) {
+			host := &fakeHost{}
+			ae, err := new(&cfg.RunnerConfig{AfterExit: action, CacheOverRestarts: "/cache.json"}, host)
+			require.NoError(t, err)
+
+			// the first run, before the worker restarts the host, performs
+			// the action as usual
+			require.NoError(t, ae.Run(nil, false))
+			require.Len(t, host.actions, 1)
+
+			// a run using the cached state skips it
+			require.NoError(t, ae.Run(nil, true))
+			require.NoError(t, ae.Run(errors.New("uhoh"), true))
+			require.Len(t, host.actions, 1)
+		})
+	}
+}
@@ -0,0 +1,26 @@
+// +build linux darwin
+
+package afterexit
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+type realHost struct{}
+
+func (realHost) run(args ...string) error {
+	output, err := exec.Command("shutdown", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error running shutdown %v: %v\n%s", args, err, output)
+	}
+	return nil
+}
+
+func (h realHost) Shutdown() error {
+	return h.run("-h", "now")
+}
+
+func (h realHost) Reboot() error {
+	return h.run("-r", "now")
+}
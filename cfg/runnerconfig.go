@@ -14,6 +14,47 @@ type RunnerConfig struct {
 	WorkerConfig         *WorkerConfig              `yaml:"workerConfig"`
 	GetSecrets           bool                       `yaml:"getSecrets"`
 	CacheOverRestarts    string                     `yaml:"cacheOverRestarts"`
+	RemoveWorkerOnExit   bool                       `yaml:"removeWorkerOnExit"`
+	Hooks                []HookConfig               `yaml:"hooks"`
+	MaxLifetime          int                        `yaml:"maxLifetime"`
+	IdleTimeout          int                        `yaml:"idleTimeout"`
+	AfterExit            string                     `yaml:"afterExit"`
+	HeartbeatInterval    int                        `yaml:"heartbeatInterval"`
+	MaxMissedHeartbeats  int                        `yaml:"maxMissedHeartbeats"`
+	Status               StatusConfig               `yaml:"status"`
+	Metrics              MetricsConfig              `yaml:"metrics"`
+	RecordProtocol       string                     `yaml:"recordProtocol"`
+}
+
+// HookConfig defines a command to run at some phase of the runner's
+// operation.  See the usage string for field descriptions.
+type HookConfig struct {
+	Phase     string   `yaml:"phase"`
+	Command   []string `yaml:"command"`
+	Timeout   int      `yaml:"timeout"`
+	OnFailure string   `yaml:"onFailure"`
+}
+
+// StatusConfig defines the local status server.  See the usage string for
+// field descriptions.
+type StatusConfig struct {
+	Listen string `yaml:"listen"`
+	Token  string `yaml:"token"`
+}
+
+// MetricsConfig defines how metrics are exposed.  See the usage string for
+// field descriptions.
+type MetricsConfig struct {
+	Listen   string       `yaml:"listen"`
+	Textfile string       `yaml:"textfile"`
+	StatsD   StatsDConfig `yaml:"statsd"`
+}
+
+// StatsDConfig defines a StatsD server to which metrics forwarded from the
+// worker are pushed.
+type StatsDConfig struct {
+	Address string `yaml:"address"`
+	Prefix  string `yaml:"prefix"`
 }
 
 // Load a configuration file
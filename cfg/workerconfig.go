@@ -20,8 +20,8 @@ type WorkerConfig struct {
 
 // Normalize a JSON value, using the same types regardless of source
 //
-// Specifically, maps should be map[string]value, and numbers should
-// be float64s
+// Specifically, maps should be map[string]value, arrays should be
+// []value, and numbers should be float64s
 func normalize(value interface{}) interface{} {
 	strmap, ok := value.(map[string]interface{})
 	if ok {
@@ -41,11 +41,35 @@ func normalize(value interface{}) interface{} {
 		return res
 	}
 
+	arr, ok := value.([]interface{})
+	if ok {
+		res := make([]interface{}, len(arr))
+		for i, value := range arr {
+			res[i] = normalize(value)
+		}
+		return res
+	}
+
+	// arrays of tables, as decoded from TOML
+	maparr, ok := value.([]map[string]interface{})
+	if ok {
+		res := make([]interface{}, len(maparr))
+		for i, value := range maparr {
+			res[i] = normalize(value)
+		}
+		return res
+	}
+
 	num, ok := value.(int)
 	if ok {
 		return float64(num)
 	}
 
+	num64, ok := value.(int64)
+	if ok {
+		return float64(num64)
+	}
+
 	return value
 }
 
@@ -178,6 +202,12 @@ func (wc *WorkerConfig) Set(key string, value interface{}) (*WorkerConfig, error
 		wc = NewWorkerConfig()
 	}
 
+	// values must be representable in the config file, whatever its format
+	_, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot set %s: %s", key, err)
+	}
+
 	splitkey := strings.Split(key, ".")
 	data, err := set(splitkey, 0, wc.data, value)
 	if err != nil {
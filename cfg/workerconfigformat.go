@@ -0,0 +1,218 @@
+package cfg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// The formats in which a WorkerConfig can be written to a file for a worker.
+// The empty string is treated as "json".
+var WorkerConfigFormats = []string{"json", "yaml", "toml", "dotenv"}
+
+// Check that the given worker config format is supported
+func ValidateWorkerConfigFormat(format string) error {
+	if format == "" {
+		return nil
+	}
+	for _, f := range WorkerConfigFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unsupported worker config format %s; expected one of %s", format, strings.Join(WorkerConfigFormats, ", "))
+}
+
+// Encode this WorkerConfig in the given format.
+//
+// The dotenv format has one line per top-level key, with the value encoded as
+// JSON; that is, strings are double-quoted and nested values are JSON objects
+// or arrays.  TOML cannot represent null values, so they are an error in that
+// format.
+func (wc *WorkerConfig) Encode(format string) ([]byte, error) {
+	if wc == nil {
+		wc = NewWorkerConfig()
+	}
+
+	switch format {
+	case "", "json":
+		return json.MarshalIndent(wc.data, "", "  ")
+	case "yaml":
+		return yaml.Marshal(wc.data)
+	case "toml":
+		data, err := plainValue(wc.data)
+		if err != nil {
+			return nil, err
+		}
+		data, err = tomlValue("", data)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = toml.NewEncoder(&buf).Encode(data)
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "dotenv":
+		return encodeDotenv(wc.data)
+	default:
+		return nil, ValidateWorkerConfigFormat(format)
+	}
+}
+
+// Decode a WorkerConfig in the given format, as written by Encode.
+func DecodeWorkerConfig(format string, content []byte) (*WorkerConfig, error) {
+	var res map[string]interface{}
+
+	switch format {
+	case "", "json":
+		err := json.Unmarshal(content, &res)
+		if err != nil {
+			return nil, err
+		}
+	case "yaml":
+		err := yaml.Unmarshal(content, &res)
+		if err != nil {
+			return nil, err
+		}
+	case "toml":
+		_, err := toml.Decode(string(content), &res)
+		if err != nil {
+			return nil, err
+		}
+	case "dotenv":
+		var err error
+		res, err = decodeDotenv(content)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ValidateWorkerConfigFormat(format)
+	}
+
+	if res == nil {
+		return NewWorkerConfig(), nil
+	}
+	return &WorkerConfig{data: normalize(res).(map[string]interface{})}, nil
+}
+
+// Convert a value to plain JSON types (maps, slices, strings, float64s,
+// bools), as values given to Set may have arbitrary types.  This fails for
+// values that cannot be represented in JSON, such as NaN.
+func plainValue(value interface{}) (interface{}, error) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var res interface{}
+	err = json.Unmarshal(content, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Prepare a plain value, at the given dotted path, for encoding as TOML, which
+// distinguishes integers from floats; whole numbers (which normalize represents
+// as float64) are written as integers.  TOML has no null, so null values are
+// an error rather than being silently omitted.
+func tomlValue(path string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, fmt.Errorf("Worker config value %s is null, which cannot be represented in toml format", path)
+	case map[string]interface{}:
+		res := make(map[string]interface{})
+		for key, value := range v {
+			var err error
+			res[key], err = tomlValue(joinPath(path, key), value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, value := range v {
+			var err error
+			res[i], err = tomlValue(joinPath(path, fmt.Sprintf("%d", i)), value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v), nil
+		}
+		return v, nil
+	default:
+		return value, nil
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func encodeDotenv(data map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		if key == "" || strings.ContainsAny(key, "= \t\r\n#") {
+			return nil, fmt.Errorf("Worker config key %q cannot be represented in dotenv format", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		// json.Marshal would escape <, >, and &, which dotenv parsers do not
+		// unescape
+		var value bytes.Buffer
+		enc := json.NewEncoder(&value)
+		enc.SetEscapeHTML(false)
+		err := enc.Encode(data[key])
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "%s=%s\n", key, bytes.TrimSuffix(value.Bytes(), []byte("\n")))
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeDotenv(content []byte) (map[string]interface{}, error) {
+	res := make(map[string]interface{})
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		split := strings.SplitN(line, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("Invalid dotenv line %q", line)
+		}
+
+		var value interface{}
+		err := json.Unmarshal([]byte(split[1]), &value)
+		if err != nil {
+			// treat anything that is not JSON as an unquoted string
+			value = split[1]
+		}
+		res[split[0]] = value
+	}
+	return res, scanner.Err()
+}
@@ -0,0 +1,189 @@
+package cfg
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const roundTripYAML = `
+rootUrl: https://tc.example.com
+capacity: 4
+ratio: 0.25
+enabled: true
+credentials:
+  clientId: cli
+  nested:
+    deeper: [1, 2, 3]
+tags: [a, b]
+mounts:
+  - {path: /a, size: 10}
+  - {path: /b, size: 20}
+`
+
+func TestWorkerConfigRoundTrip(t *testing.T) {
+	var wc WorkerConfig
+	require.NoError(t, yaml.Unmarshal([]byte(roundTripYAML), &wc))
+
+	// values set after loading need not have normalized types
+	wcp, err := wc.Set("location", map[string]string{"cloud": "aws"})
+	require.NoError(t, err)
+
+	for _, format := range append(WorkerConfigFormats, "") {
+		t.Run(format, func(t *testing.T) {
+			content, err := wcp.Encode(format)
+			require.NoError(t, err)
+
+			decoded, err := DecodeWorkerConfig(format, content)
+			require.NoError(t, err)
+
+			assert.Equal(t, "https://tc.example.com", decoded.MustGet("rootUrl"))
+			assert.Equal(t, 4.0, decoded.MustGet("capacity"))
+			assert.Equal(t, 0.25, decoded.MustGet("ratio"))
+			assert.Equal(t, true, decoded.MustGet("enabled"))
+			assert.Equal(t, "cli", decoded.MustGet("credentials.clientId"))
+			assert.Equal(t, []interface{}{1.0, 2.0, 3.0}, decoded.MustGet("credentials.nested.deeper"))
+			assert.Equal(t, []interface{}{"a", "b"}, decoded.MustGet("tags"))
+			assert.Equal(t, []interface{}{
+				map[string]interface{}{"path": "/a", "size": 10.0},
+				map[string]interface{}{"path": "/b", "size": 20.0},
+			}, decoded.MustGet("mounts"))
+			assert.Equal(t, map[string]interface{}{"cloud": "aws"}, decoded.MustGet("location"))
+
+			// the loaded config, with normalized types, round-trips exactly
+			content, err = wc.Encode(format)
+			require.NoError(t, err)
+			decoded, err = DecodeWorkerConfig(format, content)
+			require.NoError(t, err)
+			assert.Equal(t, wc.data, decoded.data)
+		})
+	}
+}
+
+func TestEncodeTOMLIntegers(t *testing.T) {
+	wc, err := NewWorkerConfig().Set("capacity", 4.0)
+	require.NoError(t, err)
+	wc, err = wc.Set("ratio", 0.5)
+	require.NoError(t, err)
+
+	content, err := wc.Encode("toml")
+	require.NoError(t, err)
+	assert.Equal(t, "capacity = 4\nratio = 0.5\n", string(content))
+}
+
+func TestEncodeDotenv(t *testing.T) {
+	wc, err := NewWorkerConfig().Set("rootUrl", "https://tc.example.com")
+	require.NoError(t, err)
+	wc, err = wc.Set("a.b", "multi\nline")
+	require.NoError(t, err)
+
+	content, err := wc.Encode("dotenv")
+	require.NoError(t, err)
+	assert.Equal(t, "a={\"b\":\"multi\\nline\"}\nrootUrl=\"https://tc.example.com\"\n", string(content))
+
+	wc, err = NewWorkerConfig().Set("bad key", "x")
+	require.NoError(t, err)
+	_, err = wc.Encode("dotenv")
+	assert.Error(t, err)
+}
+
+func TestWorkerConfigRoundTripSpecialCharacters(t *testing.T) {
+	values := []string{
+		"a<b&c>d",
+		`quote " and backslash \\`,
+		"multi\nline\ttab",
+		"x=y # not a comment",
+		"unicode é ✓",
+		"",
+	}
+	for _, format := range append(WorkerConfigFormats, "") {
+		t.Run(format, func(t *testing.T) {
+			wc := NewWorkerConfig()
+			for i, value := range values {
+				var err error
+				wc, err = wc.Set(fmt.Sprintf("value%d", i), value)
+				require.NoError(t, err)
+			}
+
+			content, err := wc.Encode(format)
+			require.NoError(t, err)
+			decoded, err := DecodeWorkerConfig(format, content)
+			require.NoError(t, err)
+			for i, value := range values {
+				assert.Equal(t, value, decoded.MustGet(fmt.Sprintf("value%d", i)))
+			}
+		})
+	}
+}
+
+func TestEncodeDotenvNoHTMLEscaping(t *testing.T) {
+	wc, err := NewWorkerConfig().Set("value", "a<b&c")
+	require.NoError(t, err)
+
+	content, err := wc.Encode("dotenv")
+	require.NoError(t, err)
+	assert.Equal(t, "value=\"a<b&c\"\n", string(content))
+}
+
+func TestWorkerConfigNulls(t *testing.T) {
+	var wc WorkerConfig
+	require.NoError(t, yaml.Unmarshal([]byte("key: ~\nnested: {inner: ~}\n"), &wc))
+
+	for _, format := range []string{"json", "yaml", "dotenv"} {
+		t.Run(format, func(t *testing.T) {
+			content, err := wc.Encode(format)
+			require.NoError(t, err)
+			decoded, err := DecodeWorkerConfig(format, content)
+			require.NoError(t, err)
+			assert.Nil(t, decoded.MustGet("key"))
+			assert.Nil(t, decoded.MustGet("nested.inner"))
+		})
+	}
+
+	// TOML cannot represent nulls
+	_, err := wc.Encode("toml")
+	assert.Error(t, err)
+	wcp, err := NewWorkerConfig().Set("list", []interface{}{"a", nil})
+	require.NoError(t, err)
+	_, err = wcp.Encode("toml")
+	assert.Error(t, err)
+}
+
+func TestWorkerConfigUnrepresentable(t *testing.T) {
+	for _, value := range []interface{}{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		_, err := NewWorkerConfig().Set("value", value)
+		assert.Error(t, err)
+	}
+
+	// values decoded from YAML can be NaN or infinite, which only YAML can
+	// represent
+	wc, err := DecodeWorkerConfig("yaml", []byte("value: .nan\n"))
+	require.NoError(t, err)
+	for _, format := range []string{"json", "toml", "dotenv"} {
+		_, err := wc.Encode(format)
+		assert.Error(t, err, format)
+	}
+}
+
+func TestDecodeDotenvUnquoted(t *testing.T) {
+	wc, err := DecodeWorkerConfig("dotenv", []byte("# comment\n\nX=some value\nY=12\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "some value", wc.MustGet("X"))
+	assert.Equal(t, 12.0, wc.MustGet("Y"))
+}
+
+func TestValidateWorkerConfigFormat(t *testing.T) {
+	for _, format := range append(WorkerConfigFormats, "") {
+		assert.NoError(t, ValidateWorkerConfigFormat(format))
+	}
+	assert.Error(t, ValidateWorkerConfigFormat("ini"))
+
+	_, err := NewWorkerConfig().Encode("ini")
+	assert.Error(t, err)
+	_, err = DecodeWorkerConfig("ini", []byte{})
+	assert.Error(t, err)
+}
@@ -17,8 +17,13 @@ The start-worker command starts Taskcluster workers.  It is typically invoked
 during instance startup.
 
 Usage:
+	start-worker protocol-replay [--worker] <file>
 	start-worker <runnerConfig>
 
+Options:
+	--worker  Replay the worker side of a recorded protocol session over
+	          stdin/stdout, instead of printing it.
+
 ` + runner.Usage() + `
 
 ` + provider.Usage() + `
@@ -33,8 +38,12 @@ func main() {
 		os.Exit(1)
 	}
 
-	filename := opts["<runnerConfig>"].(string)
-	_, err = runner.Run(filename)
+	if opts["protocol-replay"].(bool) {
+		err = protocolReplay(opts["<file>"].(string), opts["--worker"].(bool))
+	} else {
+		filename := opts["<runnerConfig>"].(string)
+		_, err = runner.Run(filename)
+	}
 	if err != nil {
 		log.Printf("%s", err)
 		os.Exit(1)
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+)
+
+// Print a recorded protocol session, or, with worker set, replay the worker
+// side of it over stdin/stdout
+func protocolReplay(filename string, worker bool) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	records, err := protocol.ReadRecording(f)
+	if err != nil {
+		return fmt.Errorf("Error reading recording %s: %s", filename, err)
+	}
+
+	if !worker {
+		return protocol.FormatRecording(os.Stdout, records)
+	}
+
+	transp := protocol.NewStdioTransport()
+	go func() {
+		_, _ = io.Copy(transp, os.Stdin)
+		transp.Close()
+	}()
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(os.Stdout, transp)
+		close(done)
+	}()
+
+	err = protocol.ReplayWorker(transp, records)
+
+	// wait for the remaining messages to be written before returning
+	transp.CloseOut()
+	<-done
+
+	if err != nil {
+		return fmt.Errorf("Replay of %s failed: %s", filename, err)
+	}
+	return nil
+}
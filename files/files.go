@@ -14,10 +14,27 @@ import (
 )
 
 func ExtractAll(files []File) error {
-	for _, f := range files {
-		err := f.extract()
+	for i := range files {
+		err := files[i].extract()
 		if err != nil {
-			return fmt.Errorf("Error extracting file %v: %v", f.Path, err)
+			return fmt.Errorf("Error extracting file %v: %v", files[i].Path, err)
+		}
+	}
+	return nil
+}
+
+// Chown changes the owner of the paths created when the given files were
+// extracted, including the contents of zip files, to the given user and
+// group.  Paths that existed before extraction, such as the directory into
+// which a zip file is extracted or a file that was overwritten, keep their
+// owners.
+func Chown(files []File, uid, gid int) error {
+	for _, f := range files {
+		for _, path := range f.created {
+			err := os.Lchown(path, uid, gid)
+			if err != nil {
+				return fmt.Errorf("Error changing owner of file %v: %v", f.Path, err)
+			}
 		}
 	}
 	return nil
@@ -32,9 +49,12 @@ type File struct {
 	Content     string `json:"content"`
 	Encoding    string `json:"encoding"`
 	Format      string `json:"format"`
+
+	// paths created by extracting this file
+	created []string
 }
 
-func (f File) extract() error {
+func (f *File) extract() error {
 	switch f.Format {
 	case "file":
 		return f.extractFile()
@@ -45,7 +65,7 @@ func (f File) extract() error {
 	}
 }
 
-func (f File) extractFile() error {
+func (f *File) extractFile() error {
 	switch f.Encoding {
 	case "base64":
 		data, err := base64.StdEncoding.DecodeString(f.Content)
@@ -58,13 +78,21 @@ func (f File) extractFile() error {
 		if err != nil {
 			return err
 		}
-		return ioutil.WriteFile(f.Path, data, 0777)
+		existed := exists(f.Path)
+		err = ioutil.WriteFile(f.Path, data, 0777)
+		if err != nil {
+			return err
+		}
+		if !existed {
+			f.created = append(f.created, f.Path)
+		}
+		return nil
 	default:
 		return errors.New("Unsupported encoding " + f.Encoding + " for worker file")
 	}
 }
 
-func (f File) extractZip() error {
+func (f *File) extractZip() error {
 	switch f.Encoding {
 	case "base64":
 		data, err := base64.StdEncoding.DecodeString(f.Content)
@@ -77,7 +105,7 @@ func (f File) extractZip() error {
 		if err != nil {
 			return err
 		}
-		return unzip(data, f.Path)
+		return unzip(data, f.Path, &f.created)
 	default:
 		return errors.New("Unsupported encoding " + f.Encoding + " for worker file")
 	}
@@ -85,15 +113,16 @@ func (f File) extractZip() error {
 
 // This is a modified version of
 // http://stackoverflow.com/questions/20357223/easy-way-to-unzip-file-with-golang
-// to work with in memory zip, rather than a file
-func unzip(b []byte, dest string) error {
+// to work with in memory zip, rather than a file, and to record the paths it
+// creates
+func unzip(b []byte, dest string, created *[]string) error {
 	br := bytes.NewReader(b)
 	r, err := zip.NewReader(br, int64(len(b)))
 	if err != nil {
 		return err
 	}
 
-	err = os.MkdirAll(dest, 0755)
+	err = mkdirAll(dest, 0755, created)
 	if err != nil {
 		return err
 	}
@@ -113,17 +142,18 @@ func unzip(b []byte, dest string) error {
 		path := filepath.Join(dest, f.Name)
 
 		dir := filepath.Dir(path)
-		err = os.MkdirAll(dir, 0755)
+		err = mkdirAll(dir, 0755, created)
 		if err != nil {
 			return err
 		}
 
 		if f.FileInfo().IsDir() {
-			err := os.MkdirAll(path, f.Mode())
+			err := mkdirAll(path, f.Mode(), created)
 			if err != nil {
 				return err
 			}
 		} else {
+			existed := exists(path)
 			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
 			if err != nil {
 				return err
@@ -134,6 +164,10 @@ func unzip(b []byte, dest string) error {
 				}
 			}()
 
+			if !existed {
+				*created = append(*created, path)
+			}
+
 			_, err = io.Copy(f, rc)
 			if err != nil {
 				return err
@@ -151,3 +185,38 @@ func unzip(b []byte, dest string) error {
 
 	return nil
 }
+
+// Like os.MkdirAll, but append each directory that did not already exist to
+// created.
+func mkdirAll(path string, perm os.FileMode, created *[]string) error {
+	info, err := os.Stat(path)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s exists and is not a directory", path)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	parent := filepath.Dir(path)
+	if parent != path {
+		err = mkdirAll(parent, perm, created)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Mkdir(path, perm)
+	if err != nil {
+		return err
+	}
+	*created = append(*created, path)
+	return nil
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
@@ -0,0 +1,61 @@
+// +build linux darwin
+
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/Flaque/filet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChown(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("giving files to another user requires root")
+	}
+
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	existingPath := filepath.Join(dir, "existing")
+	require.NoError(t, ioutil.WriteFile(existingPath, []byte("mine"), 0644))
+
+	files := []File{
+		{
+			Description: "greeting",
+			Path:        filepath.Join(dir, "new", "greeting"),
+			Content:     "SGVsbG8sIFdvcmxk",
+			Encoding:    "base64",
+			Format:      "file",
+		},
+		{
+			// extracted into a directory that already has contents
+			Description: "stuff",
+			Path:        dir,
+			Content:     testZip,
+			Encoding:    "base64",
+			Format:      "zip",
+		},
+	}
+	require.NoError(t, ExtractAll(files))
+	require.NoError(t, Chown(files, 65534, 65534))
+
+	owner := func(path string) uint32 {
+		stat, err := os.Lstat(path)
+		require.NoError(t, err)
+		return stat.Sys().(*syscall.Stat_t).Uid
+	}
+
+	for _, path := range []string{"new/greeting", "hi", "bye", "dir", "dir/sub"} {
+		require.Equal(t, uint32(65534), owner(filepath.Join(dir, path)), path)
+	}
+
+	// the destination, the file's parent directory, and the existing file
+	// keep their owners
+	for _, path := range []string{dir, filepath.Join(dir, "new"), existingPath} {
+		require.Equal(t, uint32(0), owner(path), path)
+	}
+}
@@ -7,8 +7,12 @@ import (
 
 	"github.com/Flaque/filet"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// this is a ZIP file with `hi`, `dir/sub`, and `bye` in it.
+const testZip = `UEsDBAoAAAAAACyz8063xRQTBAAAAAQAAAADABwAYnllVVQJAANTQzJdU0MyXXV4CwABBOkDAAAE6QMAAGJ5ZQpQSwMECgAAAAAAZrPzTu6a6r0EAAAABAAAAAcAHABkaXIvc3ViVVQJAAO/QzJdv0MyXXV4CwABBOkDAAAE6QMAAHN1YgpQSwMECgAAAAAAKrPzTnp6b+0DAAAAAwAAAAIAHABoaVVUCQADUEMyXVBDMl11eAsAAQTpAwAABOkDAABoaQpQSwECHgMKAAAAAAAss/NOt8UUEwQAAAAEAAAAAwAYAAAAAAABAAAAtIEAAAAAYnllVVQFAANTQzJddXgLAAEE6QMAAATpAwAAUEsBAh4DCgAAAAAAZrPzTu6a6r0EAAAABAAAAAcAGAAAAAAAAQAAALSBQQAAAGRpci9zdWJVVAUAA79DMl11eAsAAQTpAwAABOkDAABQSwECHgMKAAAAAAAqs/NOenpv7QMAAAADAAAAAgAYAAAAAAABAAAAtIGGAAAAaGlVVAUAA1BDMl11eAsAAQTpAwAABOkDAABQSwUGAAAAAAMAAwDeAAAAxQAAAAAA`
+
 func TestFile(t *testing.T) {
 	defer filet.CleanUp(t)
 	dir := filet.TmpDir(t, "")
@@ -61,10 +65,9 @@ func TestZipSubdir(t *testing.T) {
 	file := File{
 		Description: "stuff",
 		Path:        path,
-		// this is a ZIP file with `hi`, `dir/sub`, and `bye` in it.
-		Content:  `UEsDBAoAAAAAACyz8063xRQTBAAAAAQAAAADABwAYnllVVQJAANTQzJdU0MyXXV4CwABBOkDAAAE6QMAAGJ5ZQpQSwMECgAAAAAAZrPzTu6a6r0EAAAABAAAAAcAHABkaXIvc3ViVVQJAAO/QzJdv0MyXXV4CwABBOkDAAAE6QMAAHN1YgpQSwMECgAAAAAAKrPzTnp6b+0DAAAAAwAAAAIAHABoaVVUCQADUEMyXVBDMl11eAsAAQTpAwAABOkDAABoaQpQSwECHgMKAAAAAAAss/NOt8UUEwQAAAAEAAAAAwAYAAAAAAABAAAAtIEAAAAAYnllVVQFAANTQzJddXgLAAEE6QMAAATpAwAAUEsBAh4DCgAAAAAAZrPzTu6a6r0EAAAABAAAAAcAGAAAAAAAAQAAALSBQQAAAGRpci9zdWJVVAUAA79DMl11eAsAAQTpAwAABOkDAABQSwECHgMKAAAAAAAqs/NOenpv7QMAAAADAAAAAgAYAAAAAAABAAAAtIGGAAAAaGlVVAUAA1BDMl11eAsAAQTpAwAABOkDAABQSwUGAAAAAAMAAwDeAAAAxQAAAAAA`,
-		Encoding: "base64",
-		Format:   "zip",
+		Content:     testZip,
+		Encoding:    "base64",
+		Format:      "zip",
 	}
 
 	err := file.extract()
@@ -83,3 +86,26 @@ func TestZipSubdir(t *testing.T) {
 		}
 	}
 }
+
+func TestZipRecordsCreated(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "existing"), []byte("x"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "hi"), []byte("x"), 0644))
+
+	files := []File{{
+		Description: "stuff",
+		Path:        dir,
+		Content:     testZip,
+		Encoding:    "base64",
+		Format:      "zip",
+	}}
+	require.NoError(t, ExtractAll(files))
+
+	// neither the destination nor the overwritten `hi` was created
+	require.ElementsMatch(t, []string{
+		filepath.Join(dir, "bye"),
+		filepath.Join(dir, "dir"),
+		filepath.Join(dir, "dir", "sub"),
+	}, files[0].created)
+}
@@ -3,6 +3,7 @@ module github.com/taskcluster/taskcluster-worker-runner
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/Flaque/filet v0.0.0-20190209224823-fc4d33cfcf93
 	github.com/Microsoft/go-winio v0.4.14
 	github.com/docopt/docopt-go v0.0.0-20180111231733-ee0de3bc6815
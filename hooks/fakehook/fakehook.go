@@ -0,0 +1,63 @@
+// A fake hook command for testing.  It behaves according to its first
+// argument:
+//
+//   - echo: output a worker-config patch containing the state it read on stdin
+//     and the environment variables it received
+//   - fail: exit with a nonzero status
+//   - sleep: sleep for a minute
+//   - background: start `sleep` in the background, with the same stdout, and
+//     exit
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"time"
+)
+
+func main() {
+	switch os.Args[1] {
+	case "echo":
+		var stdin interface{}
+		err := json.NewDecoder(os.Stdin).Decode(&stdin)
+		if err != nil {
+			panic(err)
+		}
+		env := map[string]string{}
+		for _, name := range []string{
+			"TASKCLUSTER_ROOT_URL",
+			"TASKCLUSTER_CLIENT_ID",
+			"TASKCLUSTER_ACCESS_TOKEN",
+			"TASKCLUSTER_WORKER_POOL_ID",
+			"TASKCLUSTER_WORKER_GROUP",
+			"TASKCLUSTER_WORKER_ID",
+			"TASKCLUSTER_WORKER_LOCATION",
+			"TASKCLUSTER_WORKER_RUNNER_HOOK",
+		} {
+			if value, ok := os.LookupEnv(name); ok {
+				env[name] = value
+			}
+		}
+		err = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"hook": map[string]interface{}{
+				"stdin": stdin,
+				"env":   env,
+			},
+		})
+		if err != nil {
+			panic(err)
+		}
+	case "fail":
+		os.Exit(1)
+	case "sleep":
+		time.Sleep(time.Minute)
+	case "background":
+		cmd := exec.Command(os.Args[0], "sleep")
+		cmd.Stdout = os.Stdout
+		err := cmd.Start()
+		if err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package hooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/files"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+)
+
+// The phases at which hooks can run
+const (
+	AfterProvider = "after-provider"
+	BeforeFiles   = "before-files"
+	BeforeStart   = "before-start"
+	AfterExit     = "after-exit"
+)
+
+var phases = []string{AfterProvider, BeforeFiles, BeforeStart, AfterExit}
+
+// The default time allowed for a hook to complete
+const defaultTimeout = 10 * time.Minute
+
+// The time to wait for a hook's output to be closed once it has been killed.
+// A process started by the hook that is not in its process group may hold
+// the output open indefinitely.
+var killWaitTimeout = 5 * time.Second
+
+// Substrings of worker config keys, compared case-insensitively, which
+// indicate that the value is secret
+var secretKeyPatterns = []string{"password", "secret", "token", "certificate", "credential", "privatekey"}
+
+const redactedValue = "<redacted>"
+
+// Check that the configured hooks are valid
+func Validate(hooks []cfg.HookConfig) error {
+	for i, hook := range hooks {
+		found := false
+		for _, phase := range phases {
+			if hook.Phase == phase {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("hooks[%d].phase must be one of %s", i, strings.Join(phases, ", "))
+		}
+		if len(hook.Command) == 0 {
+			return fmt.Errorf("hooks[%d].command must not be empty", i)
+		}
+		if hook.Timeout < 0 {
+			return fmt.Errorf("hooks[%d].timeout must not be negative", i)
+		}
+		if hook.OnFailure != "" && hook.OnFailure != "abort" && hook.OnFailure != "warn" {
+			return fmt.Errorf("hooks[%d].onFailure must be abort or warn", i)
+		}
+	}
+	return nil
+}
+
+// Get a copy of the state suitable for passing to a hook, without the
+// credentials, secret worker config values, or the contents of files.
+func redactedState(state *run.State) (run.State, error) {
+	redacted := *state
+	redacted.Credentials.AccessToken = ""
+	redacted.Credentials.Certificate = ""
+	redacted.Files = make([]files.File, len(state.Files))
+	for i, f := range state.Files {
+		f.Content = ""
+		redacted.Files[i] = f
+	}
+
+	if state.WorkerConfig != nil {
+		// the worker config is treated as read-only, so copy it by
+		// round-tripping through JSON
+		encoded, err := json.Marshal(state.WorkerConfig)
+		if err != nil {
+			return redacted, err
+		}
+		var data interface{}
+		err = json.Unmarshal(encoded, &data)
+		if err != nil {
+			return redacted, err
+		}
+		credentials := []string{state.Credentials.AccessToken, state.Credentials.Certificate}
+		encoded, err = json.Marshal(redactConfig(data, credentials))
+		if err != nil {
+			return redacted, err
+		}
+		redacted.WorkerConfig = cfg.NewWorkerConfig()
+		err = json.Unmarshal(encoded, redacted.WorkerConfig)
+		if err != nil {
+			return redacted, err
+		}
+	}
+
+	return redacted, nil
+}
+
+// Replace values in a worker config that have secret-looking keys or are equal
+// to one of the given credentials.
+func redactConfig(value interface{}, credentials []string) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		rv := make(map[string]interface{})
+		for k, v := range value {
+			if isSecretKey(k) {
+				rv[k] = redactedValue
+			} else {
+				rv[k] = redactConfig(v, credentials)
+			}
+		}
+		return rv
+	case []interface{}:
+		rv := make([]interface{}, len(value))
+		for i, v := range value {
+			rv[i] = redactConfig(v, credentials)
+		}
+		return rv
+	case string:
+		for _, c := range credentials {
+			if c != "" && value == c {
+				return redactedValue
+			}
+		}
+	}
+	return value
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, pattern := range secretKeyPatterns {
+		if strings.Contains(key, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the environment for a hook, identifying the worker.
+func hookEnv(phase string, state *run.State) ([]string, error) {
+	workerLocation := state.WorkerLocation
+	if workerLocation == nil {
+		workerLocation = map[string]string{}
+	}
+	workerLocationJson, err := json.Marshal(workerLocation)
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding worker location: %v", err)
+	}
+
+	return append(os.Environ(),
+		"TASKCLUSTER_WORKER_RUNNER_HOOK="+phase,
+		"TASKCLUSTER_ROOT_URL="+state.RootURL,
+		"TASKCLUSTER_WORKER_POOL_ID="+state.WorkerPoolID,
+		"TASKCLUSTER_WORKER_GROUP="+state.WorkerGroup,
+		"TASKCLUSTER_WORKER_ID="+state.WorkerID,
+		"TASKCLUSTER_WORKER_LOCATION="+string(workerLocationJson),
+	), nil
+}
+
+// Run a single hook, returning its output if it is a before-start hook.
+func runHook(hook cfg.HookConfig, state *run.State) ([]byte, error) {
+	timeout := defaultTimeout
+	if hook.Timeout > 0 {
+		timeout = time.Duration(hook.Timeout) * time.Second
+	}
+
+	redacted, err := redactedState(state)
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := json.Marshal(redacted)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := hookEnv(hook.Phase, state)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(hook.Command[0], hook.Command[1:]...)
+	cmd.Env = env
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = os.Stderr
+	if hook.Phase == BeforeStart {
+		cmd.Stdout = &stdout
+	} else {
+		cmd.Stdout = os.Stderr
+	}
+	setProcessGroup(cmd)
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait does not return until the hook's output is closed, which may be
+	// after the hook exits if it started other processes
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			return nil, err
+		}
+		return stdout.Bytes(), nil
+	case <-time.After(timeout):
+		err = killHook(cmd)
+		if err != nil {
+			log.Printf("Error killing hook %s: %v", hook.Command[0], err)
+		}
+		select {
+		case <-done:
+		case <-time.After(killWaitTimeout):
+		}
+		return nil, fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+// Run the hooks configured for the given phase, in order.  A before-start
+// hook may output a JSON object on stdout, which is merged into the worker
+// config.  A hook failure is returned as an error, unless the hook's
+// onFailure is "warn".
+func Run(runnercfg *cfg.RunnerConfig, phase string, state *run.State) error {
+	for _, hook := range runnercfg.Hooks {
+		if hook.Phase != phase {
+			continue
+		}
+
+		log.Printf("Running %s hook %s", phase, strings.Join(hook.Command, " "))
+		output, err := runHook(hook, state)
+
+		if err == nil && len(bytes.TrimSpace(output)) > 0 {
+			var patch cfg.WorkerConfig
+			err = json.Unmarshal(output, &patch)
+			if err != nil {
+				err = fmt.Errorf("invalid worker config patch: %v", err)
+			} else {
+				state.WorkerConfig = state.WorkerConfig.Merge(&patch)
+			}
+		}
+
+		if err != nil {
+			if hook.OnFailure == "warn" {
+				log.Printf("%s hook %s failed (ignored): %v", phase, hook.Command[0], err)
+				continue
+			}
+			return fmt.Errorf("%s hook %s failed: %v", phase, hook.Command[0], err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package hooks
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Flaque/filet"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/files"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+	taskcluster "github.com/taskcluster/taskcluster/clients/client-go/v24"
+)
+
+func buildFakeHook(t *testing.T) string {
+	dir := filet.TmpDir(t, "")
+	hookPath := filepath.Join(dir, "fakehook")
+	if runtime.GOOS == "windows" {
+		hookPath += ".exe"
+	}
+	cmd := exec.Command("go", "build", "-o", hookPath, "./fakehook")
+	require.NoError(t, cmd.Run())
+	return hookPath
+}
+
+func testState(t *testing.T) run.State {
+	workerConfig := cfg.NewWorkerConfig()
+	for key, value := range map[string]interface{}{
+		"password":                "hunter2",
+		"taskcluster.accessToken": "secret-token",
+		"credentials.cert":        "secret-cert",
+		"tokens":                  []interface{}{"secret-token"},
+		"cloud.publicIP":          "1.2.3.4",
+	} {
+		var err error
+		workerConfig, err = workerConfig.Set(key, value)
+		require.NoError(t, err)
+	}
+	return run.State{
+		RootURL: "https://tc.example.com",
+		Credentials: taskcluster.Credentials{
+			ClientID:    "cli",
+			AccessToken: "secret-token",
+			Certificate: "secret-cert",
+		},
+		WorkerPoolID:   "pp/ww",
+		WorkerGroup:    "wg",
+		WorkerID:       "wi",
+		WorkerLocation: map[string]string{"cloud": "here"},
+		WorkerConfig:   workerConfig,
+		Files:          []files.File{{Content: "c2VjcmV0", Path: "/some/file", Format: "file", Encoding: "base64"}},
+	}
+}
+
+func TestBeforeStartPatch(t *testing.T) {
+	defer filet.CleanUp(t)
+	hookPath := buildFakeHook(t)
+
+	runnercfg := &cfg.RunnerConfig{
+		Hooks: []cfg.HookConfig{
+			{Phase: BeforeStart, Command: []string{hookPath, "echo"}},
+			// hooks for other phases do not run
+			{Phase: AfterExit, Command: []string{hookPath, "fail"}},
+		},
+	}
+	state := testState(t)
+
+	require.NoError(t, Run(runnercfg, BeforeStart, &state))
+
+	require.Equal(t, "hunter2", state.WorkerConfig.MustGet("password"))
+
+	env := state.WorkerConfig.MustGet("hook.env").(map[string]interface{})
+	require.Equal(t, map[string]interface{}{
+		"TASKCLUSTER_ROOT_URL":           "https://tc.example.com",
+		"TASKCLUSTER_WORKER_POOL_ID":     "pp/ww",
+		"TASKCLUSTER_WORKER_GROUP":       "wg",
+		"TASKCLUSTER_WORKER_ID":          "wi",
+		"TASKCLUSTER_WORKER_LOCATION":    `{"cloud":"here"}`,
+		"TASKCLUSTER_WORKER_RUNNER_HOOK": "before-start",
+	}, env)
+
+	stdin := state.WorkerConfig.MustGet("hook.stdin").(map[string]interface{})
+	require.Equal(t, "wi", stdin["WorkerID"])
+
+	// worker config is available to hooks, except for secrets
+	hookConfig := stdin["WorkerConfig"].(map[string]interface{})
+	require.Equal(t, map[string]interface{}{"publicIP": "1.2.3.4"}, hookConfig["cloud"])
+	require.Equal(t, "<redacted>", hookConfig["password"])
+	require.Equal(t, "<redacted>", hookConfig["taskcluster"].(map[string]interface{})["accessToken"])
+
+	encoded, err := json.Marshal(stdin)
+	require.NoError(t, err)
+	for _, secret := range []string{"secret-token", "secret-cert", "hunter2", "c2VjcmV0"} {
+		require.False(t, strings.Contains(string(encoded), secret), "stdin contains %s", secret)
+	}
+
+	// the original state is not redacted
+	require.Equal(t, "secret-token", state.Credentials.AccessToken)
+	require.Equal(t, "c2VjcmV0", state.Files[0].Content)
+}
+
+func TestFailureAbort(t *testing.T) {
+	defer filet.CleanUp(t)
+	hookPath := buildFakeHook(t)
+
+	runnercfg := &cfg.RunnerConfig{
+		Hooks: []cfg.HookConfig{
+			{Phase: AfterProvider, Command: []string{hookPath, "fail"}},
+		},
+	}
+	state := testState(t)
+
+	err := Run(runnercfg, AfterProvider, &state)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "after-provider hook")
+}
+
+func TestFailureWarn(t *testing.T) {
+	defer filet.CleanUp(t)
+	hookPath := buildFakeHook(t)
+
+	runnercfg := &cfg.RunnerConfig{
+		Hooks: []cfg.HookConfig{
+			{Phase: AfterExit, Command: []string{hookPath, "fail"}, OnFailure: "warn"},
+			{Phase: AfterExit, Command: []string{filepath.Join(os.TempDir(), "no-such-hook")}, OnFailure: "warn"},
+		},
+	}
+	state := testState(t)
+
+	require.NoError(t, Run(runnercfg, AfterExit, &state))
+}
+
+func TestTimeout(t *testing.T) {
+	defer filet.CleanUp(t)
+	hookPath := buildFakeHook(t)
+
+	runnercfg := &cfg.RunnerConfig{
+		Hooks: []cfg.HookConfig{
+			{Phase: BeforeFiles, Command: []string{hookPath, "sleep"}, Timeout: 1},
+		},
+	}
+	state := testState(t)
+
+	err := Run(runnercfg, BeforeFiles, &state)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out")
+}
+
+func TestTimeoutBackgroundProcess(t *testing.T) {
+	defer filet.CleanUp(t)
+	hookPath := buildFakeHook(t)
+
+	// the hook exits, but a process it started keeps its output open
+	runnercfg := &cfg.RunnerConfig{
+		Hooks: []cfg.HookConfig{
+			{Phase: BeforeStart, Command: []string{hookPath, "background"}, Timeout: 1},
+		},
+	}
+	state := testState(t)
+
+	started := time.Now()
+	err := Run(runnercfg, BeforeStart, &state)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out")
+	require.True(t, time.Since(started) < 30*time.Second)
+}
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, Validate(nil))
+	require.NoError(t, Validate([]cfg.HookConfig{
+		{Phase: AfterProvider, Command: []string{"true"}},
+		{Phase: AfterExit, Command: []string{"true"}, Timeout: 10, OnFailure: "warn"},
+	}))
+
+	require.Error(t, Validate([]cfg.HookConfig{{Phase: "sometime", Command: []string{"true"}}}))
+	require.Error(t, Validate([]cfg.HookConfig{{Phase: BeforeStart}}))
+	require.Error(t, Validate([]cfg.HookConfig{{Phase: BeforeStart, Command: []string{"true"}, Timeout: -1}}))
+	require.Error(t, Validate([]cfg.HookConfig{{Phase: BeforeStart, Command: []string{"true"}, OnFailure: "ignore"}}))
+}
@@ -0,0 +1,19 @@
+// +build linux darwin
+
+package hooks
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Run the hook in its own process group, so that it can be killed along with
+// any processes it starts.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Kill the hook's process group.
+func killHook(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
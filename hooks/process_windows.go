@@ -0,0 +1,16 @@
+// +build windows
+
+package hooks
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// Kill the hook process.  Any processes it started are not killed, but
+// runHook does not wait for them.
+func killHook(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,143 @@
+package lifetime
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+)
+
+// An object to enforce the runner's maxLifetime and idleTimeout by asking the
+// worker to terminate gracefully.
+type Lifetime struct {
+	maxLifetime time.Duration
+	idleTimeout time.Duration
+
+	// the protocol (set in SetProtocol)
+	proto *protocol.Protocol
+
+	// protects the remaining fields, which are accessed from timer and
+	// protocol goroutines
+	mux sync.Mutex
+
+	// a timer for maxLifetime
+	maxLifetimeTimer *time.Timer
+
+	// a timer for idleTimeout, running only while the worker is idle
+	idleTimer *time.Timer
+
+	// true once graceful-termination has been sent, so that it is only sent
+	// once
+	terminating bool
+
+	// true between WorkerStarted and WorkerFinished
+	running bool
+}
+
+func New(runnercfg *cfg.RunnerConfig) *Lifetime {
+	return new(
+		time.Duration(runnercfg.MaxLifetime)*time.Second,
+		time.Duration(runnercfg.IdleTimeout)*time.Second)
+}
+
+// New takes its durations directly, allowing tests to use short durations.
+func new(maxLifetime, idleTimeout time.Duration) *Lifetime {
+	return &Lifetime{maxLifetime: maxLifetime, idleTimeout: idleTimeout}
+}
+
+func (lt *Lifetime) SetProtocol(proto *protocol.Protocol) {
+	lt.proto = proto
+	if lt.idleTimeout > 0 {
+		proto.Register("idle", func(msg protocol.Message) { lt.workerIdle() })
+		proto.Register("busy", func(msg protocol.Message) { lt.workerBusy() })
+	}
+}
+
+func (lt *Lifetime) WorkerStarted() error {
+	lt.mux.Lock()
+	defer lt.mux.Unlock()
+
+	lt.running = true
+	if lt.maxLifetime > 0 {
+		lt.maxLifetimeTimer = time.AfterFunc(lt.maxLifetime, func() {
+			lt.terminate("Worker has reached its maximum lifetime of %s; stopping worker", lt.maxLifetime)
+		})
+	}
+
+	// idleTimeout relies on the worker reporting when it is idle, and that
+	// is not known until the protocol is initialized
+	if lt.idleTimeout > 0 && lt.proto != nil {
+		go func() {
+			if !lt.proto.Capable("idle") {
+				log.Printf("Worker does not support the idle capability; idleTimeout of %s is not in effect", lt.idleTimeout)
+			}
+		}()
+	}
+	return nil
+}
+
+func (lt *Lifetime) WorkerFinished() error {
+	lt.mux.Lock()
+	defer lt.mux.Unlock()
+
+	lt.running = false
+	if lt.maxLifetimeTimer != nil {
+		lt.maxLifetimeTimer.Stop()
+		lt.maxLifetimeTimer = nil
+	}
+	if lt.idleTimer != nil {
+		lt.idleTimer.Stop()
+		lt.idleTimer = nil
+	}
+	return nil
+}
+
+// The worker has reported that it is idle; start the idle timer if it is not
+// already running.
+func (lt *Lifetime) workerIdle() {
+	lt.mux.Lock()
+	defer lt.mux.Unlock()
+
+	if !lt.running || lt.idleTimer != nil {
+		return
+	}
+	lt.idleTimer = time.AfterFunc(lt.idleTimeout, func() {
+		lt.terminate("Worker has been idle for %s; stopping worker", lt.idleTimeout)
+	})
+}
+
+// The worker has reported that it is busy; stop the idle timer.
+func (lt *Lifetime) workerBusy() {
+	lt.mux.Lock()
+	defer lt.mux.Unlock()
+
+	if lt.idleTimer != nil {
+		lt.idleTimer.Stop()
+		lt.idleTimer = nil
+	}
+}
+
+func (lt *Lifetime) terminate(reason string, duration time.Duration) {
+	lt.mux.Lock()
+	if !lt.running || lt.terminating {
+		lt.mux.Unlock()
+		return
+	}
+	lt.terminating = true
+	lt.mux.Unlock()
+
+	log.Printf(reason, duration)
+	if lt.proto != nil && lt.proto.Capable("graceful-termination") {
+		lt.proto.Send(protocol.Message{
+			Type: "graceful-termination",
+			Properties: map[string]interface{}{
+				// there is no hurry, so let any running tasks finish
+				"finish-tasks": true,
+			},
+		})
+	} else {
+		log.Println("Worker does not support graceful-termination; it will continue running")
+	}
+}
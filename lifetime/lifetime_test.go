@@ -0,0 +1,149 @@
+package lifetime
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+)
+
+func setup(lt *Lifetime) *protocol.FakeTransport {
+	transp := protocol.NewFakeTransport()
+	proto := protocol.NewProtocol(transp)
+	proto.Capabilities.Add("graceful-termination")
+	proto.Capabilities.Add("idle")
+	proto.SetInitialized()
+
+	lt.SetProtocol(proto)
+	return transp
+}
+
+var gracefulTermination = protocol.Message{
+	Type: "graceful-termination",
+	Properties: map[string]interface{}{
+		"finish-tasks": true,
+	},
+}
+
+func waitForMessage(transp *protocol.FakeTransport) {
+	for len(transp.Messages()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNew(t *testing.T) {
+	lt := New(&cfg.RunnerConfig{MaxLifetime: 3600, IdleTimeout: 60})
+	assert.Equal(t, time.Hour, lt.maxLifetime)
+	assert.Equal(t, time.Minute, lt.idleTimeout)
+}
+
+func TestMaxLifetime(t *testing.T) {
+	lt := new(50*time.Millisecond, 0)
+	transp := setup(lt)
+
+	require.NoError(t, lt.WorkerStarted())
+	waitForMessage(transp)
+
+	// wait a bit longer to check that the message is only sent once
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []protocol.Message{gracefulTermination}, transp.Messages())
+
+	require.NoError(t, lt.WorkerFinished())
+}
+
+func TestIdleTimeout(t *testing.T) {
+	lt := new(0, 50*time.Millisecond)
+	transp := setup(lt)
+
+	require.NoError(t, lt.WorkerStarted())
+	lt.workerIdle()
+	waitForMessage(transp)
+	assert.Equal(t, []protocol.Message{gracefulTermination}, transp.Messages())
+
+	require.NoError(t, lt.WorkerFinished())
+}
+
+func TestBusyResetsIdleTimeout(t *testing.T) {
+	lt := new(0, 100*time.Millisecond)
+	transp := setup(lt)
+
+	require.NoError(t, lt.WorkerStarted())
+
+	// the worker is never idle for long enough
+	for i := 0; i < 5; i++ {
+		lt.workerIdle()
+		time.Sleep(50 * time.Millisecond)
+		lt.workerBusy()
+	}
+	assert.Equal(t, []protocol.Message{}, transp.Messages())
+
+	// repeated idle messages do not restart the timer
+	lt.workerIdle()
+	time.Sleep(50 * time.Millisecond)
+	lt.workerIdle()
+	time.Sleep(75 * time.Millisecond)
+	assert.Equal(t, []protocol.Message{gracefulTermination}, transp.Messages())
+
+	require.NoError(t, lt.WorkerFinished())
+}
+
+func TestWorkerFinishedStopsTimers(t *testing.T) {
+	lt := new(50*time.Millisecond, 50*time.Millisecond)
+	transp := setup(lt)
+
+	require.NoError(t, lt.WorkerStarted())
+	lt.workerIdle()
+	require.NoError(t, lt.WorkerFinished())
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []protocol.Message{}, transp.Messages())
+}
+
+// A log destination that can be read while it is written
+type logBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.String()
+}
+
+func TestIdleTimeoutWithoutIdleCapability(t *testing.T) {
+	logs := &logBuffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	for _, capable := range []bool{true, false} {
+		lt := new(0, time.Hour)
+		proto := protocol.NewProtocol(protocol.NewFakeTransport())
+		if capable {
+			proto.Capabilities.Add("idle")
+		}
+		lt.SetProtocol(proto)
+
+		require.NoError(t, lt.WorkerStarted())
+		proto.SetInitialized()
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, lt.WorkerFinished())
+
+		warned := strings.Contains(logs.String(), "idleTimeout of 1h0m0s is not in effect")
+		assert.Equal(t, !capable, warned)
+	}
+}
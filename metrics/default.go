@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+)
+
+// The default registry, used by the package-level functions
+var Default = NewRegistry()
+
+// Record the duration of a phase of the runner's operation
+func ObservePhase(phase string, duration time.Duration) {
+	Default.ObservePhase(phase, duration)
+}
+
+// Record that the worker has started
+func WorkerStarted(cached bool) {
+	Default.WorkerStarted(cached)
+}
+
+// Record that the worker has exited
+func WorkerExited(code int) {
+	Default.WorkerExited(code)
+}
+
+// Set the expiration time of the worker's credentials
+func SetCredentialsExpire(expires time.Time) {
+	Default.SetCredentialsExpire(expires)
+}
+
+// Record a termination notice from the given provider
+func TerminationNotice(provider, kind, id string) {
+	Default.TerminationNotice(provider, kind, id)
+}
+
+// Wrap the given transport so that messages are counted in the default
+// registry.
+func WrapTransport(transp protocol.Transport) protocol.Transport {
+	return &metricsTransport{transp, Default}
+}
+
+// metricsTransport wraps a Transport to count messages
+type metricsTransport struct {
+	protocol.Transport
+	registry *Registry
+}
+
+func (transp *metricsTransport) Send(msg protocol.Message) {
+	transp.registry.Message("sent", msg.Type)
+	transp.Transport.Send(msg)
+}
+
+func (transp *metricsTransport) Recv() (protocol.Message, bool) {
+	msg, ok := transp.Transport.Recv()
+	if ok {
+		transp.registry.Message("received", msg.Type)
+	}
+	return msg, ok
+}
@@ -0,0 +1,308 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Buckets for phase-duration histograms, in seconds.  Registration with
+// worker-manager and fetching secrets generally take a few seconds, but can
+// take much longer when services are degraded.
+var phaseBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, le := range h.buckets {
+		if value <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Registry holds the metrics for a run of start-worker.  Most users should
+// use the package-level functions, which operate on a default registry.
+type Registry struct {
+	mux sync.Mutex
+
+	phaseDurations     map[string]*histogram
+	messages           map[[2]string]uint64
+	protocolErrors     map[string]uint64
+	workerStarts       map[string]uint64
+	workerExits        map[string]uint64
+	credentialsExpire  time.Time
+	terminationNotices map[[2]string]uint64
+
+	// termination notices already counted, by provider/kind/id
+	seenNotices map[string]bool
+
+	// metrics forwarded from the worker, by name, and labels added to them
+	workerMetrics map[string]*workerMetric
+	baseLabels    map[string]string
+
+	// limits on forwarded metrics, and samples dropped for exceeding them, by
+	// limit ("metrics" or "series")
+	maxWorkerMetrics int
+	maxWorkerSeries  int
+	droppedSamples   map[string]uint64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		phaseDurations:     make(map[string]*histogram),
+		messages:           make(map[[2]string]uint64),
+		protocolErrors:     make(map[string]uint64),
+		workerStarts:       make(map[string]uint64),
+		workerExits:        make(map[string]uint64),
+		terminationNotices: make(map[[2]string]uint64),
+		seenNotices:        make(map[string]bool),
+		workerMetrics:      make(map[string]*workerMetric),
+		baseLabels:         make(map[string]string),
+		maxWorkerMetrics:   maxWorkerMetrics,
+		maxWorkerSeries:    maxWorkerSeries,
+		droppedSamples:     make(map[string]uint64),
+	}
+}
+
+// Record the duration of a phase of the runner's operation
+func (r *Registry) ObservePhase(phase string, duration time.Duration) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	h, ok := r.phaseDurations[phase]
+	if !ok {
+		h = newHistogram(phaseBuckets)
+		r.phaseDurations[phase] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// Record a protocol message; direction is "sent" (to the worker) or
+// "received" (from the worker)
+func (r *Registry) Message(direction, messageType string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.messages[[2]string{direction, messageType}]++
+}
+
+// Record an error handling a protocol message from the worker, by kind (see
+// protocol.ErrorCallback)
+func (r *Registry) ProtocolError(kind string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.protocolErrors[kind]++
+}
+
+// Record that the worker has started; cached indicates that it was started
+// from cached state, meaning that it is restarting.
+func (r *Registry) WorkerStarted(cached bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.workerStarts[strconv.FormatBool(cached)]++
+}
+
+// Record that the worker has exited with the given exit code, or -1 if it is
+// not known
+func (r *Registry) WorkerExited(code int) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.workerExits[strconv.Itoa(code)]++
+}
+
+// Set the expiration time of the worker's credentials
+func (r *Registry) SetCredentialsExpire(expires time.Time) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.credentialsExpire = expires
+}
+
+// Record a termination notice from the given provider.  Providers which poll
+// for notices may see the same notice repeatedly; a notice with an id that has
+// already been recorded is ignored.  An empty id is always recorded.
+func (r *Registry) TerminationNotice(provider, kind, id string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if id != "" {
+		key := provider + "/" + kind + "/" + id
+		if r.seenNotices[key] {
+			return
+		}
+		r.seenNotices[key] = true
+	}
+	r.terminationNotices[[2]string{provider, kind}]++
+}
+
+// Write the metrics in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	header(cw, "worker_runner_phase_duration_seconds", "histogram",
+		"Duration of each phase of starting the worker.")
+	for _, phase := range sortedKeys(r.phaseDurations) {
+		writeHistogram(cw, "worker_runner_phase_duration_seconds", "phase="+quote(phase), r.phaseDurations[phase])
+	}
+
+	header(cw, "worker_runner_protocol_messages_total", "counter",
+		"Protocol messages exchanged with the worker, by direction and type.")
+	for _, key := range sortedPairs(r.messages) {
+		fmt.Fprintf(cw, "worker_runner_protocol_messages_total{direction=%s,type=%s} %d\n",
+			quote(key[0]), quote(key[1]), r.messages[key])
+	}
+
+	header(cw, "worker_runner_protocol_errors_total", "counter",
+		"Errors handling protocol messages from the worker, by kind.")
+	for _, kind := range sortedKeys(r.protocolErrors) {
+		fmt.Fprintf(cw, "worker_runner_protocol_errors_total{kind=%s} %d\n", quote(kind), r.protocolErrors[kind])
+	}
+
+	header(cw, "worker_runner_worker_starts_total", "counter",
+		"Worker starts; cached=\"true\" indicates a restart using cached state.")
+	for _, cached := range sortedKeys(r.workerStarts) {
+		fmt.Fprintf(cw, "worker_runner_worker_starts_total{cached=%s} %d\n", quote(cached), r.workerStarts[cached])
+	}
+
+	header(cw, "worker_runner_worker_exits_total", "counter",
+		"Worker exits, by exit code (-1 if unknown).")
+	for _, code := range sortedKeys(r.workerExits) {
+		fmt.Fprintf(cw, "worker_runner_worker_exits_total{code=%s} %d\n", quote(code), r.workerExits[code])
+	}
+
+	if !r.credentialsExpire.IsZero() {
+		header(cw, "worker_runner_credentials_expiry_seconds", "gauge",
+			"Seconds until the worker's credentials expire.")
+		fmt.Fprintf(cw, "worker_runner_credentials_expiry_seconds %s\n",
+			strconv.FormatFloat(time.Until(r.credentialsExpire).Seconds(), 'f', 3, 64))
+	}
+
+	header(cw, "worker_runner_termination_notices_total", "counter",
+		"Termination notices received from the cloud provider, by provider and kind.")
+	for _, key := range sortedPairs(r.terminationNotices) {
+		fmt.Fprintf(cw, "worker_runner_termination_notices_total{provider=%s,kind=%s} %d\n",
+			quote(key[0]), quote(key[1]), r.terminationNotices[key])
+	}
+
+	header(cw, "worker_runner_worker_samples_dropped_total", "counter",
+		"Metric samples from the worker dropped for exceeding the limit on forwarded metrics or series, by limit.")
+	for _, limit := range sortedKeys(r.droppedSamples) {
+		fmt.Fprintf(cw, "worker_runner_worker_samples_dropped_total{limit=%s} %d\n", quote(limit), r.droppedSamples[limit])
+	}
+
+	r.writeWorkerMetrics(cw)
+
+	err := cw.w.(*bufio.Writer).Flush()
+	if err == nil {
+		err = cw.err
+	}
+	return cw.n, err
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, le := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(le), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), h.count)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Surround a non-empty label string with braces
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func header(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// Quote a label value, which must be valid UTF-8 with backslashes, double
+// quotes, and newlines escaped
+func quote(value string) string {
+	if !utf8.ValidString(value) {
+		value = string([]rune(value))
+	}
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return `"` + value + `"`
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]uint64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedPairs(m map[[2]string]uint64) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+// countingWriter counts bytes written and remembers the first error, so that
+// WriteTo can use fmt.Fprintf freely
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,214 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+)
+
+func metricsText(t *testing.T, r *Registry) string {
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(buf.Len()), n)
+	return buf.String()
+}
+
+func TestEmptyRegistry(t *testing.T) {
+	text := metricsText(t, NewRegistry())
+	assert.Contains(t, text, "# TYPE worker_runner_phase_duration_seconds histogram\n")
+	assert.Contains(t, text, "# TYPE worker_runner_protocol_messages_total counter\n")
+	assert.NotContains(t, text, "credentials_expiry")
+}
+
+func TestPhaseHistogram(t *testing.T) {
+	r := NewRegistry()
+	r.ObservePhase("provider", 2*time.Second)
+	r.ObservePhase("provider", 200*time.Second)
+
+	text := metricsText(t, r)
+	for _, line := range []string{
+		`worker_runner_phase_duration_seconds_bucket{phase="provider",le="1"} 0`,
+		`worker_runner_phase_duration_seconds_bucket{phase="provider",le="2.5"} 1`,
+		`worker_runner_phase_duration_seconds_bucket{phase="provider",le="120"} 1`,
+		`worker_runner_phase_duration_seconds_bucket{phase="provider",le="300"} 2`,
+		`worker_runner_phase_duration_seconds_bucket{phase="provider",le="+Inf"} 2`,
+		`worker_runner_phase_duration_seconds_sum{phase="provider"} 202`,
+		`worker_runner_phase_duration_seconds_count{phase="provider"} 2`,
+	} {
+		assert.Contains(t, text, line+"\n")
+	}
+}
+
+func TestCounters(t *testing.T) {
+	r := NewRegistry()
+	r.Message("sent", "welcome")
+	r.Message("received", "hello")
+	r.Message("received", "hello")
+	r.ProtocolError("invalid-message")
+	r.WorkerStarted(false)
+	r.WorkerStarted(true)
+	r.WorkerExited(0)
+	r.WorkerExited(67)
+	r.WorkerExited(67)
+
+	text := metricsText(t, r)
+	for _, line := range []string{
+		`worker_runner_protocol_messages_total{direction="received",type="hello"} 2`,
+		`worker_runner_protocol_messages_total{direction="sent",type="welcome"} 1`,
+		`worker_runner_protocol_errors_total{kind="invalid-message"} 1`,
+		`worker_runner_worker_starts_total{cached="false"} 1`,
+		`worker_runner_worker_starts_total{cached="true"} 1`,
+		`worker_runner_worker_exits_total{code="0"} 1`,
+		`worker_runner_worker_exits_total{code="67"} 2`,
+	} {
+		assert.Contains(t, text, line+"\n")
+	}
+}
+
+func TestTerminationNotices(t *testing.T) {
+	r := NewRegistry()
+	r.TerminationNotice("aws", "termination-time", "termination-time")
+	r.TerminationNotice("aws", "termination-time", "termination-time")
+	r.TerminationNotice("azure", "Preempt", "evt1")
+	r.TerminationNotice("azure", "Preempt", "evt2")
+	r.TerminationNotice("kubernetes", "sigterm", "")
+	r.TerminationNotice("kubernetes", "sigterm", "")
+
+	text := metricsText(t, r)
+	for _, line := range []string{
+		`worker_runner_termination_notices_total{provider="aws",kind="termination-time"} 1`,
+		`worker_runner_termination_notices_total{provider="azure",kind="Preempt"} 2`,
+		`worker_runner_termination_notices_total{provider="kubernetes",kind="sigterm"} 2`,
+	} {
+		assert.Contains(t, text, line+"\n")
+	}
+}
+
+func TestCredentialsExpiry(t *testing.T) {
+	r := NewRegistry()
+	r.SetCredentialsExpire(time.Now().Add(time.Hour))
+
+	text := metricsText(t, r)
+	prefix := "\nworker_runner_credentials_expiry_seconds "
+	i := strings.Index(text, prefix)
+	require.NotEqual(t, -1, i)
+	value, err := strconv.ParseFloat(strings.SplitN(text[i+len(prefix):], "\n", 2)[0], 64)
+	require.NoError(t, err)
+	assert.True(t, value > 3590 && value <= 3600, "got %f", value)
+}
+
+func TestQuote(t *testing.T) {
+	assert.Equal(t, `"a\"b\\c\nd"`, quote("a\"b\\c\nd"))
+	assert.Equal(t, `"ünïcödé"`, quote("ünïcödé"))
+	// invalid UTF-8 is replaced
+	assert.Equal(t, "\"a\uFFFDb\"", quote("a\xffb"))
+}
+
+func TestLabelEscaping(t *testing.T) {
+	r := NewRegistry()
+	r.SetBaseLabels(IdentityLabels(&run.State{
+		WorkerPoolID:   "pp/ww",
+		WorkerLocation: map[string]string{"zone": "a \"quoted\" zone"},
+	}))
+	r.TerminationNotice("azure", "Pre\"empt\n\\", "")
+	require.NoError(t, r.RecordSample(Sample{"tasks_total", "counter", 1, map[string]string{"task": "line1\nline2\\"}}))
+
+	text := metricsText(t, r)
+	for _, line := range []string{
+		`worker_runner_termination_notices_total{provider="azure",kind="Pre\"empt\n\\"} 1`,
+		`tasks_total{location_zone="a \"quoted\" zone",task="line1\nline2\\",worker_pool_id="pp/ww"} 1`,
+	} {
+		assert.Contains(t, text, "\n"+line+"\n")
+	}
+
+	// every line is a comment or a sample, so no value has broken a line
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		assert.Regexp(t, `^(# |[a-z_]+(\{.*\})? \S+$)`, line)
+	}
+}
+
+func TestWrapTransport(t *testing.T) {
+	r := NewRegistry()
+	transp := protocol.NewFakeTransport()
+	wrapped := &metricsTransport{transp, r}
+
+	wrapped.Send(protocol.Message{Type: "graceful-termination"})
+	assert.Equal(t, 1, len(transp.Messages()))
+	assert.Contains(t, metricsText(t, r), `worker_runner_protocol_messages_total{direction="sent",type="graceful-termination"} 1`)
+}
+
+func TestServer(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	textfile := filepath.Join(dir, "worker-runner.prom")
+
+	r := NewRegistry()
+	r.WorkerStarted(false)
+
+	s, err := start(cfg.MetricsConfig{Listen: "127.0.0.1:0", Textfile: textfile}, r)
+	require.NoError(t, err)
+
+	res, err := http.Get("http://" + s.Addr().String() + "/metrics")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain"))
+	assert.Contains(t, string(body), `worker_runner_worker_starts_total{cached="false"} 1`)
+
+	r.WorkerExited(1)
+	require.NoError(t, s.Close())
+
+	content, err := ioutil.ReadFile(textfile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `worker_runner_worker_exits_total{code="1"} 1`)
+
+	// only the textfile remains in the directory
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+}
+
+func TestListenAddress(t *testing.T) {
+	for _, tc := range [][2]string{
+		{":9101", "127.0.0.1:9101"},
+		{"127.0.0.1:9101", "127.0.0.1:9101"},
+		{"0.0.0.0:9101", "0.0.0.0:9101"},
+		{"[::]:9101", "[::]:9101"},
+	} {
+		address, err := listenAddress(tc[0])
+		require.NoError(t, err)
+		assert.Equal(t, tc[1], address)
+	}
+
+	_, err := listenAddress("9101")
+	assert.Error(t, err)
+}
+
+func TestServerDefaultsToLoopback(t *testing.T) {
+	s, err := start(cfg.MetricsConfig{Listen: ":0"}, NewRegistry())
+	require.NoError(t, err)
+	defer s.Close()
+	assert.True(t, s.Addr().(*net.TCPAddr).IP.IsLoopback(), s.Addr().String())
+}
+
+func TestDisabled(t *testing.T) {
+	s, err := start(cfg.MetricsConfig{}, NewRegistry())
+	require.NoError(t, err)
+	assert.Nil(t, s.Addr())
+	assert.NoError(t, s.Close())
+}
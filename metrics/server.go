@@ -0,0 +1,197 @@
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+)
+
+// Server serves the metrics in a Registry over HTTP and writes them to a
+// textfile, as configured.  It also handles metrics forwarded from the worker,
+// recording them in the registry and pushing them to any sinks.
+type Server struct {
+	registry *Registry
+	textfile string
+	listener net.Listener
+	server   *http.Server
+	sinks    []Sink
+}
+
+// Start serving the default registry's metrics, if configured
+func Start(runnercfg *cfg.RunnerConfig) (*Server, error) {
+	return start(runnercfg.Metrics, Default)
+}
+
+func start(config cfg.MetricsConfig, registry *Registry) (*Server, error) {
+	s := &Server{registry: registry, textfile: config.Textfile}
+
+	if config.StatsD.Address != "" {
+		sink, err := newStatsdSink(config.StatsD.Address, config.StatsD.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		s.sinks = append(s.sinks, sink)
+	}
+
+	if config.Listen == "" {
+		return s, nil
+	}
+
+	address, err := listenAddress(config.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("Error starting metrics server: %s", err)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Error starting metrics server: %s", err)
+	}
+	s.listener = listener
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	s.server = &http.Server{Handler: mux}
+
+	go func() {
+		err := s.server.Serve(listener)
+		if err != http.ErrServerClosed {
+			log.Printf("Error from metrics server: %s", err)
+		}
+	}()
+	log.Printf("Serving metrics on %s", address)
+
+	return s, nil
+}
+
+// Get the address on which to listen, given the configured address.  An
+// address without a host, such as `:9101`, listens only on the loopback
+// interface; metrics are served on other interfaces only if configured
+// explicitly, such as with `0.0.0.0:9101`.
+func listenAddress(listen string) (string, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// Get the address on which the server is listening, or nil if it is not
+// running.
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Set the worker's identity, which is added to the labels of metrics
+// forwarded from the worker.
+func (s *Server) SetIdentity(state *run.State) {
+	s.registry.SetBaseLabels(IdentityLabels(state))
+}
+
+// The number of metrics messages queued for handling; beyond this, messages
+// from a worker sending metrics faster than they can be pushed are dropped
+const metricsQueueSize = 100
+
+func (s *Server) SetProtocol(proto *protocol.Protocol) {
+	// pushing to sinks involves I/O, so this should not delay other messages
+	proto.RegisterAsync("metrics", metricsQueueSize, s.handleMetricsMessage)
+	proto.RegisterErrorCallback(func(kind string, err error) {
+		s.registry.ProtocolError(kind)
+	})
+}
+
+func (s *Server) handleMetricsMessage(msg protocol.Message) {
+	samples, err := ParseSamples(msg)
+	if err != nil {
+		log.Printf("Invalid metrics message from worker (ignored): %s", err)
+		return
+	}
+
+	for _, sample := range samples {
+		err = s.registry.RecordSample(sample)
+		if err == ErrSampleDropped {
+			// RecordSample logs this, without repeating it for every sample
+			continue
+		}
+		if err != nil {
+			log.Printf("Invalid metrics sample from worker (ignored): %s", err)
+			continue
+		}
+
+		labels := s.registry.SampleLabels(sample)
+		for _, sink := range s.sinks {
+			err = sink.Push(sample, labels)
+			if err != nil {
+				log.Printf("Error pushing metrics sample: %s", err)
+			}
+		}
+	}
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, err := s.registry.WriteTo(w)
+	if err != nil {
+		log.Printf("Error writing metrics: %s", err)
+	}
+}
+
+// Write the metrics to the textfile, if configured.  The file is replaced
+// atomically, so that a collector never sees a partial file.
+func (s *Server) WriteTextfile() error {
+	if s.textfile == "" {
+		return nil
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.textfile), ".worker-runner-metrics")
+	if err != nil {
+		return err
+	}
+	_, err = s.registry.WriteTo(f)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.textfile)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Error writing metrics to %s: %s", s.textfile, err)
+	}
+	return nil
+}
+
+// Stop the HTTP server, if it is running, write the textfile, if configured,
+// and close any sinks.
+func (s *Server) Close() error {
+	err := s.WriteTextfile()
+	if s.server != nil {
+		closeErr := s.server.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	for _, sink := range s.sinks {
+		closeErr := sink.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Sink receives samples forwarded from the worker, along with their labels
+// (including the worker's identity labels), and pushes them elsewhere.
+type Sink interface {
+	Push(s Sample, labels map[string]string) error
+	Close() error
+}
+
+// statsdSink pushes samples to a StatsD server over UDP, using the DogStatsD
+// tag extension for labels.
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+func newStatsdSink(address, prefix string) (*statsdSink, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to StatsD at %s: %s", address, err)
+	}
+	return &statsdSink{conn, prefix}, nil
+}
+
+// StatsD metric types for each sample kind
+var statsdTypes = map[string]string{
+	"counter":   "c",
+	"gauge":     "g",
+	"histogram": "h",
+}
+
+// Format a sample as a StatsD line
+func formatStatsd(prefix string, s Sample, labels map[string]string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s%s:%s|%s", prefix, s.Name, formatFloat(s.Value), statsdTypes[s.Kind])
+
+	if len(labels) > 0 {
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		tags := make([]string, len(names))
+		for i, name := range names {
+			// characters with meaning in the StatsD line format cannot appear
+			// in tag values
+			value := strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_").Replace(labels[name])
+			tags[i] = name + ":" + value
+		}
+		buf.WriteString("|#")
+		buf.WriteString(strings.Join(tags, ","))
+	}
+	return buf.Bytes()
+}
+
+func (sink *statsdSink) Push(s Sample, labels map[string]string) error {
+	_, err := sink.conn.Write(formatStatsd(sink.prefix, s, labels))
+	return err
+}
+
+func (sink *statsdSink) Close() error {
+	return sink.conn.Close()
+}
@@ -0,0 +1,258 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+)
+
+// Buckets for histograms forwarded from the worker, matching the Prometheus
+// client libraries' defaults
+var workerBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Limits on the metrics forwarded from the worker, so that a worker using
+// labels with unbounded values (such as task IDs) cannot use unbounded memory
+const (
+	maxWorkerMetrics = 100
+	maxWorkerSeries  = 100
+)
+
+// ErrSampleDropped is returned from RecordSample when a sample is dropped
+// because it would exceed the limit on forwarded metrics or series.
+var ErrSampleDropped = errors.New("too many forwarded metrics or series; sample dropped")
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// Sample is a single metric sample forwarded from the worker.  For counters,
+// Value is an increment; for gauges, it is the new value; and for histograms,
+// it is an observation.
+type Sample struct {
+	Name   string
+	Kind   string
+	Value  float64
+	Labels map[string]string
+}
+
+// Parse the samples in a `metrics` message from the worker
+func ParseSamples(msg protocol.Message) ([]Sample, error) {
+	list, ok := msg.Properties["samples"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("metrics message must have a samples array")
+	}
+
+	samples := make([]Sample, 0, len(list))
+	for i, item := range list {
+		sample, err := parseSample(item)
+		if err != nil {
+			return nil, fmt.Errorf("samples[%d]: %s", i, err)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+func parseSample(item interface{}) (Sample, error) {
+	var s Sample
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return s, fmt.Errorf("sample must be an object")
+	}
+
+	s.Name, _ = m["name"].(string)
+	if !metricNameRegexp.MatchString(s.Name) {
+		return s, fmt.Errorf("invalid metric name %q", s.Name)
+	}
+	if strings.HasPrefix(s.Name, "worker_runner_") {
+		return s, fmt.Errorf("metric name %q uses the reserved prefix worker_runner_", s.Name)
+	}
+
+	s.Kind, _ = m["kind"].(string)
+	if s.Kind != "counter" && s.Kind != "gauge" && s.Kind != "histogram" {
+		return s, fmt.Errorf("kind must be counter, gauge, or histogram")
+	}
+
+	s.Value, ok = m["value"].(float64)
+	if !ok {
+		return s, fmt.Errorf("value must be a number")
+	}
+	if s.Kind == "counter" && s.Value < 0 {
+		return s, fmt.Errorf("counter increments must not be negative")
+	}
+
+	s.Labels = make(map[string]string)
+	if labels, ok := m["labels"]; ok {
+		labelMap, ok := labels.(map[string]interface{})
+		if !ok {
+			return s, fmt.Errorf("labels must be an object")
+		}
+		for name, value := range labelMap {
+			if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") || name == "le" {
+				return s, fmt.Errorf("invalid label name %q", name)
+			}
+			s.Labels[name], ok = value.(string)
+			if !ok {
+				return s, fmt.Errorf("label %s must be a string", name)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// Get the labels identifying this worker, to be added to forwarded samples:
+// worker_pool_id, and location_<key> for each key in the worker location.
+func IdentityLabels(state *run.State) map[string]string {
+	labels := map[string]string{
+		"worker_pool_id": state.WorkerPoolID,
+	}
+	for key, value := range state.WorkerLocation {
+		labels["location_"+invalidLabelChars.ReplaceAllString(key, "_")] = value
+	}
+	return labels
+}
+
+// A metric forwarded from the worker, with a series for each distinct set of
+// labels
+type workerMetric struct {
+	kind   string
+	series map[string]*workerSeries
+
+	// true once a sample has been dropped for exceeding the series limit
+	limited bool
+}
+
+type workerSeries struct {
+	labels string
+	value  float64
+	hist   *histogram
+}
+
+// Set the labels added to all forwarded samples.  These take precedence over
+// labels in the samples themselves.
+func (r *Registry) SetBaseLabels(labels map[string]string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.baseLabels = make(map[string]string)
+	for k, v := range labels {
+		r.baseLabels[k] = v
+	}
+}
+
+// Get the labels for a sample, including the base labels
+func (r *Registry) SampleLabels(s Sample) map[string]string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.sampleLabels(s)
+}
+
+func (r *Registry) sampleLabels(s Sample) map[string]string {
+	labels := make(map[string]string)
+	for k, v := range s.Labels {
+		labels[k] = v
+	}
+	for k, v := range r.baseLabels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// Record a sample forwarded from the worker
+func (r *Registry) RecordSample(s Sample) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	m, ok := r.workerMetrics[s.Name]
+	if !ok {
+		if len(r.workerMetrics) >= r.maxWorkerMetrics {
+			if r.droppedSamples["metrics"] == 0 {
+				log.Printf("Worker has forwarded %d metrics; dropping samples for new metrics such as %s", len(r.workerMetrics), s.Name)
+			}
+			r.droppedSamples["metrics"]++
+			return ErrSampleDropped
+		}
+		m = &workerMetric{kind: s.Kind, series: make(map[string]*workerSeries)}
+		r.workerMetrics[s.Name] = m
+	} else if m.kind != s.Kind {
+		return fmt.Errorf("metric %s is a %s, not a %s", s.Name, m.kind, s.Kind)
+	}
+
+	labels := formatLabels(r.sampleLabels(s))
+	series, ok := m.series[labels]
+	if !ok {
+		if len(m.series) >= r.maxWorkerSeries {
+			if !m.limited {
+				log.Printf("Worker has forwarded %d series of metric %s; dropping samples with new labels", len(m.series), s.Name)
+				m.limited = true
+			}
+			r.droppedSamples["series"]++
+			return ErrSampleDropped
+		}
+		series = &workerSeries{labels: labels}
+		if s.Kind == "histogram" {
+			series.hist = newHistogram(workerBuckets)
+		}
+		m.series[labels] = series
+	}
+
+	switch s.Kind {
+	case "counter":
+		series.value += s.Value
+	case "gauge":
+		series.value = s.Value
+	case "histogram":
+		series.hist.observe(s.Value)
+	}
+	return nil
+}
+
+// Format labels for the text exposition format, sorted by name
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=" + quote(labels[name])
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r *Registry) writeWorkerMetrics(cw *countingWriter) {
+	names := make([]string, 0, len(r.workerMetrics))
+	for name := range r.workerMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		m := r.workerMetrics[name]
+		header(cw, name, m.kind, "Forwarded from the worker.")
+
+		keys := make([]string, 0, len(m.series))
+		for key := range m.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			series := m.series[key]
+			if m.kind == "histogram" {
+				writeHistogram(cw, name, series.labels, series.hist)
+			} else {
+				fmt.Fprintf(cw, "%s%s %s\n", name, braces(series.labels), formatFloat(series.value))
+			}
+		}
+	}
+}
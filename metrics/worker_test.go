@@ -0,0 +1,190 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+)
+
+// Decode a message as it would arrive over the protocol
+func decodeMessage(t *testing.T, encoded string) protocol.Message {
+	var msg protocol.Message
+	require.NoError(t, json.Unmarshal([]byte(encoded), &msg))
+	return msg
+}
+
+func TestParseSamples(t *testing.T) {
+	msg := decodeMessage(t, `{"type": "metrics", "samples": [
+		{"name": "tasks_total", "kind": "counter", "value": 1, "labels": {"status": "completed"}},
+		{"name": "disk_free_bytes", "kind": "gauge", "value": 1024}
+	]}`)
+	samples, err := ParseSamples(msg)
+	require.NoError(t, err)
+	assert.Equal(t, []Sample{
+		{"tasks_total", "counter", 1, map[string]string{"status": "completed"}},
+		{"disk_free_bytes", "gauge", 1024, map[string]string{}},
+	}, samples)
+}
+
+func TestParseSamplesInvalid(t *testing.T) {
+	for _, sample := range []string{
+		`"not-an-object"`,
+		`{"name": "bad-name", "kind": "counter", "value": 1}`,
+		`{"name": "worker_runner_x", "kind": "counter", "value": 1}`,
+		`{"name": "x", "kind": "summary", "value": 1}`,
+		`{"name": "x", "kind": "counter", "value": "1"}`,
+		`{"name": "x", "kind": "counter", "value": -1}`,
+		`{"name": "x", "kind": "gauge", "value": 1, "labels": ["a"]}`,
+		`{"name": "x", "kind": "gauge", "value": 1, "labels": {"bad-label": "a"}}`,
+		`{"name": "x", "kind": "gauge", "value": 1, "labels": {"le": "a"}}`,
+		`{"name": "x", "kind": "gauge", "value": 1, "labels": {"a": 1}}`,
+	} {
+		msg := decodeMessage(t, `{"type": "metrics", "samples": [`+sample+`]}`)
+		_, err := ParseSamples(msg)
+		assert.Error(t, err, sample)
+	}
+
+	_, err := ParseSamples(decodeMessage(t, `{"type": "metrics"}`))
+	assert.Error(t, err)
+}
+
+func TestIdentityLabels(t *testing.T) {
+	labels := IdentityLabels(&run.State{
+		WorkerPoolID:   "pp/ww",
+		WorkerLocation: map[string]string{"cloud": "aws", "availability-zone": "us-east-1a"},
+	})
+	assert.Equal(t, map[string]string{
+		"worker_pool_id":             "pp/ww",
+		"location_cloud":             "aws",
+		"location_availability_zone": "us-east-1a",
+	}, labels)
+}
+
+func TestRecordSample(t *testing.T) {
+	r := NewRegistry()
+	r.SetBaseLabels(map[string]string{"worker_pool_id": "pp/ww"})
+
+	require.NoError(t, r.RecordSample(Sample{"tasks_total", "counter", 1, map[string]string{"status": "completed"}}))
+	require.NoError(t, r.RecordSample(Sample{"tasks_total", "counter", 2, map[string]string{"status": "completed"}}))
+	require.NoError(t, r.RecordSample(Sample{"tasks_total", "counter", 1, map[string]string{"status": "failed"}}))
+	require.NoError(t, r.RecordSample(Sample{"disk_free_bytes", "gauge", 10, nil}))
+	require.NoError(t, r.RecordSample(Sample{"disk_free_bytes", "gauge", 5, nil}))
+	require.NoError(t, r.RecordSample(Sample{"task_seconds", "histogram", 0.3, nil}))
+	require.NoError(t, r.RecordSample(Sample{"task_seconds", "histogram", 7, nil}))
+
+	// base labels take precedence
+	require.NoError(t, r.RecordSample(Sample{"spoofed", "gauge", 1, map[string]string{"worker_pool_id": "other/pool"}}))
+
+	// a metric's kind cannot change
+	require.Error(t, r.RecordSample(Sample{"tasks_total", "gauge", 1, nil}))
+
+	text := metricsText(t, r)
+	for _, line := range []string{
+		`# TYPE disk_free_bytes gauge`,
+		`disk_free_bytes{worker_pool_id="pp/ww"} 5`,
+		`spoofed{worker_pool_id="pp/ww"} 1`,
+		`# TYPE task_seconds histogram`,
+		`task_seconds_bucket{worker_pool_id="pp/ww",le="0.25"} 0`,
+		`task_seconds_bucket{worker_pool_id="pp/ww",le="0.5"} 1`,
+		`task_seconds_bucket{worker_pool_id="pp/ww",le="10"} 2`,
+		`task_seconds_bucket{worker_pool_id="pp/ww",le="+Inf"} 2`,
+		`task_seconds_sum{worker_pool_id="pp/ww"} 7.3`,
+		`task_seconds_count{worker_pool_id="pp/ww"} 2`,
+		`# TYPE tasks_total counter`,
+		`tasks_total{status="completed",worker_pool_id="pp/ww"} 3`,
+		`tasks_total{status="failed",worker_pool_id="pp/ww"} 1`,
+	} {
+		assert.Contains(t, text, line+"\n")
+	}
+}
+
+func TestRecordSampleLimits(t *testing.T) {
+	r := NewRegistry()
+	r.maxWorkerMetrics = 2
+	r.maxWorkerSeries = 2
+
+	// a label with unbounded values only creates series up to the limit
+	for _, task := range []string{"t1", "t2", "t3", "t4"} {
+		err := r.RecordSample(Sample{"tasks_total", "counter", 1, map[string]string{"task": task}})
+		if task == "t1" || task == "t2" {
+			require.NoError(t, err)
+		} else {
+			require.Equal(t, ErrSampleDropped, err)
+		}
+	}
+	// existing series are still updated
+	require.NoError(t, r.RecordSample(Sample{"tasks_total", "counter", 1, map[string]string{"task": "t1"}}))
+
+	// as are existing metrics, but new metrics beyond the limit are dropped
+	require.NoError(t, r.RecordSample(Sample{"disk_free_bytes", "gauge", 10, nil}))
+	require.Equal(t, ErrSampleDropped, r.RecordSample(Sample{"load", "gauge", 1, nil}))
+
+	text := metricsText(t, r)
+	for _, line := range []string{
+		`tasks_total{task="t1"} 2`,
+		`tasks_total{task="t2"} 1`,
+		`disk_free_bytes 10`,
+		`worker_runner_worker_samples_dropped_total{limit="metrics"} 1`,
+		`worker_runner_worker_samples_dropped_total{limit="series"} 2`,
+	} {
+		assert.Contains(t, text, line+"\n")
+	}
+	assert.NotContains(t, text, `task="t3"`)
+	assert.NotContains(t, text, "load")
+}
+
+func TestFormatStatsd(t *testing.T) {
+	assert.Equal(t, "tasks_total:1|c",
+		string(formatStatsd("", Sample{"tasks_total", "counter", 1, nil}, nil)))
+	assert.Equal(t, "worker.disk_free_bytes:1.5|g|#location_cloud:aws,worker_pool_id:pp/ww",
+		string(formatStatsd("worker.", Sample{"disk_free_bytes", "gauge", 1.5, nil},
+			map[string]string{"worker_pool_id": "pp/ww", "location_cloud": "aws"})))
+	assert.Equal(t, "task_seconds:7|h|#status:a_b_c",
+		string(formatStatsd("", Sample{"task_seconds", "histogram", 7, nil},
+			map[string]string{"status": "a|b,c"})))
+}
+
+func TestForwardedMetrics(t *testing.T) {
+	// a UDP listener standing in for a StatsD server
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	r := NewRegistry()
+	s, err := start(cfg.MetricsConfig{
+		StatsD: cfg.StatsDConfig{Address: conn.LocalAddr().String(), Prefix: "w."},
+	}, r)
+	require.NoError(t, err)
+	defer s.Close()
+
+	s.SetIdentity(&run.State{
+		WorkerPoolID:   "pp/ww",
+		WorkerLocation: map[string]string{"cloud": "aws"},
+	})
+
+	transp := protocol.NewFakeTransport()
+	proto := protocol.NewProtocol(transp)
+	s.SetProtocol(proto)
+
+	s.handleMetricsMessage(decodeMessage(t, `{"type": "metrics", "samples": [
+		{"name": "tasks_total", "kind": "counter", "value": 1}
+	]}`))
+	// invalid messages are ignored
+	s.handleMetricsMessage(decodeMessage(t, `{"type": "metrics", "samples": "nope"}`))
+
+	assert.Contains(t, metricsText(t, r), `tasks_total{location_cloud="aws",worker_pool_id="pp/ww"} 1`+"\n")
+
+	buf := make([]byte, 1024)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "w.tasks_total:1|c|#location_cloud:aws,worker_pool_id:pp/ww", strings.TrimSpace(string(buf[:n])))
+}
@@ -17,14 +17,25 @@ func MakePrivateToOwner(filename string) (err error) {
 		panic("empty filename passed to MakePrivateToOwner")
 	}
 
+	return MakePrivateToUser(filename, os.Getuid(), -1)
+}
+
+// MakePrivateToUser ensures that the given file is owned by, and private to,
+// the given user.  If gid is not -1, the file's group is also changed.
+func MakePrivateToUser(filename string, uid, gid int) (err error) {
+	if filename == "" {
+		panic("empty filename passed to MakePrivateToUser")
+	}
+
 	stat, err := os.Stat(filename)
 	if err != nil {
 		return err
 	}
 
-	uid := int(stat.Sys().(*syscall.Stat_t).Uid)
-	if uid != os.Getuid() {
-		err = os.Chown(filename, os.Getuid(), -1)
+	fileUID := int(stat.Sys().(*syscall.Stat_t).Uid)
+	fileGID := int(stat.Sys().(*syscall.Stat_t).Gid)
+	if fileUID != uid || (gid != -1 && fileGID != gid) {
+		err = os.Chown(filename, uid, gid)
 		if err != nil {
 			return err
 		}
@@ -38,14 +49,21 @@ func MakePrivateToOwner(filename string) (err error) {
 // file's owner, returning an error if this is not the case, or cannot be
 // determined.
 func VerifyPrivateToOwner(filename string) error {
+	return VerifyPrivateToUser(filename, os.Getuid())
+}
+
+// VerifyPrivateToUser verifies that the given file is owned by the given user
+// and can only be read by that user, returning an error if this is not the
+// case, or cannot be determined.
+func VerifyPrivateToUser(filename string, uid int) error {
 	stat, err := os.Stat(filename)
 	if err != nil {
 		return err
 	}
 
-	uid := int(stat.Sys().(*syscall.Stat_t).Uid)
-	if uid != os.Getuid() {
-		return fmt.Errorf("%s has incorrect owner id %d", filename, uid)
+	fileUID := int(stat.Sys().(*syscall.Stat_t).Uid)
+	if fileUID != uid {
+		return fmt.Errorf("%s has incorrect owner id %d", filename, fileUID)
 	}
 	// (note: we don't check gid since the group has no permission to the file)
 
@@ -3,12 +3,32 @@
 package perms
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/Flaque/filet"
 	"github.com/stretchr/testify/require"
 )
 
 func makePermsBad(t *testing.T, filename string) {
 	require.NoError(t, os.Chmod(filename, 0666))
 }
+
+func TestPrivateToUser(t *testing.T) {
+	defer filet.CleanUp(t)
+
+	dir := filet.TmpDir(t, "")
+	filename := filepath.Join(dir, "test")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("hi"), 0644))
+	makePermsBad(t, filename)
+
+	require.Error(t, VerifyPrivateToUser(filename, os.Getuid()))
+
+	// only root can give files away, so use the current user and group
+	require.NoError(t, MakePrivateToUser(filename, os.Getuid(), os.Getgid()))
+	require.NoError(t, VerifyPrivateToUser(filename, os.Getuid()))
+
+	require.Error(t, VerifyPrivateToUser(filename, os.Getuid()+1))
+}
@@ -4,16 +4,34 @@ import "sort"
 
 var KnownCapabilities = []string{
 	"graceful-termination",
+	"heartbeat",
+	"idle",
+	"metrics",
 }
 
+// CurrentVersion is the version of the protocol implemented by this package.
+// A peer that does not send a version is assumed to implement version 1.
+const CurrentVersion = 1
+
+// Parameters are numeric limits associated with a capability, such as a
+// maximum size.  When negotiated, each parameter takes the smaller of the
+// values given by the two sides, or the value given by one side if the other
+// does not give it.
+type Parameters map[string]int
+
 type Capabilities struct {
-	// use a map as a poor-man's set
-	capabilities map[string]bool
+	// the protocol version
+	version int
+
+	// use a map as a poor-man's set, with the parameters for each capability
+	// (nil if there are none)
+	capabilities map[string]Parameters
 }
 
 func EmptyCapabilities() *Capabilities {
 	return &Capabilities{
-		capabilities: make(map[string]bool),
+		version:      CurrentVersion,
+		capabilities: make(map[string]Parameters),
 	}
 }
 
@@ -22,12 +40,58 @@ func FullCapabilities() *Capabilities {
 }
 
 func FromCapabilitiesList(caplist []string) *Capabilities {
-	caps := make(map[string]bool)
+	caps := EmptyCapabilities()
 	for _, c := range caplist {
-		caps[c] = true
+		caps.Add(c)
 	}
-	return &Capabilities{
-		capabilities: caps,
+	return caps
+}
+
+// Get the capabilities from a `welcome` or `hello` message.  The version and
+// parameters are optional, and invalid parameters are ignored.
+func FromMessage(msg Message) *Capabilities {
+	caps := FromCapabilitiesList(listOfStrings(msg.Properties["capabilities"]))
+
+	caps.version = 1
+	if v := msg.Properties["protocol-version"]; isInteger(v) && toFloat(v) >= 1 {
+		caps.version = int(toFloat(v))
+	}
+
+	if params, ok := msg.Properties["capability-parameters"].(map[string]interface{}); ok {
+		for c, p := range params {
+			p, ok := p.(map[string]interface{})
+			if !ok || !caps.Has(c) {
+				continue
+			}
+			for name, value := range p {
+				if isInteger(value) {
+					caps.SetParameter(c, name, int(toFloat(value)))
+				}
+			}
+		}
+	}
+
+	return caps
+}
+
+// Add these capabilities to the properties of a `welcome` or `hello` message
+func (caps *Capabilities) toProperties(properties map[string]interface{}) {
+	properties["capabilities"] = caps.List()
+	properties["protocol-version"] = caps.version
+
+	params := make(map[string]interface{})
+	for c, p := range caps.capabilities {
+		if len(p) == 0 {
+			continue
+		}
+		values := make(map[string]interface{})
+		for name, value := range p {
+			values[name] = value
+		}
+		params[c] = values
+	}
+	if len(params) > 0 {
+		properties["capability-parameters"] = params
 	}
 }
 
@@ -40,8 +104,20 @@ func (caps *Capabilities) List() []string {
 	return rv
 }
 
+// Get the protocol version
+func (caps *Capabilities) Version() int {
+	return caps.version
+}
+
+// Set the protocol version
+func (caps *Capabilities) SetVersion(version int) {
+	caps.version = version
+}
+
 func (caps *Capabilities) Add(c string) {
-	caps.capabilities[c] = true
+	if _, has := caps.capabilities[c]; !has {
+		caps.capabilities[c] = nil
+	}
 }
 
 func (caps *Capabilities) Remove(c string) {
@@ -53,12 +129,63 @@ func (caps *Capabilities) Has(c string) bool {
 	return has
 }
 
+// Set a parameter for a capability, adding the capability if necessary
+func (caps *Capabilities) SetParameter(c, name string, value int) {
+	params := caps.capabilities[c]
+	if params == nil {
+		params = make(Parameters)
+		caps.capabilities[c] = params
+	}
+	params[name] = value
+}
+
+// Get a parameter for a capability, returning false if it is not set
+func (caps *Capabilities) Parameter(c, name string) (int, bool) {
+	value, ok := caps.capabilities[c][name]
+	return value, ok
+}
+
+// Make a copy of these capabilities which can be modified independently
+func (caps *Capabilities) Copy() *Capabilities {
+	rv := EmptyCapabilities()
+	rv.version = caps.version
+	for c, params := range caps.capabilities {
+		rv.Add(c)
+		for name, value := range params {
+			rv.SetParameter(c, name, value)
+		}
+	}
+	return rv
+}
+
+// Limit these capabilities to those supported by both sides: the lower of the
+// two versions, the capabilities in both, and parameters negotiated as
+// described for Parameters.
 func (caps *Capabilities) LimitTo(other *Capabilities) {
-	newcaps := make(map[string]bool)
-	for c := range caps.capabilities {
-		if other.Has(c) {
-			newcaps[c] = true
+	if other.version < caps.version {
+		caps.version = other.version
+	}
+
+	newcaps := make(map[string]Parameters)
+	for c, params := range caps.capabilities {
+		otherParams, has := other.capabilities[c]
+		if !has {
+			continue
+		}
+
+		var newparams Parameters
+		if len(params) > 0 || len(otherParams) > 0 {
+			newparams = make(Parameters)
+			for name, value := range params {
+				newparams[name] = value
+			}
+			for name, value := range otherParams {
+				if existing, ok := newparams[name]; !ok || value < existing {
+					newparams[name] = value
+				}
+			}
 		}
+		newcaps[c] = newparams
 	}
 	caps.capabilities = newcaps
 }
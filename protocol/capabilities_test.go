@@ -1,9 +1,11 @@
 package protocol
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestEmptyCapabilities(t *testing.T) {
@@ -38,3 +40,93 @@ func TestLimitTo(t *testing.T) {
 	assert.True(t, caps1.Has("def"))
 	assert.False(t, caps1.Has("ghi"))
 }
+
+func TestLimitToVersionsAndParameters(t *testing.T) {
+	caps1 := FromCapabilitiesList([]string{"abc", "def", "ghi"})
+	caps1.SetVersion(3)
+	caps1.SetParameter("abc", "max-size", 100)
+	caps1.SetParameter("abc", "only-here", 1)
+	caps1.SetParameter("ghi", "max-size", 10)
+
+	caps2 := FromCapabilitiesList([]string{"abc", "def"})
+	caps2.SetVersion(2)
+	caps2.SetParameter("abc", "max-size", 50)
+	caps2.SetParameter("def", "only-there", 2)
+
+	caps1.LimitTo(caps2)
+	assert.Equal(t, 2, caps1.Version())
+	assert.Equal(t, []string{"abc", "def"}, caps1.List())
+
+	v, ok := caps1.Parameter("abc", "max-size")
+	assert.True(t, ok)
+	assert.Equal(t, 50, v)
+	v, ok = caps1.Parameter("abc", "only-here")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+	v, ok = caps1.Parameter("def", "only-there")
+	assert.True(t, ok)
+	assert.Equal(t, 2, v)
+	_, ok = caps1.Parameter("ghi", "max-size")
+	assert.False(t, ok)
+}
+
+func TestCopy(t *testing.T) {
+	caps1 := FromCapabilitiesList([]string{"abc"})
+	caps1.SetParameter("abc", "max-size", 100)
+	caps2 := caps1.Copy()
+	caps2.SetParameter("abc", "max-size", 10)
+	caps2.Add("def")
+
+	v, _ := caps1.Parameter("abc", "max-size")
+	assert.Equal(t, 100, v)
+	assert.False(t, caps1.Has("def"))
+}
+
+func TestFromMessage(t *testing.T) {
+	var msg Message
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"type": "hello",
+		"capabilities": ["abc", "def"],
+		"protocol-version": 2,
+		"capability-parameters": {
+			"abc": {"max-size": 100, "invalid": "x", "fraction": 1.5},
+			"def": "invalid",
+			"unknown": {"max-size": 1}
+		}
+	}`), &msg))
+
+	caps := FromMessage(msg)
+	assert.Equal(t, []string{"abc", "def"}, caps.List())
+	assert.Equal(t, 2, caps.Version())
+	v, ok := caps.Parameter("abc", "max-size")
+	assert.True(t, ok)
+	assert.Equal(t, 100, v)
+	_, ok = caps.Parameter("abc", "invalid")
+	assert.False(t, ok)
+	_, ok = caps.Parameter("abc", "fraction")
+	assert.False(t, ok)
+}
+
+func TestFromMessageListOnly(t *testing.T) {
+	var msg Message
+	require.NoError(t, json.Unmarshal([]byte(`{"type": "hello", "capabilities": ["abc"]}`), &msg))
+
+	caps := FromMessage(msg)
+	assert.Equal(t, []string{"abc"}, caps.List())
+	assert.Equal(t, 1, caps.Version())
+}
+
+func TestPropertiesRoundTrip(t *testing.T) {
+	caps := FromCapabilitiesList([]string{"abc", "def"})
+	caps.SetParameter("abc", "max-size", 100)
+
+	msg := Message{Type: "welcome", Properties: map[string]interface{}{}}
+	caps.toProperties(msg.Properties)
+
+	encoded, err := json.Marshal(&msg)
+	require.NoError(t, err)
+	var decoded Message
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+
+	assert.Equal(t, caps, FromMessage(decoded))
+}
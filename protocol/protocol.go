@@ -1,9 +1,35 @@
 package protocol
 
-import "sync"
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+)
 
 type MessageCallback func(msg Message)
 
+// ErrorCallback is called for each error handling a received message, with
+// one of the error kinds below.
+type ErrorCallback func(kind string, err error)
+
+// Kinds of errors handling received messages
+const (
+	// the message did not match the schema for its type
+	InvalidMessage = "invalid-message"
+	// a callback panicked
+	CallbackPanic = "callback-panic"
+	// the queue for an asynchronous callback was full, so the message was
+	// dropped
+	QueueFull = "queue-full"
+)
+
+// A queue of messages for an asynchronous callback
+type asyncQueue struct {
+	messages chan Message
+	callback MessageCallback
+}
+
 type Protocol struct {
 	// transport over which this protocol is running
 	transport Transport
@@ -12,9 +38,19 @@ type Protocol struct {
 	// to avoid finding the empty set at startup)
 	Capabilities *Capabilities
 
+	// capabilities supported by this side of the connection, defaulting to all
+	// known capabilities; this can be modified before the protocol is started
+	LocalCapabilities *Capabilities
+
 	// callbacks per message type
 	callbacks map[string][]MessageCallback
 
+	// callbacks for errors
+	errorCallbacks []ErrorCallback
+
+	// queues for asynchronous callbacks, started with the protocol
+	asyncQueues []*asyncQueue
+
 	// tracking for whether this protocol is intialized
 	initialized     bool
 	initializedCond sync.Cond
@@ -22,10 +58,11 @@ type Protocol struct {
 
 func NewProtocol(transport Transport) *Protocol {
 	return &Protocol{
-		transport:    transport,
-		Capabilities: EmptyCapabilities(),
-		callbacks:    make(map[string][]MessageCallback),
-		initialized:  false,
+		transport:         transport,
+		Capabilities:      EmptyCapabilities(),
+		LocalCapabilities: FullCapabilities(),
+		callbacks:         make(map[string][]MessageCallback),
+		initialized:       false,
 		initializedCond: sync.Cond{
 			L: &sync.Mutex{},
 		},
@@ -33,54 +70,113 @@ func NewProtocol(transport Transport) *Protocol {
 }
 
 // Register a callback for the given message type.  This must occur before the
-// protocol is started.
+// protocol is started.  Callbacks are called in the protocol's receive loop,
+// so a slow callback delays all subsequent messages; see RegisterAsync.
 func (prot *Protocol) Register(messageType string, callback MessageCallback) {
 	callbacks := prot.callbacks[messageType]
-	callbacks = append(callbacks, callback)
+	callbacks = append(callbacks, prot.recovering(messageType, callback))
 	prot.callbacks[messageType] = callbacks
 }
 
+// Register a callback for the given message type, to be called in its own
+// goroutine.  Up to queueSize messages are queued for the callback, and
+// messages arriving when the queue is full are dropped with a QueueFull
+// error.  Messages are passed to the callback in the order they arrive.  This
+// must occur before the protocol is started.
+func (prot *Protocol) RegisterAsync(messageType string, queueSize int, callback MessageCallback) {
+	q := &asyncQueue{
+		messages: make(chan Message, queueSize),
+		callback: prot.recovering(messageType, callback),
+	}
+	prot.asyncQueues = append(prot.asyncQueues, q)
+
+	prot.callbacks[messageType] = append(prot.callbacks[messageType], func(msg Message) {
+		select {
+		case q.messages <- msg:
+		default:
+			prot.error(QueueFull, fmt.Errorf("queue for %s messages is full; message dropped", messageType))
+		}
+	})
+}
+
+// Register a callback for errors handling received messages, in addition to
+// logging them.  This must occur before the protocol is started.
+func (prot *Protocol) RegisterErrorCallback(callback ErrorCallback) {
+	prot.errorCallbacks = append(prot.errorCallbacks, callback)
+}
+
+func (prot *Protocol) error(kind string, err error) {
+	log.Printf("Protocol error (%s): %s", kind, err)
+	for _, cb := range prot.errorCallbacks {
+		cb(kind, err)
+	}
+}
+
+// Wrap a callback so that a panic is reported as an error, rather than
+// crashing the process
+func (prot *Protocol) recovering(messageType string, callback MessageCallback) MessageCallback {
+	return func(msg Message) {
+		defer func() {
+			if r := recover(); r != nil {
+				prot.error(CallbackPanic, fmt.Errorf("panic in %s callback: %v\n%s", messageType, r, debug.Stack()))
+			}
+		}()
+		callback(msg)
+	}
+}
+
 // convert an anymous interface into a list of strings; useful for parsing lists
-// out of messages
+// out of messages.  Anything else, including non-string elements, is ignored;
+// use ValidateMessage to detect such errors.
 func listOfStrings(val interface{}) []string {
-	aslist := val.([]interface{})
-	rv := make([]string, 0, len(aslist))
-	for _, elt := range aslist {
-		rv = append(rv, elt.(string))
+	switch val := val.(type) {
+	case []string:
+		return val
+	case []interface{}:
+		rv := make([]string, 0, len(val))
+		for _, elt := range val {
+			if s, ok := elt.(string); ok {
+				rv = append(rv, s)
+			}
+		}
+		return rv
 	}
-	return rv
+	return []string{}
 }
 
 // Start the protocol and initiate the hello/welcome transaction.
 func (prot *Protocol) Start(asWorker bool) {
 	if asWorker {
 		prot.Register("welcome", func(msg Message) {
-			caps := FullCapabilities()
-			otherCaps := FromCapabilitiesList(listOfStrings(msg.Properties["capabilities"]))
-			caps.LimitTo(otherCaps)
+			caps := prot.LocalCapabilities.Copy()
+			caps.LimitTo(FromMessage(msg))
 			prot.Capabilities = caps
 
-			prot.Send(Message{
-				Type: "hello",
-				Properties: map[string]interface{}{
-					"capabilities": prot.Capabilities.List(),
-				},
-			})
+			hello := Message{Type: "hello", Properties: map[string]interface{}{}}
+			caps.toProperties(hello.Properties)
+			prot.Send(hello)
 			prot.SetInitialized()
 		})
 	} else {
 		prot.Register("hello", func(msg Message) {
-			prot.Capabilities = FromCapabilitiesList(listOfStrings(msg.Properties["capabilities"]))
+			// the worker has already negotiated, but may not support versions
+			// or parameters, so negotiate again
+			caps := prot.LocalCapabilities.Copy()
+			caps.LimitTo(FromMessage(msg))
+			prot.Capabilities = caps
 			prot.SetInitialized()
 		})
 
-		fullCaps := FullCapabilities()
-		prot.Send(Message{
-			Type: "welcome",
-			Properties: map[string]interface{}{
-				"capabilities": fullCaps.List(),
-			},
-		})
+		welcome := Message{Type: "welcome", Properties: map[string]interface{}{}}
+		prot.LocalCapabilities.toProperties(welcome.Properties)
+		prot.Send(welcome)
+	}
+	for _, q := range prot.asyncQueues {
+		go func(q *asyncQueue) {
+			for msg := range q.messages {
+				q.callback(msg)
+			}
+		}(q)
 	}
 	go prot.recvLoop()
 }
@@ -105,6 +201,13 @@ func (prot *Protocol) WaitUntilInitialized() {
 	}
 }
 
+// Check whether this protocol is initialized, without waiting.
+func (prot *Protocol) IsInitialized() bool {
+	prot.initializedCond.L.Lock()
+	defer prot.initializedCond.L.Unlock()
+	return prot.initialized
+}
+
 // Check if a capability is supported, after waiting for initialization.
 func (prot *Protocol) Capable(c string) bool {
 	prot.WaitUntilInitialized()
@@ -119,14 +222,47 @@ func (prot *Protocol) Send(msg Message) {
 }
 
 func (prot *Protocol) recvLoop() {
+	// when the transport closes, stop the asynchronous callbacks once their
+	// queues are empty
+	defer func() {
+		for _, q := range prot.asyncQueues {
+			close(q.messages)
+		}
+	}()
+
 	for {
 		msg, ok := prot.transport.Recv()
 		if !ok {
 			return
 		}
+		msg = prot.defaultCapabilities(msg)
+		err := ValidateMessage(msg)
+		if err != nil {
+			prot.error(InvalidMessage, fmt.Errorf("invalid %s message (ignored): %s", msg.Type, err))
+			continue
+		}
 		callbacks := prot.callbacks[msg.Type]
 		for _, cb := range callbacks {
 			cb(msg)
 		}
 	}
 }
+
+// A welcome or hello message without capabilities is an error, but ignoring it
+// would leave the connection uninitialized forever, so treat it as offering no
+// capabilities.
+func (prot *Protocol) defaultCapabilities(msg Message) Message {
+	if msg.Type != "welcome" && msg.Type != "hello" {
+		return msg
+	}
+	if _, ok := msg.Properties["capabilities"]; ok {
+		return msg
+	}
+	prot.error(InvalidMessage, fmt.Errorf("%s message has no capabilities; assuming none", msg.Type))
+
+	props := map[string]interface{}{"capabilities": []interface{}{}}
+	for k, v := range msg.Properties {
+		props[k] = v
+	}
+	return Message{Type: msg.Type, Properties: props}
+}
@@ -2,6 +2,8 @@ package protocol
 
 import (
 	"io"
+	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -73,3 +75,201 @@ func TestProtocol(t *testing.T) {
 	require.True(t, workerProto.Capable("graceful-termination"))
 	require.True(t, runnerProto.Capable("graceful-termination"))
 }
+
+func TestProtocolParameters(t *testing.T) {
+	runnerTransp := NewStdioTransport()
+	workerTransp := NewStdioTransport()
+	defer wireTransports(runnerTransp, workerTransp)()
+
+	runnerProto := NewProtocol(runnerTransp)
+	runnerProto.LocalCapabilities.SetParameter("heartbeat", "interval", 30)
+	runnerProto.LocalCapabilities.SetParameter("metrics", "max-samples", 100)
+
+	workerProto := NewProtocol(workerTransp)
+	workerProto.LocalCapabilities.SetVersion(CurrentVersion + 1)
+	workerProto.LocalCapabilities.SetParameter("metrics", "max-samples", 10)
+
+	runnerProto.Start(false)
+	workerProto.Start(true)
+
+	for _, proto := range []*Protocol{runnerProto, workerProto} {
+		proto.WaitUntilInitialized()
+		require.Equal(t, CurrentVersion, proto.Capabilities.Version())
+		interval, _ := proto.Capabilities.Parameter("heartbeat", "interval")
+		require.Equal(t, 30, interval)
+		maxSamples, _ := proto.Capabilities.Parameter("metrics", "max-samples")
+		require.Equal(t, 10, maxSamples)
+	}
+}
+
+func TestProtocolListOnlyWorker(t *testing.T) {
+	runnerTransp := NewStdioTransport()
+	defer runnerTransp.Close()
+
+	runnerProto := NewProtocol(runnerTransp)
+	runnerProto.LocalCapabilities.SetVersion(CurrentVersion + 1)
+	runnerProto.LocalCapabilities.SetParameter("heartbeat", "interval", 30)
+	runnerProto.Start(false)
+
+	// a worker that predates versions and parameters ignores them in the
+	// welcome message and sends only a list of capabilities
+	welcome := <-runnerTransp.Out
+	require.Equal(t, CurrentVersion+1, int(welcome.Properties["protocol-version"].(int)))
+	_, err := runnerTransp.Write([]byte(`~{"type": "hello", "capabilities": ["heartbeat"]}` + "\n"))
+	require.NoError(t, err)
+
+	runnerProto.WaitUntilInitialized()
+	require.Equal(t, []string{"heartbeat"}, runnerProto.Capabilities.List())
+	require.Equal(t, 1, runnerProto.Capabilities.Version())
+	interval, _ := runnerProto.Capabilities.Parameter("heartbeat", "interval")
+	require.Equal(t, 30, interval)
+}
+
+// Collect errors from a protocol, safely
+type errorCollector struct {
+	mux   sync.Mutex
+	kinds []string
+}
+
+func (ec *errorCollector) callback(kind string, err error) {
+	ec.mux.Lock()
+	defer ec.mux.Unlock()
+	ec.kinds = append(ec.kinds, kind)
+}
+
+func (ec *errorCollector) Kinds() []string {
+	ec.mux.Lock()
+	defer ec.mux.Unlock()
+	return append([]string{}, ec.kinds...)
+}
+
+func writeLine(t *testing.T, transp *StdioTransport, line string) {
+	_, err := transp.Write([]byte(line + "\n"))
+	require.NoError(t, err)
+}
+
+func TestProtocolInvalidHello(t *testing.T) {
+	runnerTransp := NewStdioTransport()
+	defer runnerTransp.Close()
+
+	ec := &errorCollector{}
+	runnerProto := NewProtocol(runnerTransp)
+	runnerProto.RegisterErrorCallback(ec.callback)
+	runnerProto.Start(false)
+
+	// invalid hello messages are ignored, and a valid one still works
+	writeLine(t, runnerTransp, `~{"type": "hello", "capabilities": [1, 2]}`)
+	writeLine(t, runnerTransp, `~{"type": "hello", "capabilities": "graceful-termination"}`)
+	writeLine(t, runnerTransp, `~{"type": "hello", "capabilities": ["graceful-termination"]}`)
+
+	require.True(t, runnerProto.Capable("graceful-termination"))
+	require.Equal(t, []string{InvalidMessage, InvalidMessage}, ec.Kinds())
+}
+
+func TestProtocolHelloWithoutCapabilities(t *testing.T) {
+	runnerTransp := NewStdioTransport()
+	defer runnerTransp.Close()
+
+	ec := &errorCollector{}
+	runnerProto := NewProtocol(runnerTransp)
+	runnerProto.RegisterErrorCallback(ec.callback)
+	runnerProto.Start(false)
+
+	// a hello without capabilities still initializes the connection, with no
+	// capabilities
+	writeLine(t, runnerTransp, `~{"type": "hello"}`)
+
+	require.False(t, runnerProto.Capable("graceful-termination"))
+	require.Equal(t, []string{InvalidMessage}, ec.Kinds())
+}
+
+func TestProtocolWelcomeWithoutCapabilities(t *testing.T) {
+	workerTransp := NewStdioTransport()
+	defer workerTransp.Close()
+
+	workerProto := NewProtocol(workerTransp)
+	workerProto.Start(true)
+
+	writeLine(t, workerTransp, `~{"type": "welcome", "protocol-version": 1}`)
+
+	require.False(t, workerProto.Capable("graceful-termination"))
+	msg := <-workerTransp.Out
+	require.Equal(t, "hello", msg.Type)
+}
+
+func TestProtocolCallbackPanic(t *testing.T) {
+	transp := NewStdioTransport()
+	defer transp.Close()
+
+	ec := &errorCollector{}
+	proto := NewProtocol(transp)
+	proto.RegisterErrorCallback(ec.callback)
+
+	done := make(chan bool)
+	proto.Register("heartbeat", func(msg Message) {
+		panic("uhoh")
+	})
+	proto.Register("idle", func(msg Message) {
+		close(done)
+	})
+	proto.Start(false)
+
+	writeLine(t, transp, `~{"type": "heartbeat"}`)
+	writeLine(t, transp, `~{"type": "idle"}`)
+	<-done
+
+	require.Equal(t, []string{CallbackPanic}, ec.Kinds())
+}
+
+func TestProtocolAsync(t *testing.T) {
+	transp := NewStdioTransport()
+	defer transp.Close()
+
+	ec := &errorCollector{}
+	proto := NewProtocol(transp)
+	proto.RegisterErrorCallback(ec.callback)
+
+	// a slow asynchronous callback, blocked until unblock is closed
+	unblock := make(chan bool)
+	var mux sync.Mutex
+	var handled []interface{}
+	asyncDone := make(chan bool)
+	started := make(chan bool, 1)
+	proto.RegisterAsync("metrics", 2, func(msg Message) {
+		select {
+		case started <- true:
+		default:
+		}
+		<-unblock
+		mux.Lock()
+		defer mux.Unlock()
+		handled = append(handled, msg.Properties["n"])
+		if len(handled) == 3 {
+			close(asyncDone)
+		}
+	})
+
+	syncDone := make(chan bool)
+	proto.Register("idle", func(msg Message) {
+		close(syncDone)
+	})
+	proto.Start(false)
+
+	// the first message is taken by the callback, the next two fill the queue,
+	// and the last is dropped
+	for n := 0; n < 4; n++ {
+		writeLine(t, transp, `~{"type": "metrics", "samples": [], "n": `+strconv.Itoa(n)+`}`)
+		if n == 0 {
+			<-started
+		}
+	}
+
+	// the slow callback does not block other messages
+	writeLine(t, transp, `~{"type": "idle"}`)
+	<-syncDone
+	require.Equal(t, []string{QueueFull}, ec.Kinds())
+
+	close(unblock)
+	<-asyncDone
+	require.Equal(t, []interface{}{0.0, 1.0, 2.0}, handled)
+}
@@ -0,0 +1,231 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// These are randomized property tests, not coverage-guided fuzz targets: they
+// feed input generated from a fixed seed, so that failures are reproducible,
+// to the parts of the protocol that handle data from the other process,
+// checking that nothing panics and that valid messages survive.
+
+const randomIterations = 500
+
+// Fragments from which random input lines are built
+var randomFragments = []string{
+	"~", "{", "}", "[", "]", "\"", ":", ",", "\n", "\r", " ", "\x00", "\xff",
+	`"type"`, `"hello"`, `"welcome"`, `"capabilities"`, `"graceful-termination"`,
+	`"finish-tasks"`, `true`, `null`, `1`, `-1.5`, `1e400`, `"é"`,
+	`~{"type": "heartbeat"}`,
+}
+
+func randomLine(rng *rand.Rand) []byte {
+	var buf bytes.Buffer
+	for i := rng.Intn(20); i > 0; i-- {
+		if rng.Intn(4) == 0 {
+			b := make([]byte, rng.Intn(10))
+			rng.Read(b)
+			buf.Write(b)
+		} else {
+			buf.WriteString(randomFragments[rng.Intn(len(randomFragments))])
+		}
+	}
+	return buf.Bytes()
+}
+
+// Write data to the transport in random-sized chunks, reusing the same buffer
+// for each chunk as io.Copy does
+func writeRandomChunks(t *testing.T, rng *rand.Rand, transp *StdioTransport, data []byte) {
+	buf := make([]byte, 64)
+	for len(data) > 0 {
+		n := 1 + rng.Intn(len(buf))
+		if n > len(data) {
+			n = len(data)
+		}
+		copy(buf, data[:n])
+		_, err := transp.Write(buf[:n])
+		require.NoError(t, err)
+		data = data[n:]
+	}
+}
+
+func TestRandomStdioTransportWrite(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < randomIterations; i++ {
+		transp := NewStdioTransport()
+		transp.InvalidLines = ioutil.Discard
+
+		var got []Message
+		done := make(chan bool)
+		go func() {
+			readMessages(transp.In, &got)
+			close(done)
+		}()
+
+		// interleave random lines with valid messages, each of which must be
+		// received intact
+		var input []byte
+		var expected []Message
+		for j := rng.Intn(10); j > 0; j-- {
+			input = append(input, randomLine(rng)...)
+			input = append(input, '\n')
+
+			msg := Message{Type: "valid", Properties: map[string]interface{}{"n": float64(j)}}
+			line, err := json.Marshal(&msg)
+			require.NoError(t, err)
+			input = append(input, '~')
+			input = append(input, line...)
+			input = append(input, '\n')
+			expected = append(expected, msg)
+		}
+
+		writeRandomChunks(t, rng, transp, input)
+		require.NoError(t, transp.Close())
+		<-done
+
+		var valid []Message
+		for _, msg := range got {
+			if msg.Type == "valid" {
+				valid = append(valid, msg)
+			}
+		}
+		require.Equal(t, expected, valid, "input: %q", input)
+	}
+}
+
+// Generate a random JSON-compatible value, biased towards the shapes that
+// appear in messages
+func randomValue(rng *rand.Rand, depth int) interface{} {
+	choice := rng.Intn(9)
+	if depth > 3 && choice >= 6 {
+		choice = rng.Intn(6)
+	}
+	switch choice {
+	case 0:
+		return nil
+	case 1:
+		return rng.Intn(2) == 0
+	case 2:
+		return float64(rng.Intn(200) - 100)
+	case 3:
+		return rng.NormFloat64() * 1e10
+	case 4:
+		return randomFragments[rng.Intn(len(randomFragments))]
+	case 5:
+		return KnownCapabilities[rng.Intn(len(KnownCapabilities))]
+	case 6, 7:
+		list := make([]interface{}, rng.Intn(5))
+		for i := range list {
+			list[i] = randomValue(rng, depth+1)
+		}
+		return list
+	default:
+		return randomObject(rng, depth+1)
+	}
+}
+
+var randomKeys = []string{
+	"type", "capabilities", "protocol-version", "capability-parameters",
+	"finish-tasks", "samples", "interval", "graceful-termination", "heartbeat", "x",
+}
+
+func randomObject(rng *rand.Rand, depth int) map[string]interface{} {
+	obj := make(map[string]interface{})
+	for i := rng.Intn(5); i > 0; i-- {
+		obj[randomKeys[rng.Intn(len(randomKeys))]] = randomValue(rng, depth)
+	}
+	return obj
+}
+
+// Generate a random message, usually of a known type
+func randomMessage(rng *rand.Rand) []byte {
+	obj := randomObject(rng, 0)
+	types := []interface{}{"welcome", "hello", "graceful-termination", "heartbeat", "idle", "busy", "metrics"}
+	if rng.Intn(10) != 0 {
+		obj["type"] = types[rng.Intn(len(types))]
+	}
+	// often start from a mostly-valid message
+	if rng.Intn(2) == 0 {
+		obj["capabilities"] = []interface{}{"heartbeat", randomValue(rng, 3)}
+	}
+	encoded, err := json.Marshal(obj)
+	if err != nil {
+		panic(err)
+	}
+	return encoded
+}
+
+func TestRandomMessageDecoding(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+
+	for i := 0; i < randomIterations*4; i++ {
+		encoded := randomMessage(rng)
+
+		var msg Message
+		if json.Unmarshal(encoded, &msg) != nil {
+			continue
+		}
+		if ValidateMessage(msg) != nil {
+			continue
+		}
+
+		// decoding capabilities from a valid message must not panic
+		if msg.Type == "welcome" || msg.Type == "hello" {
+			caps := FromMessage(msg)
+			caps.LimitTo(FullCapabilities())
+		}
+	}
+}
+
+func TestRandomProtocol(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+
+	// most of these messages are invalid, and logged as such
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, asWorker := range []bool{false, true} {
+		transp := NewStdioTransport()
+		transp.InvalidLines = ioutil.Discard
+		// the protocol's own messages are not interesting here
+		go func() {
+			for range transp.Out {
+			}
+		}()
+
+		proto := NewProtocol(transp)
+		done := make(chan bool)
+		proto.Register("busy", func(msg Message) {
+			if msg.Properties["done"] == true {
+				close(done)
+			}
+		})
+		proto.Register("graceful-termination", func(msg Message) {
+			_ = msg.Properties["finish-tasks"].(bool)
+		})
+		proto.Start(asWorker)
+
+		for i := 0; i < randomIterations; i++ {
+			line := append(append([]byte{'~'}, randomMessage(rng)...), '\n')
+			_, err := transp.Write(line)
+			require.NoError(t, err, string(line))
+		}
+
+		// the protocol is still processing messages
+		_, err := transp.Write([]byte(`~{"type": "busy", "done": true}` + "\n"))
+		require.NoError(t, err)
+		<-done
+
+		require.NoError(t, transp.Close())
+		transp.CloseOut()
+	}
+}
@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Directions of recorded messages, from the perspective of the side doing the
+// recording
+const (
+	Sent     = "sent"
+	Received = "received"
+)
+
+// Record is a single message in a recorded protocol session.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Message   Message   `json:"message"`
+}
+
+// RecorderTransport wraps a Transport, writing each message sent or received
+// to a JSONL file, one Record per line.
+type RecorderTransport struct {
+	inner Transport
+
+	// protects the writer, which is used from multiple goroutines
+	mux    sync.Mutex
+	writer io.Writer
+	failed bool
+}
+
+func NewRecorderTransport(inner Transport, writer io.Writer) *RecorderTransport {
+	return &RecorderTransport{inner: inner, writer: writer}
+}
+
+func (transp *RecorderTransport) record(direction string, msg Message) {
+	transp.mux.Lock()
+	defer transp.mux.Unlock()
+
+	// stop recording after the first error, rather than logging every message
+	if transp.failed {
+		return
+	}
+
+	rec := Record{time.Now(), direction, msg}
+	line, err := json.Marshal(&rec)
+	if err == nil {
+		_, err = transp.writer.Write(append(line, '\n'))
+	}
+	if err != nil {
+		log.Printf("Error recording protocol message; recording stopped: %s", err)
+		transp.failed = true
+	}
+}
+
+func (transp *RecorderTransport) Send(msg Message) {
+	transp.record(Sent, msg)
+	transp.inner.Send(msg)
+}
+
+func (transp *RecorderTransport) Recv() (Message, bool) {
+	msg, ok := transp.inner.Recv()
+	if ok {
+		transp.record(Received, msg)
+	}
+	return msg, ok
+}
+
+// Read a recording written by RecorderTransport
+func ReadRecording(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	// messages can be large, e.g., with many metrics samples
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		err := json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		if rec.Direction != Sent && rec.Direction != Received {
+			return nil, fmt.Errorf("line %d: invalid direction %q", line, rec.Direction)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// Write a human-readable version of a recording made by start-worker, with
+// each message's time relative to the first message.
+func FormatRecording(w io.Writer, records []Record) error {
+	var start time.Time
+	if len(records) > 0 {
+		start = records[0].Time
+	}
+
+	for _, rec := range records {
+		arrow := "runner -> worker"
+		if rec.Direction == Received {
+			arrow = "worker -> runner"
+		}
+
+		properties := ""
+		if len(rec.Message.Properties) > 0 {
+			j, err := json.Marshal(rec.Message.Properties)
+			if err != nil {
+				return err
+			}
+			properties = string(j)
+		}
+
+		_, err := fmt.Fprintf(w, "%9.3fs  %s  %-20s %s\n",
+			rec.Time.Sub(start).Seconds(), arrow, rec.Message.Type, properties)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replay the worker side of a recording made by start-worker over the given
+// worker-side transport.  Messages the worker sent are sent again, in order,
+// and messages the runner sent are expected, by type, in the same order.
+// Timing is not reproduced.
+func ReplayWorker(transp Transport, records []Record) error {
+	for i, rec := range records {
+		if rec.Direction == Received {
+			transp.Send(rec.Message)
+			continue
+		}
+
+		msg, ok := transp.Recv()
+		if !ok {
+			return fmt.Errorf("record %d: connection closed while waiting for %s message", i, rec.Message.Type)
+		}
+		if msg.Type != rec.Message.Type {
+			return fmt.Errorf("record %d: expected %s message, got %s", i, rec.Message.Type, msg.Type)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Wire a runner-side and worker-side transport together, returning a function
+// to close them both
+func wireTransports(runnerTransp, workerTransp *StdioTransport) func() {
+	go func() {
+		_, _ = io.Copy(runnerTransp, workerTransp)
+	}()
+	go func() {
+		_, _ = io.Copy(workerTransp, runnerTransp)
+	}()
+	return func() {
+		runnerTransp.Close()
+		workerTransp.Close()
+	}
+}
+
+// Record a session between a runner and a worker protocol, returning the
+// recording made on the runner side
+func recordSession(t *testing.T) []byte {
+	runnerTransp := NewStdioTransport()
+	workerTransp := NewStdioTransport()
+	defer wireTransports(runnerTransp, workerTransp)()
+
+	var buf bytes.Buffer
+	recorder := NewRecorderTransport(runnerTransp, &buf)
+	runnerProto := NewProtocol(recorder)
+	workerProto := NewProtocol(workerTransp)
+
+	done := make(chan bool)
+	runnerProto.Register("heartbeat", func(msg Message) {
+		runnerProto.Send(Message{Type: "graceful-termination", Properties: map[string]interface{}{"finish-tasks": false}})
+	})
+	workerProto.Register("graceful-termination", func(msg Message) {
+		close(done)
+	})
+
+	runnerProto.Start(false)
+	workerProto.Start(true)
+	workerProto.WaitUntilInitialized()
+	workerProto.Send(Message{Type: "heartbeat"})
+	<-done
+
+	return buf.Bytes()
+}
+
+func TestRecordSession(t *testing.T) {
+	records, err := ReadRecording(bytes.NewReader(recordSession(t)))
+	require.NoError(t, err)
+
+	var got []string
+	for _, rec := range records {
+		got = append(got, rec.Direction+" "+rec.Message.Type)
+		assert.False(t, rec.Time.IsZero())
+	}
+	assert.Equal(t, []string{
+		"sent welcome",
+		"received hello",
+		"received heartbeat",
+		"sent graceful-termination",
+	}, got)
+	assert.Equal(t, false, records[3].Message.Properties["finish-tasks"])
+}
+
+func TestReadRecordingInvalid(t *testing.T) {
+	_, err := ReadRecording(strings.NewReader(`{"time": "2020-01-01T00:00:00Z", "direction": "sideways", "message": {"type": "hello"}}`))
+	assert.Error(t, err)
+
+	_, err = ReadRecording(strings.NewReader(`{"time": "2020-01-01T00:00:00Z", "direction": "sent", "message": {}}`))
+	assert.Error(t, err)
+
+	_, err = ReadRecording(strings.NewReader("not json\n"))
+	assert.Error(t, err)
+}
+
+func TestFormatRecording(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	require.NoError(t, FormatRecording(&buf, []Record{
+		{start, Sent, Message{Type: "welcome", Properties: map[string]interface{}{"capabilities": []string{"heartbeat"}}}},
+		{start.Add(1500 * time.Millisecond), Received, Message{Type: "heartbeat"}},
+	}))
+	assert.Equal(t, ""+
+		"    0.000s  runner -> worker  welcome              {\"capabilities\":[\"heartbeat\"]}\n"+
+		"    1.500s  worker -> runner  heartbeat            \n",
+		buf.String())
+}
+
+func TestReplayWorker(t *testing.T) {
+	records, err := ReadRecording(bytes.NewReader(recordSession(t)))
+	require.NoError(t, err)
+
+	runnerTransp := NewStdioTransport()
+	workerTransp := NewStdioTransport()
+	defer wireTransports(runnerTransp, workerTransp)()
+
+	runnerProto := NewProtocol(runnerTransp)
+	runnerProto.Register("heartbeat", func(msg Message) {
+		runnerProto.Send(Message{Type: "graceful-termination", Properties: map[string]interface{}{"finish-tasks": false}})
+	})
+	runnerProto.Start(false)
+
+	require.NoError(t, ReplayWorker(workerTransp, records))
+	require.True(t, runnerProto.Capable("graceful-termination"))
+}
+
+func TestReplayWorkerMismatch(t *testing.T) {
+	records, err := ReadRecording(bytes.NewReader(recordSession(t)))
+	require.NoError(t, err)
+
+	runnerTransp := NewStdioTransport()
+	workerTransp := NewStdioTransport()
+	defer wireTransports(runnerTransp, workerTransp)()
+
+	// this runner responds to heartbeats with the wrong message
+	runnerProto := NewProtocol(runnerTransp)
+	runnerProto.Register("heartbeat", func(msg Message) {
+		runnerProto.Send(Message{Type: "idle"})
+	})
+	runnerProto.Start(false)
+
+	err = ReplayWorker(workerTransp, records)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expected graceful-termination message, got idle")
+}
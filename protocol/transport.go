@@ -2,10 +2,15 @@ package protocol
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"log"
 	"os"
+	"reflect"
 	"sync"
+	"time"
 )
 
 // Transport is a means of sending and receiving messages.
@@ -17,6 +22,56 @@ type Transport interface {
 	Recv() (Message, bool)
 }
 
+// OverflowPolicy determines what StdioTransport does when a message is sent
+// and its queue of outgoing messages is full, as when the other process is not
+// reading its input.
+type OverflowPolicy int
+
+const (
+	// Discard the oldest queued message to make room, except that control
+	// messages (welcome, hello, and graceful-termination) are only discarded
+	// as duplicates of a message that is still queued.  When the queue holds
+	// only control messages, another control message waits as for
+	// OverflowBlock, delaying later senders, and any other message is
+	// discarded.
+	OverflowDropOldest OverflowPolicy = iota
+	// Wait for room in the queue, until the send times out or the transport
+	// is closed.
+	OverflowBlock
+	// Fail with ErrQueueFull.  Sending never blocks.
+	OverflowError
+)
+
+var (
+	// ErrQueueFull is returned from SendContext when the queue of outgoing
+	// messages is full and the policy is OverflowError.
+	ErrQueueFull = errors.New("outgoing message queue is full")
+
+	// ErrClosed is returned from SendContext after CloseOut.
+	ErrClosed = errors.New("transport is closed")
+)
+
+// Control messages are those that the protocol cannot do without: the
+// capability negotiation and requests to terminate.
+var controlMessages = map[string]bool{
+	"welcome":              true,
+	"hello":                true,
+	"graceful-termination": true,
+}
+
+// StdioTransportOptions configure the outgoing side of a StdioTransport.
+type StdioTransportOptions struct {
+	// the number of outgoing messages that can be queued (default 5)
+	QueueSize int
+
+	// what to do when the queue is full
+	Overflow OverflowPolicy
+
+	// the longest that Send waits for room in the queue, or zero to wait until
+	// the transport is closed
+	SendTimeout time.Duration
+}
+
 // StdioTransport implements the worker-runner protocol over stdin/stdout.  It
 // implements Transport, io.Reader and io.WriteCloser, where it uses the
 // encoding defined in `protocol.md`, and exposes channels of incoming and
@@ -30,27 +85,186 @@ type StdioTransport struct {
 	// os.Stdout
 	InvalidLines io.Writer
 
+	options StdioTransportOptions
+
 	// protects access to inBuffer (outbuffer has no contention)
 	inMux sync.Mutex
 
 	inBuffer  []byte
 	outBuffer []byte
+
+	// senders hold a read lock on outMux while sending to Out, and CloseOut
+	// holds the write lock while closing it; outDone is closed first, to
+	// release any blocked senders
+	outMux    sync.RWMutex
+	outClosed bool
+	// serializes senders while they drop messages, so that the queue's order
+	// is preserved
+	dropMux      sync.Mutex
+	outDone      chan struct{}
+	closeOutOnce sync.Once
 }
 
-// Create a new StdioTransport.  The result implements both io.Reader and
-// io.Writer so it can be specified as a cmd's Stdin and Stdout.
+// Create a new StdioTransport with the default options, which never block when
+// sending, except for control messages.  The result implements both io.Reader and io.Writer so it can be
+// specified as a cmd's Stdin and Stdout.
 func NewStdioTransport() *StdioTransport {
+	return NewStdioTransportWithOptions(StdioTransportOptions{})
+}
+
+// Create a new StdioTransport with the given options.
+func NewStdioTransportWithOptions(options StdioTransportOptions) *StdioTransport {
+	if options.QueueSize <= 0 {
+		options.QueueSize = 5
+	}
 	return &StdioTransport{
 		In:           make(chan Message, 5),
-		Out:          make(chan Message, 5),
+		Out:          make(chan Message, options.QueueSize),
 		InvalidLines: os.Stdout,
+		options:      options,
+		outDone:      make(chan struct{}),
 	}
 }
 
 // protocol.Transport interface
 
+// Send a message, logging rather than returning any error.  This waits for
+// room in the queue no longer than the configured SendTimeout.
 func (transp *StdioTransport) Send(msg Message) {
-	transp.Out <- msg
+	ctx := context.Background()
+	if transp.options.SendTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, transp.options.SendTimeout)
+		defer cancel()
+	}
+
+	err := transp.SendContext(ctx, msg)
+	if err != nil {
+		log.Printf("Error sending %s message (dropped): %s", msg.Type, err)
+	}
+}
+
+// Send a message, handling a full queue according to the overflow policy.
+// When waiting for room in the queue, this waits until the context is done.
+func (transp *StdioTransport) SendContext(ctx context.Context, msg Message) error {
+	transp.outMux.RLock()
+	defer transp.outMux.RUnlock()
+
+	if transp.outClosed {
+		return ErrClosed
+	}
+
+	switch transp.options.Overflow {
+	case OverflowError:
+		select {
+		case transp.Out <- msg:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+
+	case OverflowBlock:
+		return transp.waitToSend(ctx, msg)
+
+	default:
+		return transp.sendDropOldest(ctx, msg)
+	}
+}
+
+// Wait for room in the queue to send a message
+func (transp *StdioTransport) waitToSend(ctx context.Context, msg Message) error {
+	select {
+	case transp.Out <- msg:
+		return nil
+	case <-transp.outDone:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send a message with OverflowDropOldest.  Senders are serialized, so while
+// the queued messages are taken and replaced, only a reader can change the
+// queue.
+func (transp *StdioTransport) sendDropOldest(ctx context.Context, msg Message) error {
+	transp.dropMux.Lock()
+	defer transp.dropMux.Unlock()
+
+	select {
+	case transp.Out <- msg:
+		return nil
+	default:
+	}
+
+	var queued []Message
+drain:
+	for len(queued) < cap(transp.Out) {
+		select {
+		case old := <-transp.Out:
+			queued = append(queued, old)
+		default:
+			break drain
+		}
+	}
+
+	// a reader may have made room in the meantime
+	send := true
+	if len(queued) == cap(transp.Out) {
+		send, queued = dropFromFullQueue(queued, msg)
+	}
+
+	// no other sender can add to the queue, so the queued messages fit
+	for _, old := range queued {
+		transp.Out <- old
+	}
+	if !send {
+		return nil
+	}
+	// this only waits if the queue holds only control messages
+	return transp.waitToSend(ctx, msg)
+}
+
+// Choose what to drop from a full queue in order to send msg, returning
+// whether msg should still be sent and the messages to keep queued.  A control
+// message is only dropped if the same message is still queued.
+func dropFromFullQueue(queued []Message, msg Message) (bool, []Message) {
+	isControl := controlMessages[msg.Type]
+	if isControl {
+		for _, old := range queued {
+			if reflect.DeepEqual(old, msg) {
+				log.Printf("Outgoing message queue is full; dropped duplicate %s message", msg.Type)
+				return false, queued
+			}
+		}
+	}
+
+	for i, old := range queued {
+		if !controlMessages[old.Type] {
+			log.Printf("Outgoing message queue is full; dropped %s message", old.Type)
+			return true, append(queued[:i], queued[i+1:]...)
+		}
+	}
+
+	if !isControl {
+		log.Printf("Outgoing message queue is full of control messages; dropped %s message", msg.Type)
+		return false, queued
+	}
+	return true, queued
+}
+
+// Close the outgoing side of the transport, as when the other process has
+// exited.  Messages already queued can still be read, after which Read
+// returns io.EOF.  Any subsequent or blocked sends fail with ErrClosed.  This
+// can be called more than once.
+func (transp *StdioTransport) CloseOut() {
+	transp.closeOutOnce.Do(func() {
+		close(transp.outDone)
+
+		transp.outMux.Lock()
+		defer transp.outMux.Unlock()
+		transp.outClosed = true
+		close(transp.Out)
+	})
 }
 
 func (transp *StdioTransport) Recv() (Message, bool) {
@@ -89,8 +303,10 @@ func (transp *StdioTransport) Read(p []byte) (int, error) {
 func (transp *StdioTransport) Write(p []byte) (int, error) {
 	transp.inMux.Lock()
 	defer transp.inMux.Unlock()
+	// copy p, as io.Writer implementations must not retain it (and io.Copy
+	// reuses its buffer, which would corrupt any partial line)
 	if len(transp.inBuffer) == 0 {
-		transp.inBuffer = p
+		transp.inBuffer = append([]byte(nil), p...)
 	} else {
 		transp.inBuffer = append(transp.inBuffer, p...)
 	}
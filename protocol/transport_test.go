@@ -2,11 +2,17 @@ package protocol
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // Write the given data in chunks of the given size
@@ -16,7 +22,7 @@ func writeInChunks(data []byte, chunkSize int, writer io.WriteCloser) error {
 			break
 		}
 
-		if len(data) >= chunkSize {
+		if len(data) < chunkSize {
 			chunkSize = len(data)
 		}
 		n, err := writer.Write(data[:chunkSize])
@@ -147,3 +153,182 @@ func TestReaderUnmarshalable(t *testing.T) {
 	_, err := io.Copy(&result, transp)
 	assert.Error(t, err)
 }
+
+// Read all messages from a transport whose outgoing side has been closed
+func readAllTypes(t *testing.T, transp *StdioTransport) []string {
+	var result bytes.Buffer
+	_, err := io.Copy(&result, transp)
+	require.NoError(t, err)
+
+	types := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(result.String()), "\n") {
+		var msg Message
+		require.NoError(t, json.Unmarshal([]byte(line[1:]), &msg))
+		types = append(types, msg.Type)
+	}
+	return types
+}
+
+// Run f, failing if it does not return promptly
+func requireReturns(t *testing.T, f func()) {
+	done := make(chan bool)
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked")
+	}
+}
+
+func TestSendDropOldest(t *testing.T) {
+	transp := NewStdioTransportWithOptions(StdioTransportOptions{QueueSize: 2})
+
+	// nothing reads from the transport, but sending does not block
+	requireReturns(t, func() {
+		for i := 0; i < 10; i++ {
+			transp.Send(Message{Type: "msg" + strconv.Itoa(i)})
+		}
+	})
+
+	transp.CloseOut()
+	assert.Equal(t, []string{"msg8", "msg9"}, readAllTypes(t, transp))
+}
+
+func TestSendError(t *testing.T) {
+	transp := NewStdioTransportWithOptions(StdioTransportOptions{QueueSize: 1, Overflow: OverflowError})
+
+	require.NoError(t, transp.SendContext(context.Background(), Message{Type: "first"}))
+	require.Equal(t, ErrQueueFull, transp.SendContext(context.Background(), Message{Type: "second"}))
+
+	// Send logs the error and drops the message
+	requireReturns(t, func() {
+		transp.Send(Message{Type: "third"})
+	})
+
+	transp.CloseOut()
+	assert.Equal(t, []string{"first"}, readAllTypes(t, transp))
+}
+
+func TestSendBlockTimeout(t *testing.T) {
+	transp := NewStdioTransportWithOptions(StdioTransportOptions{
+		QueueSize:   1,
+		Overflow:    OverflowBlock,
+		SendTimeout: 10 * time.Millisecond,
+	})
+
+	transp.Send(Message{Type: "first"})
+	requireReturns(t, func() {
+		transp.Send(Message{Type: "second"})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, transp.SendContext(ctx, Message{Type: "third"}))
+
+	transp.CloseOut()
+	assert.Equal(t, []string{"first"}, readAllTypes(t, transp))
+}
+
+func TestSendBlockReader(t *testing.T) {
+	transp := NewStdioTransportWithOptions(StdioTransportOptions{QueueSize: 1, Overflow: OverflowBlock})
+
+	// a slow reader eventually receives all messages, in order
+	types := make(chan []string)
+	go func() {
+		types <- readAllTypes(t, transp)
+	}()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, transp.SendContext(context.Background(), Message{Type: "msg" + strconv.Itoa(i)}))
+	}
+	transp.CloseOut()
+	assert.Equal(t, []string{"msg0", "msg1", "msg2", "msg3", "msg4"}, <-types)
+}
+
+func TestCloseOut(t *testing.T) {
+	transp := NewStdioTransportWithOptions(StdioTransportOptions{QueueSize: 1, Overflow: OverflowBlock})
+	require.NoError(t, transp.SendContext(context.Background(), Message{Type: "first"}))
+
+	// a sender blocked on a full queue is released when the transport closes
+	blocked := make(chan error)
+	go func() {
+		blocked <- transp.SendContext(context.Background(), Message{Type: "second"})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	transp.CloseOut()
+	require.Equal(t, ErrClosed, <-blocked)
+
+	// sending after closing fails rather than panicking, and closing again is
+	// harmless
+	require.Equal(t, ErrClosed, transp.SendContext(context.Background(), Message{Type: "third"}))
+	transp.Send(Message{Type: "fourth"})
+	transp.CloseOut()
+
+	// queued messages can still be read
+	assert.Equal(t, []string{"first"}, readAllTypes(t, transp))
+}
+
+func TestSendDropOldestKeepsControlMessages(t *testing.T) {
+	transp := NewStdioTransportWithOptions(StdioTransportOptions{QueueSize: 3})
+
+	requireReturns(t, func() {
+		transp.Send(Message{Type: "welcome"})
+		transp.Send(Message{Type: "msg0"})
+		transp.Send(Message{Type: "msg1"})
+		transp.Send(Message{Type: "graceful-termination", Properties: map[string]interface{}{"finish-tasks": true}})
+		transp.Send(Message{Type: "msg2"})
+	})
+
+	transp.CloseOut()
+	assert.Equal(t, []string{"welcome", "graceful-termination", "msg2"}, readAllTypes(t, transp))
+}
+
+func TestSendDropOldestDuplicateControlMessages(t *testing.T) {
+	transp := NewStdioTransportWithOptions(StdioTransportOptions{QueueSize: 2})
+
+	// repeated identical control messages do not fill the queue, and other
+	// messages are dropped once it holds only control messages
+	gt := func(finishTasks bool) Message {
+		return Message{Type: "graceful-termination", Properties: map[string]interface{}{"finish-tasks": finishTasks}}
+	}
+	requireReturns(t, func() {
+		transp.Send(Message{Type: "welcome"})
+		for i := 0; i < 5; i++ {
+			transp.Send(gt(true))
+		}
+		transp.Send(Message{Type: "msg0"})
+	})
+
+	// a different control message waits for room
+	sent := make(chan error)
+	go func() {
+		sent <- transp.SendContext(context.Background(), gt(false))
+	}()
+	select {
+	case err := <-sent:
+		t.Fatalf("did not wait: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	types := make(chan []string)
+	go func() {
+		types <- readAllTypes(t, transp)
+	}()
+	require.NoError(t, <-sent)
+	transp.CloseOut()
+	assert.Equal(t, []string{"welcome", "graceful-termination", "graceful-termination"}, <-types)
+}
+
+func TestSendDropOldestControlMessageTimeout(t *testing.T) {
+	transp := NewStdioTransportWithOptions(StdioTransportOptions{QueueSize: 1, SendTimeout: 10 * time.Millisecond})
+
+	transp.Send(Message{Type: "welcome"})
+	requireReturns(t, func() {
+		transp.Send(Message{Type: "graceful-termination", Properties: map[string]interface{}{"finish-tasks": false}})
+	})
+
+	transp.CloseOut()
+	assert.Equal(t, []string{"welcome"}, readAllTypes(t, transp))
+}
@@ -0,0 +1,116 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+)
+
+// A function to check the properties of a message of a particular type
+type validator func(msg Message) error
+
+// Validators for known message types.  Messages of other types are not
+// validated, since they have no callbacks or belong to capabilities that
+// were added later.
+var validators = map[string]validator{
+	"welcome":              validateCapabilities,
+	"hello":                validateCapabilities,
+	"graceful-termination": requireBool("finish-tasks"),
+	"metrics":              requireArray("samples"),
+}
+
+// Validate a message's properties against the schema for its type, as
+// described in `protocol.md`.  Messages are validated before their callbacks
+// are called, so callbacks can assume that required properties are present.
+func ValidateMessage(msg Message) error {
+	if msg.Type == "" {
+		return fmt.Errorf("message has no type")
+	}
+	if v, ok := validators[msg.Type]; ok {
+		return v(msg)
+	}
+	return nil
+}
+
+func validateCapabilities(msg Message) error {
+	caps, ok := msg.Properties["capabilities"]
+	if !ok {
+		return fmt.Errorf("capabilities is required")
+	}
+	if !isListOfStrings(caps) {
+		return fmt.Errorf("capabilities must be an array of strings")
+	}
+
+	if v, ok := msg.Properties["protocol-version"]; ok {
+		if !isInteger(v) || toFloat(v) < 1 {
+			return fmt.Errorf("protocol-version must be a positive integer")
+		}
+	}
+
+	if params, ok := msg.Properties["capability-parameters"]; ok {
+		paramsObj, ok := params.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("capability-parameters must be an object")
+		}
+		for c, p := range paramsObj {
+			if _, ok := p.(map[string]interface{}); !ok {
+				return fmt.Errorf("capability-parameters.%s must be an object", c)
+			}
+		}
+	}
+
+	return nil
+}
+
+func requireBool(property string) validator {
+	return func(msg Message) error {
+		if _, ok := msg.Properties[property].(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", property)
+		}
+		return nil
+	}
+}
+
+func requireArray(property string) validator {
+	return func(msg Message) error {
+		if _, ok := msg.Properties[property].([]interface{}); !ok {
+			return fmt.Errorf("%s must be an array", property)
+		}
+		return nil
+	}
+}
+
+func isListOfStrings(val interface{}) bool {
+	switch val := val.(type) {
+	case []string:
+		return true
+	case []interface{}:
+		for _, elt := range val {
+			if _, ok := elt.(string); !ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Check for an integer, which may have been decoded from JSON as a float64
+func isInteger(val interface{}) bool {
+	switch val := val.(type) {
+	case int:
+		return true
+	case float64:
+		return val == math.Trunc(val) && math.Abs(val) <= math.MaxInt32
+	}
+	return false
+}
+
+func toFloat(val interface{}) float64 {
+	switch val := val.(type) {
+	case int:
+		return float64(val)
+	case float64:
+		return val
+	}
+	return 0
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateMessage(t *testing.T) {
+	for _, test := range []struct {
+		encoded string
+		valid   bool
+	}{
+		{`{"type": "hello", "capabilities": []}`, true},
+		{`{"type": "hello", "capabilities": ["a", "b"], "protocol-version": 2}`, true},
+		{`{"type": "welcome", "capabilities": ["a"], "capability-parameters": {"a": {"x": 1}}}`, true},
+		{`{"type": "hello"}`, false},
+		{`{"type": "hello", "capabilities": "a"}`, false},
+		{`{"type": "hello", "capabilities": [1]}`, false},
+		{`{"type": "hello", "capabilities": [], "protocol-version": 0}`, false},
+		{`{"type": "hello", "capabilities": [], "protocol-version": 1.5}`, false},
+		{`{"type": "hello", "capabilities": [], "protocol-version": "1"}`, false},
+		{`{"type": "hello", "capabilities": [], "capability-parameters": []}`, false},
+		{`{"type": "hello", "capabilities": [], "capability-parameters": {"a": 1}}`, false},
+		{`{"type": "graceful-termination", "finish-tasks": true}`, true},
+		{`{"type": "graceful-termination"}`, false},
+		{`{"type": "graceful-termination", "finish-tasks": "yes"}`, false},
+		{`{"type": "metrics", "samples": []}`, true},
+		{`{"type": "metrics", "samples": {}}`, false},
+		{`{"type": "heartbeat"}`, true},
+		{`{"type": "some-future-message", "anything": [1, 2]}`, true},
+		{`{"type": ""}`, false},
+	} {
+		var msg Message
+		require.NoError(t, json.Unmarshal([]byte(test.encoded), &msg), test.encoded)
+		err := ValidateMessage(msg)
+		if test.valid {
+			assert.NoError(t, err, test.encoded)
+		} else {
+			assert.Error(t, err, test.encoded)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Package workerclient implements the worker side of the worker-runner
+// protocol, for use by worker implementations.  See `protocol.md` for details
+// of the protocol.
+//
+// A worker creates a client, declares the capabilities it supports by
+// registering handlers or enabling them, and then starts the client:
+//
+//	c := workerclient.NewStdio()
+//	c.OnGracefulTermination(func(finishTasks bool) { ... })
+//	c.EnableHeartbeat()
+//	c.Start()
+//	defer c.Close()
+//
+// Messages to start-worker are only sent once the connection is initialized
+// and start-worker has agreed to the corresponding capability, so it is safe
+// to call methods like Heartbeat when the worker is not running under
+// start-worker at all.
+package workerclient
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+)
+
+// Client is a connection to start-worker, from the worker's perspective
+type Client struct {
+	in     io.Reader
+	out    io.Writer
+	closer io.Closer
+
+	transp *protocol.StdioTransport
+	proto  *protocol.Protocol
+
+	// closed when all output has been written
+	outputDone chan struct{}
+}
+
+// MetricSample is a metric sample to be forwarded to start-worker with the
+// `metrics` capability.  For counters, Value is an increment; for gauges, it
+// is the new value; and for histograms, it is an observation.
+type MetricSample struct {
+	Name   string
+	Kind   string
+	Value  float64
+	Labels map[string]string
+}
+
+// Create a new client reading protocol messages from in and writing them to
+// out.
+func New(in io.Reader, out io.Writer) *Client {
+	transp := protocol.NewStdioTransport()
+	// start-worker sends nothing but protocol messages
+	transp.InvalidLines = ioutil.Discard
+
+	proto := protocol.NewProtocol(transp)
+	// capabilities are added as the worker declares them
+	proto.LocalCapabilities = protocol.EmptyCapabilities()
+
+	return &Client{
+		in:         in,
+		out:        out,
+		transp:     transp,
+		proto:      proto,
+		outputDone: make(chan struct{}),
+	}
+}
+
+// Create a new client communicating over stdin and stdout, as when the worker
+// is started by start-worker.  Other output to stdout is passed along to
+// start-worker's log.
+func NewStdio() *Client {
+	return New(os.Stdin, os.Stdout)
+}
+
+// Create a new client communicating over a network connection, such as a
+// unix socket.  The connection is closed when the client is closed.
+func Dial(network, address string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	c := New(conn, conn)
+	c.closer = conn
+	return c, nil
+}
+
+// Call the given function when start-worker requests graceful termination.
+// The function is called in its own goroutine, so it may take as long as
+// necessary to shut down.  This declares the `graceful-termination`
+// capability.  It must be called before Start.
+func (c *Client) OnGracefulTermination(cb func(finishTasks bool)) {
+	c.proto.LocalCapabilities.Add("graceful-termination")
+	c.proto.RegisterAsync("graceful-termination", 10, func(msg protocol.Message) {
+		finishTasks, _ := msg.Properties["finish-tasks"].(bool)
+		cb(finishTasks)
+	})
+}
+
+// Declare the `idle` capability, meaning that the worker will call Idle and
+// Busy.  It must be called before Start.
+func (c *Client) EnableIdle() {
+	c.proto.LocalCapabilities.Add("idle")
+}
+
+// Declare the `heartbeat` capability, meaning that the worker will call
+// Heartbeat regularly.  It must be called before Start.
+func (c *Client) EnableHeartbeat() {
+	c.proto.LocalCapabilities.Add("heartbeat")
+}
+
+// Declare the `metrics` capability, meaning that the worker may call
+// SendMetrics.  It must be called before Start.
+func (c *Client) EnableMetrics() {
+	c.proto.LocalCapabilities.Add("metrics")
+}
+
+// Start communicating with start-worker.  Capability negotiation happens in
+// the background.
+func (c *Client) Start() {
+	go func() {
+		_, _ = io.Copy(c.transp, c.in)
+		c.transp.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(c.out, c.transp)
+		close(c.outputDone)
+	}()
+	c.proto.Start(true)
+}
+
+// Wait until the connection is initialized.  This never returns if the worker
+// is not running under start-worker.
+func (c *Client) WaitUntilInitialized() {
+	c.proto.WaitUntilInitialized()
+}
+
+// Check if a capability was agreed, after waiting for initialization.
+func (c *Client) Capable(capability string) bool {
+	return c.proto.Capable(capability)
+}
+
+// Get a parameter for an agreed capability, after waiting for
+// initialization.  For example, the `heartbeat` capability's `interval`
+// parameter gives the number of seconds between heartbeats that start-worker
+// expects.
+func (c *Client) Parameter(capability, name string) (int, bool) {
+	c.proto.WaitUntilInitialized()
+	return c.proto.Capabilities.Parameter(capability, name)
+}
+
+// Send a message if the connection is initialized and the capability was
+// agreed, without waiting.
+func (c *Client) sendIfCapable(capability string, msg protocol.Message) {
+	if c.proto.IsInitialized() && c.proto.Capabilities.Has(capability) {
+		c.proto.Send(msg)
+	}
+}
+
+// Report that the worker has no running tasks
+func (c *Client) Idle() {
+	c.sendIfCapable("idle", protocol.Message{Type: "idle"})
+}
+
+// Report that the worker has begun a task
+func (c *Client) Busy() {
+	c.sendIfCapable("idle", protocol.Message{Type: "busy"})
+}
+
+// Report that the worker is alive
+func (c *Client) Heartbeat() {
+	c.sendIfCapable("heartbeat", protocol.Message{Type: "heartbeat"})
+}
+
+// Forward metric samples to start-worker
+func (c *Client) SendMetrics(samples ...MetricSample) {
+	list := make([]interface{}, len(samples))
+	for i, s := range samples {
+		sample := map[string]interface{}{
+			"name":  s.Name,
+			"kind":  s.Kind,
+			"value": s.Value,
+		}
+		if len(s.Labels) > 0 {
+			labels := make(map[string]interface{})
+			for k, v := range s.Labels {
+				labels[k] = v
+			}
+			sample["labels"] = labels
+		}
+		list[i] = sample
+	}
+	c.sendIfCapable("metrics", protocol.Message{
+		Type:       "metrics",
+		Properties: map[string]interface{}{"samples": list},
+	})
+}
+
+// Close the client, after writing any messages already sent.  The client
+// must have been started.
+func (c *Client) Close() error {
+	c.transp.CloseOut()
+	<-c.outputDone
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package workerclient
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiation(t *testing.T) {
+	r := NewFakeRunner("graceful-termination", "heartbeat")
+	defer r.Close()
+
+	c := r.Client()
+	c.OnGracefulTermination(func(bool) {})
+	c.EnableIdle()
+	c.Start()
+	defer c.Close()
+
+	r.WaitUntilInitialized()
+	c.WaitUntilInitialized()
+
+	// only capabilities both sides support are agreed
+	for _, capable := range []func(string) bool{r.Capable, c.Capable} {
+		assert.True(t, capable("graceful-termination"))
+		assert.False(t, capable("heartbeat"))
+		assert.False(t, capable("idle"))
+	}
+}
+
+func TestGracefulTermination(t *testing.T) {
+	r := NewFakeRunner()
+	defer r.Close()
+
+	got := make(chan bool)
+	c := r.Client()
+	c.OnGracefulTermination(func(finishTasks bool) {
+		got <- finishTasks
+	})
+	c.Start()
+	defer c.Close()
+
+	require.True(t, r.Capable("graceful-termination"))
+	r.GracefulTermination(true)
+	assert.True(t, <-got)
+	r.GracefulTermination(false)
+	assert.False(t, <-got)
+}
+
+func TestWorkerMessages(t *testing.T) {
+	r := NewFakeRunner()
+	defer r.Close()
+
+	c := r.Client()
+	c.EnableIdle()
+	c.EnableHeartbeat()
+	c.EnableMetrics()
+	c.Start()
+	defer c.Close()
+
+	c.WaitUntilInitialized()
+	c.Idle()
+	c.Busy()
+	c.Heartbeat()
+	c.SendMetrics(MetricSample{"tasks_total", "counter", 1, map[string]string{"status": "completed"}})
+
+	msg, err := r.WaitForMessage("metrics", 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"name":   "tasks_total",
+			"kind":   "counter",
+			"value":  1.0,
+			"labels": map[string]interface{}{"status": "completed"},
+		},
+	}, msg.Properties["samples"])
+
+	var types []string
+	for _, msg := range r.Messages() {
+		types = append(types, msg.Type)
+	}
+	assert.Equal(t, []string{"hello", "idle", "busy", "heartbeat", "metrics"}, types)
+}
+
+func TestUnsupportedMessagesNotSent(t *testing.T) {
+	r := NewFakeRunner("graceful-termination")
+	defer r.Close()
+
+	c := r.Client()
+	c.EnableHeartbeat()
+
+	// sending before starting, or before initialization, does nothing
+	c.Heartbeat()
+	c.Start()
+	defer c.Close()
+
+	c.WaitUntilInitialized()
+	c.Heartbeat()
+	c.Idle()
+
+	_, err := r.WaitForMessage("heartbeat", 100*time.Millisecond)
+	assert.Error(t, err)
+	assert.Len(t, r.Messages(), 1)
+}
+
+func TestDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// connect the fake runner to the socket, rather than using r.Client()
+	r := NewFakeRunner()
+	r.proto.Start(false)
+	defer r.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, _ = io.Copy(conn, r.transp)
+		}()
+		_, _ = io.Copy(r.transp, conn)
+	}()
+
+	c, err := Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	c.EnableHeartbeat()
+	c.Start()
+
+	c.WaitUntilInitialized()
+	c.Heartbeat()
+	_, err = r.WaitForMessage("heartbeat", 5*time.Second)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Close())
+}
+
+func TestParameter(t *testing.T) {
+	r := NewFakeRunner()
+	r.SetParameter("heartbeat", "interval", 30)
+	defer r.Close()
+
+	c := r.Client()
+	c.EnableHeartbeat()
+	c.Start()
+	defer c.Close()
+
+	interval, ok := c.Parameter("heartbeat", "interval")
+	assert.True(t, ok)
+	assert.Equal(t, 30, interval)
+}
@@ -0,0 +1,125 @@
+package workerclient
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+)
+
+// FakeRunner stands in for start-worker in tests of workers using this
+// package.  It offers the given capabilities (or all known capabilities) and
+// records every message it receives from the worker.
+type FakeRunner struct {
+	transp *protocol.StdioTransport
+	proto  *protocol.Protocol
+
+	// protects messages and changed
+	mux      sync.Mutex
+	messages []protocol.Message
+	// closed and replaced whenever a message is received
+	changed chan struct{}
+}
+
+// Create a new FakeRunner, offering the given capabilities or, if none are
+// given, all known capabilities.  Connect a worker to it with Client.
+func NewFakeRunner(capabilities ...string) *FakeRunner {
+	r := &FakeRunner{
+		transp:  protocol.NewStdioTransport(),
+		changed: make(chan struct{}),
+	}
+	r.proto = protocol.NewProtocol(r)
+	if len(capabilities) > 0 {
+		r.proto.LocalCapabilities = protocol.FromCapabilitiesList(capabilities)
+	}
+	return r
+}
+
+// Set a parameter for an offered capability.  This must be called before
+// Client.
+func (r *FakeRunner) SetParameter(capability, name string, value int) {
+	r.proto.LocalCapabilities.SetParameter(capability, name, value)
+}
+
+// protocol.Transport interface, recording received messages
+
+func (r *FakeRunner) Send(msg protocol.Message) {
+	r.transp.Send(msg)
+}
+
+func (r *FakeRunner) Recv() (protocol.Message, bool) {
+	msg, ok := r.transp.Recv()
+	if ok {
+		r.mux.Lock()
+		r.messages = append(r.messages, msg)
+		close(r.changed)
+		r.changed = make(chan struct{})
+		r.mux.Unlock()
+	}
+	return msg, ok
+}
+
+// Create a client connected to this fake runner, and start the runner side of
+// the protocol.  As with any client, the result must be started.  This can
+// only be called once.
+func (r *FakeRunner) Client() *Client {
+	r.proto.Start(false)
+	return New(r.transp, r.transp)
+}
+
+// Wait until the worker has sent `hello`.
+func (r *FakeRunner) WaitUntilInitialized() {
+	r.proto.WaitUntilInitialized()
+}
+
+// Check if a capability was agreed, after waiting for initialization.
+func (r *FakeRunner) Capable(capability string) bool {
+	return r.proto.Capable(capability)
+}
+
+// Send a `graceful-termination` message to the worker.
+func (r *FakeRunner) GracefulTermination(finishTasks bool) {
+	r.proto.Send(protocol.Message{
+		Type:       "graceful-termination",
+		Properties: map[string]interface{}{"finish-tasks": finishTasks},
+	})
+}
+
+// Get the messages received from the worker so far, including `hello`.
+func (r *FakeRunner) Messages() []protocol.Message {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	rv := make([]protocol.Message, len(r.messages))
+	copy(rv, r.messages)
+	return rv
+}
+
+// Wait for the worker to send a message of the given type, returning the
+// first such message.
+func (r *FakeRunner) WaitForMessage(messageType string, timeout time.Duration) (protocol.Message, error) {
+	deadline := time.After(timeout)
+	for {
+		r.mux.Lock()
+		for _, msg := range r.messages {
+			if msg.Type == messageType {
+				r.mux.Unlock()
+				return msg, nil
+			}
+		}
+		changed := r.changed
+		r.mux.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return protocol.Message{}, fmt.Errorf("no %s message received within %s", messageType, timeout)
+		}
+	}
+}
+
+// Close the connection to the worker, as start-worker does when it exits.
+// Nothing can be sent to the worker after this.
+func (r *FakeRunner) Close() {
+	r.transp.CloseOut()
+}
@@ -1,12 +1,14 @@
 package aws
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"time"
 
 	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/metrics"
 	"github.com/taskcluster/taskcluster-worker-runner/protocol"
 	"github.com/taskcluster/taskcluster-worker-runner/provider/provider"
 	"github.com/taskcluster/taskcluster-worker-runner/run"
@@ -16,6 +18,15 @@ import (
 )
 
 const TERMINATION_PATH = "/meta-data/spot/termination-time"
+const INSTANCE_ACTION_PATH = "/meta-data/spot/instance-action"
+const REBALANCE_PATH = "/meta-data/events/recommendations/rebalance"
+
+// Data from the instance-action endpoint; see
+// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/spot-instance-termination-notices.html
+type InstanceAction struct {
+	Action string `json:"action"`
+	Time   string `json:"time"`
+}
 
 type AWSProvider struct {
 	runnercfg                  *cfg.RunnerConfig
@@ -23,9 +34,17 @@ type AWSProvider struct {
 	metadataService            MetadataService
 	proto                      *protocol.Protocol
 	terminationTicker          *time.Ticker
+	terminationPollInterval    time.Duration
+	// true once the worker has been told about a rebalance recommendation
+	rebalanceNotified bool
+
+	// the state for this run, used to remove the worker when it finishes
+	state *run.State
 }
 
 func (p *AWSProvider) ConfigureRun(state *run.State) error {
+	p.state = state
+
 	userData, err := p.metadataService.queryUserData()
 	if err != nil {
 		return fmt.Errorf("Could not query user data: %v", err)
@@ -105,6 +124,7 @@ func (p *AWSProvider) ConfigureRun(state *run.State) error {
 }
 
 func (p *AWSProvider) UseCachedRun(run *run.State) error {
+	p.state = run
 	return nil
 }
 
@@ -112,26 +132,75 @@ func (p *AWSProvider) SetProtocol(proto *protocol.Protocol) {
 	p.proto = proto
 }
 
+// Send a graceful-termination message, if the worker is capable, returning
+// true if the message was sent.
+func (p *AWSProvider) sendGracefulTermination(finishTasks bool) bool {
+	if p.proto != nil && p.proto.Capable("graceful-termination") {
+		p.proto.Send(protocol.Message{
+			Type: "graceful-termination",
+			Properties: map[string]interface{}{
+				"finish-tasks": finishTasks,
+			},
+		})
+		return true
+	}
+	return false
+}
+
+// Query the instance-action endpoint, returning the pending action or nil if
+// there is none.
+func (p *AWSProvider) queryInstanceAction() *InstanceAction {
+	content, err := p.metadataService.queryMetadata(INSTANCE_ACTION_PATH)
+	// the endpoint returns 404 when no action is scheduled
+	if err != nil {
+		return nil
+	}
+
+	action := &InstanceAction{}
+	err = json.Unmarshal([]byte(content), action)
+	if err != nil {
+		log.Printf("Could not parse instance-action metadata: %v", err)
+		return nil
+	}
+	return action
+}
+
 func (p *AWSProvider) checkTerminationTime() {
+	if action := p.queryInstanceAction(); action != nil {
+		log.Printf("EC2 Metadata Service says instance action %s is scheduled at %s", action.Action, action.Time)
+		metrics.TerminationNotice("aws", "instance-action", action.Action+"@"+action.Time)
+		// the instance will be stopped or terminated within two minutes,
+		// which generally doesn't leave time to finish tasks
+		p.sendGracefulTermination(false)
+		return
+	}
+
 	_, err := p.metadataService.queryMetadata(TERMINATION_PATH)
 	// if the file exists (so, no error), it's time to go away
 	if err == nil {
 		log.Println("EC2 Metadata Service says termination is imminent")
-		if p.proto != nil && p.proto.Capable("graceful-termination") {
-			p.proto.Send(protocol.Message{
-				Type: "graceful-termination",
-				Properties: map[string]interface{}{
-					// spot termination generally doesn't leave time to finish tasks
-					"finish-tasks": false,
-				},
-			})
+		metrics.TerminationNotice("aws", "termination-time", "termination-time")
+		// spot termination generally doesn't leave time to finish tasks
+		p.sendGracefulTermination(false)
+		return
+	}
+
+	// a rebalance recommendation arrives well before any interruption, so
+	// the worker can stop claiming new tasks and finish the ones it has.  This
+	// notice does not go away, so only pass it along once.
+	if !p.rebalanceNotified {
+		_, err = p.metadataService.queryMetadata(REBALANCE_PATH)
+		if err == nil {
+			log.Println("EC2 Metadata Service recommends rebalancing; stopping worker after current tasks")
+			metrics.TerminationNotice("aws", "rebalance", "rebalance")
+			p.rebalanceNotified = p.sendGracefulTermination(true)
 		}
 	}
 }
 
 func (p *AWSProvider) WorkerStarted() error {
 	// start polling for graceful shutdown
-	p.terminationTicker = time.NewTicker(30 * time.Second)
+	p.terminationTicker = time.NewTicker(p.terminationPollInterval)
 	go func() {
 		for {
 			<-p.terminationTicker.C
@@ -145,7 +214,7 @@ func (p *AWSProvider) WorkerStarted() error {
 
 func (p *AWSProvider) WorkerFinished() error {
 	p.terminationTicker.Stop()
-	return nil
+	return provider.RemoveWorker(p.runnercfg, p.state, p.workerManagerClientFactory)
 }
 
 func clientFactory(rootURL string, credentials *tcclient.Credentials) (tc.WorkerManager, error) {
@@ -165,8 +234,24 @@ providers using providerType "aws".  It requires
 ` + "```yaml" + `
 provider:
     providerType: aws
+    # (optional) if true, fall back to IMDSv1 if an IMDSv2 session token
+    # cannot be obtained from the metadata service (default false)
+    allowIMDSv1: false
+    # (optional) interval, in seconds, at which to poll the metadata service
+    # for termination notices (default 30)
+    terminationPollInterval: 30
 ` + "```" + `
 
+While the worker is running, this provider polls for spot interruption
+notices, scheduled instance actions, and rebalance recommendations.  An
+imminent stop or termination results in a graceful-termination message with
+` + "`finish-tasks: false`" + `, while a rebalance recommendation results in a
+graceful-termination message with ` + "`finish-tasks: true`" + `, giving
+running tasks a chance to complete.
+
+All metadata requests use IMDSv2 session tokens, so this provider works on
+instances where IMDSv1 is disabled.
+
 The [$TASKCLUSTER_WORKER_LOCATION](https://docs.taskcluster.net/docs/manual/design/env-vars#taskcluster_worker_location)
 defined by this provider has the following fields:
 
@@ -187,17 +272,47 @@ func new(
 	}
 
 	if metadataService == nil {
-		metadataService = &realMetadataService{}
+		allowIMDSv1 := false
+		if v, ok := runnercfg.Provider.Data["allowIMDSv1"]; ok {
+			allowIMDSv1, ok = v.(bool)
+			if !ok {
+				return nil, errors.New("provider.allowIMDSv1 must be a boolean")
+			}
+		}
+		metadataService = &realMetadataService{allowIMDSv1: allowIMDSv1}
 	}
 
-	if _, err := metadataService.queryMetadata(TERMINATION_PATH); err == nil {
-		return nil, errors.New("Instance is about to shutdown")
+	terminationPollInterval := 30 * time.Second
+	if v, ok := runnercfg.Provider.Data["terminationPollInterval"]; ok {
+		// numbers from YAML are ints, but those from JSON are float64s
+		var secs float64
+		switch v := v.(type) {
+		case int:
+			secs = float64(v)
+		case float64:
+			secs = v
+		}
+		if secs <= 0 {
+			return nil, errors.New("provider.terminationPollInterval must be a positive number of seconds")
+		}
+		terminationPollInterval = time.Duration(secs * float64(time.Second))
 	}
 
-	return &AWSProvider{
+	p := &AWSProvider{
 		runnercfg:                  runnercfg,
 		workerManagerClientFactory: workerManagerClientFactory,
 		metadataService:            metadataService,
 		proto:                      nil,
-	}, nil
+		terminationPollInterval:    terminationPollInterval,
+	}
+
+	if _, err := metadataService.queryMetadata(TERMINATION_PATH); err == nil {
+		return nil, errors.New("Instance is about to shutdown")
+	}
+
+	if action := p.queryInstanceAction(); action != nil {
+		return nil, fmt.Errorf("Instance is about to %s", action.Action)
+	}
+
+	return p, nil
 }
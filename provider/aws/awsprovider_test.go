@@ -3,6 +3,7 @@ package aws
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/taskcluster/taskcluster-worker-runner/cfg"
@@ -138,3 +139,168 @@ func TestCheckTerminationTime(t *testing.T) {
 		},
 	}, transp.Messages())
 }
+
+func TestCheckTerminationTimeIMDSv2(t *testing.T) {
+	imds := &fakeIMDS{
+		Metadata: map[string]string{},
+	}
+	defer imds.start()()
+
+	runnercfg := &cfg.RunnerConfig{
+		Provider: cfg.ProviderConfig{
+			ProviderType: "aws",
+		},
+	}
+
+	p, err := new(runnercfg, tc.FakeWorkerManagerClientFactory, nil)
+	require.NoError(t, err, "creating provider")
+
+	transp := protocol.NewFakeTransport()
+	proto := protocol.NewProtocol(transp)
+	proto.Capabilities.Add("graceful-termination")
+	proto.SetInitialized()
+	p.SetProtocol(proto)
+
+	p.checkTerminationTime()
+	require.Equal(t, []protocol.Message{}, transp.Messages())
+
+	imds.Metadata["/meta-data/spot/termination-time"] = "now!"
+	p.checkTerminationTime()
+
+	require.Equal(t, []protocol.Message{
+		protocol.Message{
+			Type: "graceful-termination",
+			Properties: map[string]interface{}{
+				"finish-tasks": false,
+			},
+		},
+	}, transp.Messages())
+
+	// and a new provider refuses to start
+	_, err = new(runnercfg, tc.FakeWorkerManagerClientFactory, nil)
+	require.Error(t, err)
+}
+
+func TestCheckInstanceAction(t *testing.T) {
+	transp := protocol.NewFakeTransport()
+	proto := protocol.NewProtocol(transp)
+	proto.Capabilities.Add("graceful-termination")
+	proto.SetInitialized()
+
+	metaData := map[string]string{}
+
+	p := &AWSProvider{
+		metadataService: &fakeMetadataService{nil, nil, metaData, ""},
+		proto:           proto,
+	}
+
+	p.checkTerminationTime()
+	require.Equal(t, []protocol.Message{}, transp.Messages())
+
+	metaData["/meta-data/spot/instance-action"] = `{"action": "stop", "time": "2017-09-18T08:22:00Z"}`
+	p.checkTerminationTime()
+
+	require.Equal(t, []protocol.Message{
+		protocol.Message{
+			Type: "graceful-termination",
+			Properties: map[string]interface{}{
+				"finish-tasks": false,
+			},
+		},
+	}, transp.Messages())
+}
+
+func TestCheckRebalanceRecommendation(t *testing.T) {
+	transp := protocol.NewFakeTransport()
+	proto := protocol.NewProtocol(transp)
+	proto.SetInitialized()
+
+	metaData := map[string]string{
+		"/meta-data/events/recommendations/rebalance": `{"noticeTime": "2020-10-27T08:22:00Z"}`,
+	}
+
+	p := &AWSProvider{
+		metadataService: &fakeMetadataService{nil, nil, metaData, ""},
+		proto:           proto,
+	}
+
+	// protocol does not have the capability set..
+	p.checkTerminationTime()
+	require.Equal(t, []protocol.Message{}, transp.Messages())
+
+	proto.Capabilities.Add("graceful-termination")
+	p.checkTerminationTime()
+
+	finishTasks := protocol.Message{
+		Type: "graceful-termination",
+		Properties: map[string]interface{}{
+			"finish-tasks": true,
+		},
+	}
+	require.Equal(t, []protocol.Message{finishTasks}, transp.Messages())
+
+	// the recommendation is only passed along once..
+	p.checkTerminationTime()
+	require.Equal(t, []protocol.Message{finishTasks}, transp.Messages())
+
+	// ..but an imminent termination still results in a message
+	metaData["/meta-data/spot/instance-action"] = `{"action": "terminate", "time": "2020-10-27T08:30:00Z"}`
+	p.checkTerminationTime()
+	require.Equal(t, []protocol.Message{
+		finishTasks,
+		protocol.Message{
+			Type: "graceful-termination",
+			Properties: map[string]interface{}{
+				"finish-tasks": false,
+			},
+		},
+	}, transp.Messages())
+}
+
+func TestNewInstanceActionPending(t *testing.T) {
+	runnercfg := &cfg.RunnerConfig{
+		Provider: cfg.ProviderConfig{
+			ProviderType: "aws",
+		},
+	}
+	metaData := map[string]string{
+		"/meta-data/spot/instance-action": `{"action": "terminate", "time": "2020-10-27T08:30:00Z"}`,
+	}
+
+	_, err := new(runnercfg, tc.FakeWorkerManagerClientFactory, &fakeMetadataService{nil, nil, metaData, ""})
+	require.Error(t, err)
+}
+
+func TestTerminationPollInterval(t *testing.T) {
+	mds := &fakeMetadataService{nil, nil, map[string]string{}, ""}
+
+	runnercfg := &cfg.RunnerConfig{
+		Provider: cfg.ProviderConfig{
+			ProviderType: "aws",
+		},
+	}
+	p, err := new(runnercfg, tc.FakeWorkerManagerClientFactory, mds)
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, p.terminationPollInterval)
+
+	runnercfg.Provider.Data = map[string]interface{}{"terminationPollInterval": 5}
+	p, err = new(runnercfg, tc.FakeWorkerManagerClientFactory, mds)
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Second, p.terminationPollInterval)
+
+	runnercfg.Provider.Data = map[string]interface{}{"terminationPollInterval": 5.0}
+	p, err = new(runnercfg, tc.FakeWorkerManagerClientFactory, mds)
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Second, p.terminationPollInterval)
+
+	runnercfg.Provider.Data = map[string]interface{}{"terminationPollInterval": 2.5}
+	p, err = new(runnercfg, tc.FakeWorkerManagerClientFactory, mds)
+	require.NoError(t, err)
+	require.Equal(t, 2500*time.Millisecond, p.terminationPollInterval)
+
+	for _, invalid := range []interface{}{"soon", 0, -1, 0.0, -2.5} {
+		runnercfg.Provider.Data = map[string]interface{}{"terminationPollInterval": invalid}
+		_, err = new(runnercfg, tc.FakeWorkerManagerClientFactory, mds)
+		require.Error(t, err, "%v", invalid)
+	}
+}
@@ -2,13 +2,23 @@ package aws
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/taskcluster/httpbackoff/v3"
 )
 
 var EC2MetadataBaseURL = "http://169.254.169.254/latest"
 
+// The lifetime requested for IMDSv2 session tokens.  Tokens are refreshed a
+// little before they expire.
+const imdsTokenTTL = 6 * time.Hour
+
 type UserData struct {
 	WorkerPoolId         string           `json:"workerPoolId"`
 	ProviderId           string           `json:"providerId"`
@@ -37,7 +47,20 @@ type MetadataService interface {
 	queryMetadata(path string) (string, error)
 }
 
-type realMetadataService struct{}
+// realMetadataService queries the EC2 metadata service using IMDSv2 session
+// tokens; see
+// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/configuring-instance-metadata-service.html
+type realMetadataService struct {
+	// if true, fall back to IMDSv1 (requests without a session token) when a
+	// token cannot be obtained
+	allowIMDSv1 bool
+
+	// protects the token fields, as the metadata service is queried from
+	// the termination-polling goroutine
+	tokenMux     sync.Mutex
+	token        string
+	tokenExpires time.Time
+}
 
 func (mds *realMetadataService) queryUserData() (*UserData, error) {
 	// http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/ec2-instance-metadata.html#instancedata-user-data-retrieval
@@ -50,10 +73,59 @@ func (mds *realMetadataService) queryUserData() (*UserData, error) {
 	return userData, err
 }
 
-func (mds *realMetadataService) queryMetadata(path string) (string, error) {
-	// http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/ec2-instance-metadata.html#instancedata-data-retrieval
-	// call http://169.254.169.254/latest/meta-data/instance-id with httpbackoff
-	resp, _, err := httpbackoff.Get(EC2MetadataBaseURL + path)
+// Get an IMDSv2 session token, fetching a new one if there is no current token
+// or it is about to expire.
+func (mds *realMetadataService) getToken() (string, error) {
+	mds.tokenMux.Lock()
+	defer mds.tokenMux.Unlock()
+
+	if mds.token != "" && time.Now().Add(time.Minute).Before(mds.tokenExpires) {
+		return mds.token, nil
+	}
+
+	client := http.Client{}
+	req, err := http.NewRequest("PUT", EC2MetadataBaseURL+"/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(imdsTokenTTL/time.Second)))
+
+	resp, _, err := httpbackoff.ClientDo(&client, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	mds.token = string(content)
+	mds.tokenExpires = time.Now().Add(imdsTokenTTL)
+	return mds.token, nil
+}
+
+// Forget the current session token, so that the next call to getToken fetches
+// a new one.
+func (mds *realMetadataService) invalidateToken() {
+	mds.tokenMux.Lock()
+	defer mds.tokenMux.Unlock()
+	mds.token = ""
+}
+
+// Fetch the given path, including the session token if it is not empty.
+func (mds *realMetadataService) fetch(path string, token string) (string, error) {
+	client := http.Client{}
+	req, err := http.NewRequest("GET", EC2MetadataBaseURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+
+	resp, _, err := httpbackoff.ClientDo(&client, req)
 	if err != nil {
 		return "", err
 	}
@@ -62,6 +134,35 @@ func (mds *realMetadataService) queryMetadata(path string) (string, error) {
 	return string(content), err
 }
 
+func (mds *realMetadataService) queryMetadata(path string) (string, error) {
+	// http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/ec2-instance-metadata.html#instancedata-data-retrieval
+	// call http://169.254.169.254/latest/meta-data/instance-id with httpbackoff
+	token, err := mds.getToken()
+	if err != nil {
+		if !mds.allowIMDSv1 {
+			return "", fmt.Errorf("Could not get IMDSv2 session token: %v", err)
+		}
+		log.Printf("Could not get IMDSv2 session token; falling back to IMDSv1: %v", err)
+		token = ""
+	}
+
+	content, err := mds.fetch(path, token)
+
+	// a 401 indicates the token is no longer valid (for example, it was
+	// issued before the instance was stopped and started), so get a new
+	// one and try again
+	if httperr, ok := err.(httpbackoff.BadHttpResponseCode); ok && httperr.HttpResponseCode == 401 && token != "" {
+		mds.invalidateToken()
+		token, err = mds.getToken()
+		if err != nil {
+			return "", fmt.Errorf("Could not get IMDSv2 session token: %v", err)
+		}
+		content, err = mds.fetch(path, token)
+	}
+
+	return content, err
+}
+
 func (mds *realMetadataService) queryInstanceIdentityDocument() (string, *InstanceIdentityDocument, error) {
 	// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instance-identity-documents.html
 	identityDocumentString, err := mds.queryMetadata("/dynamic/instance-identity/document")
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/taskcluster/httpbackoff/v3"
@@ -48,22 +50,105 @@ func (mds *fakeMetadataService) queryInstanceIdentityDocument() (string, *Instan
 	return mds.InstanceIdentityDocument, res, nil
 }
 
-func TestQueryMetadata(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/latest/meta-data/some-data" {
-			w.WriteHeader(200)
-			fmt.Fprintln(w, "42")
-		} else {
+// fakeIMDS is a fake EC2 metadata service.  It serves the values in Metadata
+// (keyed by the path following `/latest`), and requires an IMDSv2 session
+// token unless AllowV1 is set.  If DisableV2 is set, token requests fail as
+// they would on an older metadata service.
+type fakeIMDS struct {
+	Metadata  map[string]string
+	AllowV1   bool
+	DisableV2 bool
+
+	mux           sync.Mutex
+	tokens        map[string]bool
+	tokenRequests int
+}
+
+func (imds *fakeIMDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	imds.mux.Lock()
+	defer imds.mux.Unlock()
+
+	if r.URL.Path == "/latest/api/token" {
+		if imds.DisableV2 {
 			w.WriteHeader(404)
 			fmt.Fprintln(w, "Not Found")
+			return
+		}
+		if r.Method != "PUT" {
+			w.WriteHeader(405)
+			fmt.Fprintln(w, "Method Not Allowed")
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, "Missing TTL")
+			return
+		}
+		imds.tokenRequests++
+		token := fmt.Sprintf("token-%d", imds.tokenRequests)
+		if imds.tokens == nil {
+			imds.tokens = make(map[string]bool)
+		}
+		imds.tokens[token] = true
+		w.WriteHeader(200)
+		fmt.Fprint(w, token)
+		return
+	}
+
+	token := r.Header.Get("X-aws-ec2-metadata-token")
+	if token == "" && !imds.AllowV1 {
+		w.WriteHeader(401)
+		fmt.Fprintln(w, "Unauthorized")
+		return
+	}
+	if token != "" && !imds.tokens[token] {
+		w.WriteHeader(401)
+		fmt.Fprintln(w, "Unauthorized")
+		return
+	}
+
+	if len(r.URL.Path) > len("/latest") {
+		if value, ok := imds.Metadata[r.URL.Path[len("/latest"):]]; ok {
+			w.WriteHeader(200)
+			fmt.Fprint(w, value)
+			return
 		}
-	}))
-	defer ts.Close()
+	}
+	w.WriteHeader(404)
+	fmt.Fprintf(w, "Not Found: %s", r.URL.Path)
+}
+
+// Revoke all existing tokens, as happens when an instance is stopped and started
+func (imds *fakeIMDS) revokeTokens() {
+	imds.mux.Lock()
+	defer imds.mux.Unlock()
+	imds.tokens = nil
+}
 
+func (imds *fakeIMDS) getTokenRequests() int {
+	imds.mux.Lock()
+	defer imds.mux.Unlock()
+	return imds.tokenRequests
+}
+
+// Start a server for this fake and point EC2MetadataBaseURL at it; the returned
+// function shuts it down again.
+func (imds *fakeIMDS) start() func() {
+	ts := httptest.NewServer(imds)
 	EC2MetadataBaseURL = ts.URL + "/latest"
-	defer func() {
+	return func() {
+		ts.Close()
 		EC2MetadataBaseURL = "http://169.254.169.254/latest"
-	}()
+	}
+}
+
+func TestQueryMetadata(t *testing.T) {
+	imds := &fakeIMDS{
+		Metadata: map[string]string{
+			"/meta-data/some-data": "42\n",
+		},
+	}
+	defer imds.start()()
 
 	ms := realMetadataService{}
 
@@ -79,22 +164,93 @@ func TestQueryMetadata(t *testing.T) {
 	}
 }
 
-func TestQueryUserData(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/latest/user-data" {
-			w.WriteHeader(200)
-			fmt.Fprintln(w, `{"rootUrl": "taskcluster-dev.net", "workerPoolId": "banana"}`)
-		} else {
-			w.WriteHeader(404)
-			fmt.Fprintf(w, "Not Found: %s", r.URL.Path)
-		}
-	}))
-	defer ts.Close()
+func TestQueryMetadataReusesToken(t *testing.T) {
+	imds := &fakeIMDS{
+		Metadata: map[string]string{
+			"/meta-data/some-data": "42",
+		},
+	}
+	defer imds.start()()
 
-	EC2MetadataBaseURL = ts.URL + "/latest"
-	defer func() {
-		EC2MetadataBaseURL = "http://169.254.169.254/latest"
-	}()
+	ms := realMetadataService{}
+
+	for i := 0; i < 3; i++ {
+		rv, err := ms.queryMetadata("/meta-data/some-data")
+		require.NoError(t, err)
+		require.Equal(t, "42", rv)
+	}
+	require.Equal(t, 1, imds.getTokenRequests())
+}
+
+func TestQueryMetadataRefreshesExpiredToken(t *testing.T) {
+	imds := &fakeIMDS{
+		Metadata: map[string]string{
+			"/meta-data/some-data": "42",
+		},
+	}
+	defer imds.start()()
+
+	ms := realMetadataService{}
+
+	_, err := ms.queryMetadata("/meta-data/some-data")
+	require.NoError(t, err)
+
+	// pretend the token is about to expire
+	ms.tokenExpires = time.Now().Add(10 * time.Second)
+
+	_, err = ms.queryMetadata("/meta-data/some-data")
+	require.NoError(t, err)
+	require.Equal(t, 2, imds.getTokenRequests())
+}
+
+func TestQueryMetadataRevokedToken(t *testing.T) {
+	imds := &fakeIMDS{
+		Metadata: map[string]string{
+			"/meta-data/some-data": "42",
+		},
+	}
+	defer imds.start()()
+
+	ms := realMetadataService{}
+
+	_, err := ms.queryMetadata("/meta-data/some-data")
+	require.NoError(t, err)
+
+	imds.revokeTokens()
+
+	rv, err := ms.queryMetadata("/meta-data/some-data")
+	require.NoError(t, err)
+	require.Equal(t, "42", rv)
+	require.Equal(t, 2, imds.getTokenRequests())
+}
+
+func TestQueryMetadataNoIMDSv2(t *testing.T) {
+	imds := &fakeIMDS{
+		Metadata: map[string]string{
+			"/meta-data/some-data": "42",
+		},
+		AllowV1:   true,
+		DisableV2: true,
+	}
+	defer imds.start()()
+
+	ms := realMetadataService{}
+	_, err := ms.queryMetadata("/meta-data/some-data")
+	require.Error(t, err)
+
+	ms = realMetadataService{allowIMDSv1: true}
+	rv, err := ms.queryMetadata("/meta-data/some-data")
+	require.NoError(t, err)
+	require.Equal(t, "42", rv)
+}
+
+func TestQueryUserData(t *testing.T) {
+	imds := &fakeIMDS{
+		Metadata: map[string]string{
+			"/user-data": `{"rootUrl": "taskcluster-dev.net", "workerPoolId": "banana"}`,
+		},
+	}
+	defer imds.start()()
 
 	ms := realMetadataService{}
 
@@ -105,21 +261,12 @@ func TestQueryUserData(t *testing.T) {
 }
 
 func TestQueryInstanceIdentityDocument(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/latest/dynamic/instance-identity/document" {
-			w.WriteHeader(200)
-			fmt.Fprintf(w, "{\n  \"instanceId\" : \"i-55555nonesense5\",\n  \"region\" : \"us-west-2\",\n  \"availabilityZone\" : \"us-west-2a\",\n  \"instanceType\" : \"t2.micro\",\n  \"imageId\" : \"banana\"\n,  \"privateIp\" : \"1.1.1.1\"\n}")
-		} else {
-			w.WriteHeader(404)
-			fmt.Fprintln(w, "Not Found")
-		}
-	}))
-	defer ts.Close()
-
-	EC2MetadataBaseURL = ts.URL + "/latest"
-	defer func() {
-		EC2MetadataBaseURL = "http://169.254.169.254/latest"
-	}()
+	imds := &fakeIMDS{
+		Metadata: map[string]string{
+			"/dynamic/instance-identity/document": "{\n  \"instanceId\" : \"i-55555nonesense5\",\n  \"region\" : \"us-west-2\",\n  \"availabilityZone\" : \"us-west-2a\",\n  \"instanceType\" : \"t2.micro\",\n  \"imageId\" : \"banana\"\n,  \"privateIp\" : \"1.1.1.1\"\n}",
+		},
+	}
+	defer imds.start()()
 
 	ms := realMetadataService{}
 
@@ -4,9 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/metrics"
 	"github.com/taskcluster/taskcluster-worker-runner/protocol"
 	"github.com/taskcluster/taskcluster-worker-runner/provider/provider"
 	"github.com/taskcluster/taskcluster-worker-runner/run"
@@ -21,8 +25,26 @@ type AzureProvider struct {
 	metadataService            MetadataService
 	proto                      *protocol.Protocol
 	terminationTicker          *time.Ticker
+
+	// the name of this VM, as used in scheduled events' Resources
+	vmName string
+
+	// protects the event-tracking fields below, which are updated from the
+	// termination-polling goroutine
+	eventsMux sync.Mutex
+	// events for which the worker has been sent a graceful-termination message
+	notifiedEvents map[string]bool
+	// events to acknowledge once the worker has exited
+	pendingEvents map[string]bool
+
+	// the state for this run, used to remove the worker when it finishes
+	state *run.State
 }
 
+// If a scheduled event will not start for at least this long, the worker is
+// allowed to finish its running tasks.
+const finishTasksNotice = 10 * time.Minute
+
 type CustomData struct {
 	WorkerPoolId         string           `json:"workerPoolId"`
 	ProviderId           string           `json:"providerId"`
@@ -32,6 +54,8 @@ type CustomData struct {
 }
 
 func (p *AzureProvider) ConfigureRun(state *run.State) error {
+	p.state = state
+
 	instanceData, err := p.metadataService.queryInstanceData()
 	if err != nil {
 		return fmt.Errorf("Could not query instance data: %v", err)
@@ -53,6 +77,8 @@ func (p *AzureProvider) ConfigureRun(state *run.State) error {
 		return fmt.Errorf("Could not parse customData as JSON: %v", err)
 	}
 
+	p.vmName = instanceData.Compute.Name
+
 	state.RootURL = customData.RootURL
 	state.WorkerLocation = map[string]string{
 		"cloud":  "azure",
@@ -109,6 +135,15 @@ func (p *AzureProvider) ConfigureRun(state *run.State) error {
 }
 
 func (p *AzureProvider) UseCachedRun(run *run.State) error {
+	p.state = run
+
+	// recover the VM name, used to filter scheduled events
+	instanceData, err := p.metadataService.queryInstanceData()
+	if err != nil {
+		log.Printf("Could not query instance data; all scheduled events will be considered: %v", err)
+		return nil
+	}
+	p.vmName = instanceData.Compute.Name
 	return nil
 }
 
@@ -116,6 +151,39 @@ func (p *AzureProvider) SetProtocol(proto *protocol.Protocol) {
 	p.proto = proto
 }
 
+// Determine whether the given event applies to this VM.  If the VM name is not
+// known, all events are assumed to apply.
+func (p *AzureProvider) eventTargetsThisVM(evt *ScheduledEvent) bool {
+	if p.vmName == "" {
+		return true
+	}
+	for _, r := range evt.Resources {
+		if r == p.vmName {
+			return true
+		}
+	}
+	return false
+}
+
+// Determine whether the worker can finish its tasks before the given event
+// begins.
+func eventAllowsFinishingTasks(evt *ScheduledEvent) bool {
+	switch evt.EventType {
+	case "Preempt":
+		// spot VMs are evicted after a minimum of 30 seconds
+		return false
+	case "Terminate", "Reboot", "Redeploy":
+		// NotBefore is empty once the event has started
+		notBefore, err := time.Parse(http.TimeFormat, evt.NotBefore)
+		if err != nil {
+			return false
+		}
+		return time.Until(notBefore) >= finishTasksNotice
+	default:
+		return false
+	}
+}
+
 func (p *AzureProvider) checkTerminationTime() bool {
 	evts, err := p.metadataService.queryScheduledEvents()
 	if err != nil {
@@ -123,16 +191,43 @@ func (p *AzureProvider) checkTerminationTime() bool {
 		return false
 	}
 
-	// if there are any events, let's consider that a signal we should go away
-	if evts != nil && len(evts.Events) != 0 {
-		log.Println("Azure Metadata Service says a maintenance event is imminent")
+	if evts == nil {
+		return false
+	}
+
+	p.eventsMux.Lock()
+	defer p.eventsMux.Unlock()
+
+	terminating := false
+	for i := range evts.Events {
+		evt := &evts.Events[i]
+
+		if !p.eventTargetsThisVM(evt) {
+			continue
+		}
+
+		// Freeze events pause the VM for a few seconds, and the worker
+		// can ride that out
+		if evt.EventType == "Freeze" {
+			continue
+		}
+
+		terminating = true
+		p.pendingEvents[evt.EventId] = true
+
+		if p.notifiedEvents[evt.EventId] {
+			continue
+		}
+
+		log.Printf("Azure Metadata Service says a %s event is scheduled for %s", evt.EventType, evt.NotBefore)
+		metrics.TerminationNotice("azure", evt.EventType, evt.EventId)
 		if p.proto != nil && p.proto.Capable("graceful-termination") {
 			p.proto.Send(protocol.Message{
 				Type: "graceful-termination",
 				Properties: map[string]interface{}{
-					// termination generally doesn't leave time to finish
-					// tasks. We prefer to have the worker exit cleanly
-					// immediately, resolving tasks as
+					// Unless the event is far enough in the future, there is
+					// not time to finish tasks. We prefer to have the worker
+					// exit cleanly immediately, resolving tasks as
 					// exception/worker-shutdown, than to allow Azure to
 					// terminate the worker mid-tasks, which leaves the task
 					// still "running" on the queue until the claim expires, at
@@ -140,15 +235,39 @@ func (p *AzureProvider) checkTerminationTime() bool {
 					// Either one results in a retry, but the first option is
 					// faster and gives the user more context as to what
 					// happened.
-					"finish-tasks": false,
+					"finish-tasks": eventAllowsFinishingTasks(evt),
 				},
 			})
+			p.notifiedEvents[evt.EventId] = true
 		}
+	}
 
-		return true
+	return terminating
+}
+
+// Acknowledge any scheduled events that were waiting for the worker, so that
+// Azure can proceed with them without waiting for NotBefore.
+func (p *AzureProvider) acknowledgeEvents() error {
+	p.eventsMux.Lock()
+	defer p.eventsMux.Unlock()
+
+	if len(p.pendingEvents) == 0 {
+		return nil
 	}
 
-	return false
+	eventIds := make([]string, 0, len(p.pendingEvents))
+	for id := range p.pendingEvents {
+		eventIds = append(eventIds, id)
+	}
+	sort.Strings(eventIds)
+
+	log.Printf("Acknowledging scheduled events %v", eventIds)
+	err := p.metadataService.acknowledgeScheduledEvents(eventIds)
+	if err != nil {
+		return fmt.Errorf("Could not acknowledge scheduled events: %v", err)
+	}
+	p.pendingEvents = make(map[string]bool)
+	return nil
 }
 
 func (p *AzureProvider) WorkerStarted() error {
@@ -169,8 +288,19 @@ func (p *AzureProvider) WorkerStarted() error {
 }
 
 func (p *AzureProvider) WorkerFinished() error {
-	p.terminationTicker.Stop()
-	return nil
+	if p.terminationTicker != nil {
+		p.terminationTicker.Stop()
+	}
+
+	// the worker has exited, so any scheduled events can start now; failing
+	// to acknowledge them only delays them, so it should not prevent removing
+	// the worker
+	err := p.acknowledgeEvents()
+	if err != nil {
+		log.Printf("Error acknowledging scheduled events: %v", err)
+	}
+
+	return provider.RemoveWorker(p.runnercfg, p.state, p.workerManagerClientFactory)
 }
 
 func clientFactory(rootURL string, credentials *tcclient.Credentials) (tc.WorkerManager, error) {
@@ -197,6 +327,13 @@ defined by this provider has the following fields:
 
 * cloud: azure
 * region
+
+While the worker is running, this provider polls for scheduled events
+affecting this VM.  Preempt, Terminate, Reboot, and Redeploy events result in
+a graceful-termination message, with ` + "`finish-tasks: true`" + ` only if
+the event will not begin for at least 10 minutes.  Freeze events are ignored.
+Once the worker has exited, the events are acknowledged so that Azure can
+begin them immediately.
 `
 }
 
@@ -222,5 +359,7 @@ func new(
 		workerManagerClientFactory: workerManagerClientFactory,
 		metadataService:            metadataService,
 		proto:                      nil,
+		notifiedEvents:             make(map[string]bool),
+		pendingEvents:              make(map[string]bool),
 	}, nil
 }
@@ -4,7 +4,9 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/taskcluster/taskcluster-worker-runner/cfg"
@@ -51,6 +53,7 @@ func TestConfigureRun(t *testing.T) {
 	_ = json.Unmarshal([]byte(`{
 		"compute": {
 			"customData": "",
+			"name": "my-vm",
 			"vmId": "df09142e-c0dd-43d9-a515-489f19829dfd",
 			"location": "uswest",
 			"vmSize": "medium"
@@ -69,7 +72,12 @@ func TestConfigureRun(t *testing.T) {
 
 	attestedDocument := base64.StdEncoding.EncodeToString([]byte("trust me, it's cool --Bill"))
 
-	mds := &fakeMetadataService{nil, userData, nil, &ScheduledEvents{}, nil, attestedDocument, nil, []byte(customDataJson)}
+	mds := &fakeMetadataService{
+		InstanceData:     userData,
+		ScheduledEvents:  &ScheduledEvents{},
+		AttestedDocument: attestedDocument,
+		CustomData:       []byte(customDataJson),
+	}
 
 	p, err := new(runnercfg, tc.FakeWorkerManagerClientFactory, mds)
 	require.NoError(t, err, "creating provider")
@@ -109,6 +117,8 @@ func TestConfigureRun(t *testing.T) {
 
 	require.Equal(t, "azure", state.WorkerLocation["cloud"])
 	require.Equal(t, "uswest", state.WorkerLocation["region"])
+
+	require.Equal(t, "my-vm", p.vmName)
 }
 
 func TestCheckTerminationTime(t *testing.T) {
@@ -118,13 +128,15 @@ func TestCheckTerminationTime(t *testing.T) {
 
 	evts := &ScheduledEvents{}
 
-	mds := &fakeMetadataService{nil, nil, nil, evts, nil, "", nil, []byte(`{}`)}
+	mds := &fakeMetadataService{ScheduledEvents: evts, CustomData: []byte(`{}`)}
 	p := &AzureProvider{
 		runnercfg:                  nil,
 		workerManagerClientFactory: nil,
 		metadataService:            mds,
 		proto:                      proto,
 		terminationTicker:          nil,
+		notifiedEvents:             make(map[string]bool),
+		pendingEvents:              make(map[string]bool),
 	}
 
 	p.checkTerminationTime()
@@ -169,3 +181,80 @@ func TestCheckTerminationTime(t *testing.T) {
 		},
 	}, transp.Messages())
 }
+
+func TestScheduledEventTypes(t *testing.T) {
+	transp := protocol.NewFakeTransport()
+	proto := protocol.NewProtocol(transp)
+	proto.Capabilities.Add("graceful-termination")
+	proto.SetInitialized()
+
+	evts := &ScheduledEvents{}
+	mds := &fakeMetadataService{ScheduledEvents: evts}
+	p, err := new(&cfg.RunnerConfig{}, tc.FakeWorkerManagerClientFactory, mds)
+	require.NoError(t, err)
+	p.SetProtocol(proto)
+	p.vmName = "my-vm"
+
+	soon := time.Now().Add(5 * time.Minute).UTC().Format(http.TimeFormat)
+	later := time.Now().Add(20 * time.Minute).UTC().Format(http.TimeFormat)
+
+	evts.Events = []ScheduledEvent{
+		// not for this VM
+		{EventId: "other", EventType: "Preempt", Resources: []string{"other-vm"}},
+		// freeze is ignored
+		{EventId: "freeze", EventType: "Freeze", Resources: []string{"my-vm"}, NotBefore: soon},
+	}
+	require.False(t, p.checkTerminationTime())
+	require.Equal(t, []protocol.Message{}, transp.Messages())
+
+	finishTasks := func(finish bool) protocol.Message {
+		return protocol.Message{
+			Type: "graceful-termination",
+			Properties: map[string]interface{}{
+				"finish-tasks": finish,
+			},
+		}
+	}
+
+	// a reboot far in the future allows finishing tasks
+	evts.Events = append(evts.Events, ScheduledEvent{
+		EventId: "reboot", EventType: "Reboot", Resources: []string{"my-vm"}, NotBefore: later})
+	require.True(t, p.checkTerminationTime())
+	require.Equal(t, []protocol.Message{finishTasks(true)}, transp.Messages())
+
+	// the same event is only notified once
+	require.True(t, p.checkTerminationTime())
+	require.Equal(t, []protocol.Message{finishTasks(true)}, transp.Messages())
+
+	// a redeploy soon does not allow finishing tasks
+	evts.Events = append(evts.Events, ScheduledEvent{
+		EventId: "redeploy", EventType: "Redeploy", Resources: []string{"my-vm"}, NotBefore: soon})
+	require.True(t, p.checkTerminationTime())
+	require.Equal(t, []protocol.Message{finishTasks(true), finishTasks(false)}, transp.Messages())
+
+	// nor does a preemption, even if it's a ways off
+	evts.Events = append(evts.Events, ScheduledEvent{
+		EventId: "preempt", EventType: "Preempt", Resources: []string{"my-vm"}, NotBefore: later})
+	require.True(t, p.checkTerminationTime())
+	require.Equal(t, []protocol.Message{finishTasks(true), finishTasks(false), finishTasks(false)}, transp.Messages())
+
+	// when the worker finishes, the events for this VM are acknowledged
+	require.NoError(t, p.WorkerFinished())
+	require.Equal(t, []string{"preempt", "reboot", "redeploy"}, mds.AcknowledgedEvents)
+
+	// and not acknowledged twice
+	require.NoError(t, p.WorkerFinished())
+	require.Equal(t, []string{"preempt", "reboot", "redeploy"}, mds.AcknowledgedEvents)
+}
+
+func TestUseCachedRunRecoversVMName(t *testing.T) {
+	instanceData := &InstanceData{}
+	instanceData.Compute.Name = "my-vm"
+	mds := &fakeMetadataService{InstanceData: instanceData}
+
+	p, err := new(&cfg.RunnerConfig{}, tc.FakeWorkerManagerClientFactory, mds)
+	require.NoError(t, err)
+
+	require.NoError(t, p.UseCachedRun(&run.State{}))
+	require.Equal(t, "my-vm", p.vmName)
+}
@@ -3,8 +3,10 @@
 package azure
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -19,6 +21,7 @@ var MetadataBaseURL = "http://169.254.169.254"
 type InstanceData struct {
 	Compute struct {
 		Location string `json:"location"`
+		Name     string `json:"name"`
 		VMID     string `json:"vmId"`
 		VMSize   string `json:"vmSize"`
 	} `json:"compute"`
@@ -36,14 +39,18 @@ type InstanceData struct {
 
 // Data from the /scheduledevents endpoint
 type ScheduledEvents struct {
-	Events []struct {
-		EventId      string
-		EventType    string
-		ResourceType string
-		Resources    []string
-		EventStatus  string
-		NotBefore    string
-	}
+	Events []ScheduledEvent
+}
+
+// A single scheduled event; see
+// https://docs.microsoft.com/en-us/azure/virtual-machines/linux/scheduled-events#event-properties
+type ScheduledEvent struct {
+	EventId      string
+	EventType    string
+	ResourceType string
+	Resources    []string
+	EventStatus  string
+	NotBefore    string
 }
 
 // Data from the /attested/document endpoint.
@@ -59,6 +66,8 @@ type MetadataService interface {
 	queryAttestedDocument() (string, error)
 	// Get the content of the scheduled events
 	queryScheduledEvents() (*ScheduledEvents, error)
+	// Acknowledge the given scheduled events, allowing them to start early
+	acknowledgeScheduledEvents(eventIds []string) error
 	// Load customData from the disk where windows azure agent stuck it
 	// This is explained by https://azure.microsoft.com/en-us/blog/custom-data-and-cloud-init-on-windows-azure/
 	// Technically they claim to also provide customData in the metadata service like the other clouds do
@@ -70,6 +79,10 @@ type MetadataService interface {
 type realMetadataService struct{}
 
 func (mds *realMetadataService) fetch(path string, apiVersion string) (string, error) {
+	return mds.request("GET", path, apiVersion, nil)
+}
+
+func (mds *realMetadataService) request(method string, path string, apiVersion string, body []byte) (string, error) {
 	client := http.Client{}
 	u, _ := url.Parse(MetadataBaseURL)
 	u = &url.URL{
@@ -78,12 +91,19 @@ func (mds *realMetadataService) fetch(path string, apiVersion string) (string, e
 		Path:     path,
 		RawQuery: "api-version=" + apiVersion,
 	}
-	req, err := http.NewRequest("GET", u.String(), nil)
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), reqBody)
 	if err != nil {
 		return "", err
 	}
 
 	req.Header.Set("Metadata", "true")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
 	resp, _, err := httpbackoff.ClientDo(&client, req)
 	if err != nil {
@@ -130,3 +150,23 @@ func (mds *realMetadataService) queryScheduledEvents() (*ScheduledEvents, error)
 	err = json.Unmarshal([]byte(content), evts)
 	return evts, err
 }
+
+func (mds *realMetadataService) acknowledgeScheduledEvents(eventIds []string) error {
+	// https://docs.microsoft.com/en-us/azure/virtual-machines/linux/scheduled-events#start-an-event
+	type startRequest struct {
+		EventId string
+	}
+	var body struct {
+		StartRequests []startRequest
+	}
+	for _, id := range eventIds {
+		body.StartRequests = append(body.StartRequests, startRequest{id})
+	}
+	encoded, err := json.Marshal(&body)
+	if err != nil {
+		return err
+	}
+
+	_, err = mds.request("POST", "/metadata/scheduledevents", "2017-11-01", encoded)
+	return err
+}
@@ -2,6 +2,7 @@ package azure
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -18,6 +19,7 @@ type fakeMetadataService struct {
 	AttestedDocument      string
 	LoadCustomDataError   error
 	CustomData            []byte
+	AcknowledgedEvents    []string
 }
 
 func (mds *fakeMetadataService) queryInstanceData() (*InstanceData, error) {
@@ -34,6 +36,11 @@ func (mds *fakeMetadataService) queryScheduledEvents() (*ScheduledEvents, error)
 	return mds.ScheduledEvents, nil
 }
 
+func (mds *fakeMetadataService) acknowledgeScheduledEvents(eventIds []string) error {
+	mds.AcknowledgedEvents = append(mds.AcknowledgedEvents, eventIds...)
+	return nil
+}
+
 func (mds *fakeMetadataService) queryAttestedDocument() (string, error) {
 	if mds.AttestedDocumentError != nil {
 		return "", mds.AttestedDocumentError
@@ -92,6 +99,16 @@ func testServer() *httptest.Server {
 				fmt.Fprintf(w, "Bad API version")
 				return
 			}
+			if r.Method == "POST" {
+				body, _ := ioutil.ReadAll(r.Body)
+				if string(body) != `{"StartRequests":[{"EventId":"77213DA4-3EBD-4C87-970D-949767E6DB59"}]}` {
+					w.WriteHeader(400)
+					fmt.Fprintf(w, "Bad start request: %s", body)
+					return
+				}
+				w.WriteHeader(200)
+				return
+			}
 			w.WriteHeader(200)
 			fmt.Fprintln(w, `{
 			  "DocumentIncarnation": 1,
@@ -186,3 +203,21 @@ func TestQueryScheduledEvents(t *testing.T) {
 	require.Equal(t, []string{"dustin-dw-testing"}, evts.Events[0].Resources)
 	require.Equal(t, "Thu, 05 Dec 2019 00:31:50 GMT", evts.Events[0].NotBefore)
 }
+
+func TestAcknowledgeScheduledEvents(t *testing.T) {
+	ts := testServer()
+	defer ts.Close()
+
+	MetadataBaseURL = ts.URL
+	defer func() {
+		MetadataBaseURL = "http://169.254.169.254"
+	}()
+
+	ms := realMetadataService{}
+
+	err := ms.acknowledgeScheduledEvents([]string{"77213DA4-3EBD-4C87-970D-949767E6DB59"})
+	require.NoError(t, err)
+
+	err = ms.acknowledgeScheduledEvents([]string{"some-other-event"})
+	require.Error(t, err)
+}
@@ -1,10 +1,15 @@
 package google
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/metrics"
 	"github.com/taskcluster/taskcluster-worker-runner/protocol"
 	"github.com/taskcluster/taskcluster-worker-runner/provider/provider"
 	"github.com/taskcluster/taskcluster-worker-runner/run"
@@ -18,9 +23,22 @@ type GoogleProvider struct {
 	workerManagerClientFactory tc.WorkerManagerClientFactory
 	metadataService            MetadataService
 	proto                      *protocol.Protocol
+
+	// cancels the metadata watchers started in WorkerStarted, and tracks
+	// their completion
+	stopWatching context.CancelFunc
+	watchers     sync.WaitGroup
+
+	// the state for this run, used to remove the worker when it finishes
+	state *run.State
 }
 
+// time to wait before retrying a failed wait-for-change request
+const watchRetryDelay = 10 * time.Second
+
 func (p *GoogleProvider) ConfigureRun(state *run.State) error {
+	p.state = state
+
 	workerID, err := p.metadataService.queryMetadata("/instance/id")
 	if err != nil {
 		return fmt.Errorf("Could not query metadata: %v", err)
@@ -103,6 +121,7 @@ func (p *GoogleProvider) ConfigureRun(state *run.State) error {
 }
 
 func (p *GoogleProvider) UseCachedRun(run *run.State) error {
+	p.state = run
 	return nil
 }
 
@@ -110,12 +129,95 @@ func (p *GoogleProvider) SetProtocol(proto *protocol.Protocol) {
 	p.proto = proto
 }
 
+func (p *GoogleProvider) sendGracefulTermination(finishTasks bool) {
+	if p.proto != nil && p.proto.Capable("graceful-termination") {
+		p.proto.Send(protocol.Message{
+			Type: "graceful-termination",
+			Properties: map[string]interface{}{
+				"finish-tasks": finishTasks,
+			},
+		})
+	}
+}
+
+func (p *GoogleProvider) handlePreempted(value string) {
+	if value == "TRUE" {
+		log.Println("GCE Metadata Service says this instance has been preempted")
+		metrics.TerminationNotice("google", "preempted", "preempted")
+		// preemption leaves only 30 seconds, so there is no time to finish tasks
+		p.sendGracefulTermination(false)
+	}
+}
+
+func (p *GoogleProvider) handleMaintenanceEvent(value string) {
+	switch value {
+	case "TERMINATE_ON_HOST_MAINTENANCE":
+		log.Println("GCE Metadata Service says this instance will be terminated for host maintenance")
+		metrics.TerminationNotice("google", "host-maintenance", value)
+		p.sendGracefulTermination(false)
+	case "MIGRATE_ON_HOST_MAINTENANCE":
+		// live migration does not interrupt the worker
+		log.Println("GCE Metadata Service says this instance will be live-migrated for host maintenance")
+	}
+}
+
+// Watch the given metadata path, calling handle with its initial value and
+// each time it changes, until the context is cancelled.
+func (p *GoogleProvider) watchMetadata(ctx context.Context, path string, handle func(value string)) {
+	defer p.watchers.Done()
+
+	etag := ""
+	for {
+		value, newEtag, err := p.metadataService.waitForChange(ctx, path, etag)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("While waiting for change to GCE metadata %s: %v", path, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchRetryDelay):
+			}
+			continue
+		}
+
+		if newEtag == "" {
+			// waiting for a change from an empty etag returns immediately, so
+			// treat this as an error rather than spinning
+			log.Printf("GCE metadata %s has no ETag", path)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchRetryDelay):
+			}
+			continue
+		}
+
+		etag = newEtag
+		handle(strings.TrimSpace(value))
+	}
+}
+
 func (p *GoogleProvider) WorkerStarted() error {
+	// watch for preemption and maintenance events
+	var ctx context.Context
+	ctx, p.stopWatching = context.WithCancel(context.Background())
+
+	p.watchers.Add(2)
+	go p.watchMetadata(ctx, "/instance/preempted", p.handlePreempted)
+	go p.watchMetadata(ctx, "/instance/maintenance-event", p.handleMaintenanceEvent)
+
 	return nil
 }
 
 func (p *GoogleProvider) WorkerFinished() error {
-	return nil
+	if p.stopWatching != nil {
+		p.stopWatching()
+		p.watchers.Wait()
+		p.stopWatching = nil
+	}
+	return provider.RemoveWorker(p.runnercfg, p.state, p.workerManagerClientFactory)
 }
 
 func clientFactory(rootURL string, credentials *tcclient.Credentials) (tc.WorkerManager, error) {
@@ -143,6 +245,11 @@ defined by this provider has the following fields:
 * cloud: google
 * region
 * zone
+
+While the worker is running, this provider watches for preemption and
+host-maintenance events, and sends a graceful-termination message with
+` + "`finish-tasks: false`" + ` when the instance is preempted or about
+to be terminated for maintenance.
 `
 }
 
@@ -3,10 +3,12 @@ package google
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
 	"github.com/taskcluster/taskcluster-worker-runner/run"
 	"github.com/taskcluster/taskcluster-worker-runner/tc"
 )
@@ -54,7 +56,7 @@ func TestGoogleConfigureRun(t *testing.T) {
 		"/instance/network-interfaces/0/access-configs/0/external-ip": "1.2.3.4",
 		"/instance/network-interfaces/0/ip":                           "192.168.0.1",
 	}
-	mds := &fakeMetadataService{nil, userData, metaData}
+	mds := &fakeMetadataService{UserData: userData, Metadata: metaData}
 
 	p, err := new(runnercfg, tc.FakeWorkerManagerClientFactory, mds)
 	require.NoError(t, err, "creating provider")
@@ -102,3 +104,127 @@ func TestGoogleConfigureRun(t *testing.T) {
 	require.Equal(t, "in-central1", state.WorkerLocation["region"])
 	require.Equal(t, "in-central1-b", state.WorkerLocation["zone"])
 }
+
+// wait until the transport has the given number of messages
+func waitForMessages(t *testing.T, transp *protocol.FakeTransport, count int) []protocol.Message {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		msgs := transp.Messages()
+		if len(msgs) >= count {
+			return msgs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.FailNow(t, "timed out waiting for messages")
+	return nil
+}
+
+func TestWatchPreempted(t *testing.T) {
+	transp := protocol.NewFakeTransport()
+	proto := protocol.NewProtocol(transp)
+	proto.Capabilities.Add("graceful-termination")
+	proto.SetInitialized()
+
+	mds := &fakeMetadataService{Metadata: map[string]string{
+		"/instance/preempted":         "FALSE",
+		"/instance/maintenance-event": "NONE",
+	}}
+	p, err := new(&cfg.RunnerConfig{}, tc.FakeWorkerManagerClientFactory, mds)
+	require.NoError(t, err)
+	p.SetProtocol(proto)
+
+	require.NoError(t, p.WorkerStarted())
+
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, []protocol.Message{}, transp.Messages())
+
+	mds.setMetadata("/instance/preempted", "TRUE")
+
+	require.Equal(t, []protocol.Message{
+		protocol.Message{
+			Type: "graceful-termination",
+			Properties: map[string]interface{}{
+				"finish-tasks": false,
+			},
+		},
+	}, waitForMessages(t, transp, 1))
+
+	require.NoError(t, p.WorkerFinished())
+}
+
+func TestWatchMaintenanceEvent(t *testing.T) {
+	transp := protocol.NewFakeTransport()
+	proto := protocol.NewProtocol(transp)
+	proto.Capabilities.Add("graceful-termination")
+	proto.SetInitialized()
+
+	mds := &fakeMetadataService{Metadata: map[string]string{
+		"/instance/preempted":         "FALSE",
+		"/instance/maintenance-event": "NONE",
+	}}
+	p, err := new(&cfg.RunnerConfig{}, tc.FakeWorkerManagerClientFactory, mds)
+	require.NoError(t, err)
+	p.SetProtocol(proto)
+
+	require.NoError(t, p.WorkerStarted())
+
+	// live migration does not stop the worker..
+	mds.setMetadata("/instance/maintenance-event", "MIGRATE_ON_HOST_MAINTENANCE")
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, []protocol.Message{}, transp.Messages())
+
+	// ..but termination does
+	mds.setMetadata("/instance/maintenance-event", "TERMINATE_ON_HOST_MAINTENANCE")
+
+	require.Equal(t, []protocol.Message{
+		protocol.Message{
+			Type: "graceful-termination",
+			Properties: map[string]interface{}{
+				"finish-tasks": false,
+			},
+		},
+	}, waitForMessages(t, transp, 1))
+
+	require.NoError(t, p.WorkerFinished())
+}
+
+func TestWorkerFinishedStopsWatching(t *testing.T) {
+	// missing metadata causes the watchers to wait before retrying;
+	// WorkerFinished should not wait for that delay
+	mds := &fakeMetadataService{Metadata: map[string]string{}}
+	p, err := new(&cfg.RunnerConfig{}, tc.FakeWorkerManagerClientFactory, mds)
+	require.NoError(t, err)
+
+	require.NoError(t, p.WorkerStarted())
+	time.Sleep(10 * time.Millisecond)
+
+	start := time.Now()
+	require.NoError(t, p.WorkerFinished())
+	require.True(t, time.Since(start) < time.Second)
+}
+
+func TestWatchMetadataNoETag(t *testing.T) {
+	transp := protocol.NewFakeTransport()
+	proto := protocol.NewProtocol(transp)
+	proto.Capabilities.Add("graceful-termination")
+	proto.SetInitialized()
+
+	mds := &fakeMetadataService{NoETag: true, Metadata: map[string]string{
+		"/instance/preempted":         "TRUE",
+		"/instance/maintenance-event": "NONE",
+	}}
+	p, err := new(&cfg.RunnerConfig{}, tc.FakeWorkerManagerClientFactory, mds)
+	require.NoError(t, err)
+	p.SetProtocol(proto)
+
+	require.NoError(t, p.WorkerStarted())
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, p.WorkerFinished())
+
+	// each watcher waits before retrying, rather than spinning, and does not
+	// handle a value without an etag
+	mds.mux.Lock()
+	defer mds.mux.Unlock()
+	require.Equal(t, 2, mds.waits)
+	require.Equal(t, []protocol.Message{}, transp.Messages())
+}
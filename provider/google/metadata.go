@@ -3,9 +3,12 @@ package google
 // See https://cloud.google.com/compute/docs/storing-retrieving-metadata
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 
 	"github.com/taskcluster/httpbackoff/v3"
 )
@@ -27,6 +30,12 @@ type MetadataService interface {
 
 	// Query an aribtrary metadata value; path is the portion following `latest`
 	queryMetadata(path string) (string, error)
+
+	// Wait for the metadata value at path to differ from that with the given
+	// etag, returning the new value and its etag.  If etag is empty, this
+	// returns the current value immediately.  This returns early with an
+	// error if the context is cancelled.
+	waitForChange(ctx context.Context, path string, etag string) (string, string, error)
 }
 
 type realMetadataService struct{}
@@ -60,3 +69,40 @@ func (mds *realMetadataService) queryMetadata(path string) (string, error) {
 	content, err := ioutil.ReadAll(resp.Body)
 	return string(content), err
 }
+
+func (mds *realMetadataService) waitForChange(ctx context.Context, path string, etag string) (string, string, error) {
+	// https://cloud.google.com/compute/docs/storing-retrieving-metadata#waitforchange
+	u := metadataBaseURL + path
+	if etag != "" {
+		u += "?wait_for_change=true&last_etag=" + url.QueryEscape(etag)
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	// this is a long-poll, so httpbackoff's retries are not appropriate here;
+	// the caller is expected to retry on error
+	client := http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+
+	if resp.StatusCode != 200 {
+		return "", "", httpbackoff.BadHttpResponseCode{
+			HttpResponseCode: resp.StatusCode,
+			Message:          "HTTP response code " + strconv.Itoa(resp.StatusCode) + "\n" + string(content),
+		}
+	}
+
+	return string(content), resp.Header.Get("ETag"), nil
+}
@@ -1,13 +1,17 @@
 package google
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/taskcluster/httpbackoff/v3"
 )
 
@@ -15,6 +19,15 @@ type fakeMetadataService struct {
 	UserDataError error
 	UserData      *UserData
 	Metadata      map[string]string
+
+	// if true, waitForChange returns an empty etag
+	NoETag bool
+
+	// protects Metadata, which may be changed with setMetadata while
+	// waitForChange is running, and waits
+	mux sync.Mutex
+	// the number of calls to waitForChange
+	waits int
 }
 
 func (mds *fakeMetadataService) queryUserData() (*UserData, error) {
@@ -28,6 +41,8 @@ func (mds *fakeMetadataService) queryMetadata(path string) (string, error) {
 	if path[0] != '/' {
 		panic("path must start with /")
 	}
+	mds.mux.Lock()
+	defer mds.mux.Unlock()
 	res, ok := mds.Metadata[path]
 	if !ok {
 		return "", fmt.Errorf("not found: %s", path)
@@ -35,6 +50,37 @@ func (mds *fakeMetadataService) queryMetadata(path string) (string, error) {
 	return res, nil
 }
 
+func (mds *fakeMetadataService) setMetadata(path, value string) {
+	mds.mux.Lock()
+	defer mds.mux.Unlock()
+	mds.Metadata[path] = value
+}
+
+func (mds *fakeMetadataService) waitForChange(ctx context.Context, path string, etag string) (string, string, error) {
+	mds.mux.Lock()
+	mds.waits++
+	mds.mux.Unlock()
+
+	for {
+		value, err := mds.queryMetadata(path)
+		if err != nil {
+			return "", "", err
+		}
+		// the value serves as its own etag
+		if value != etag {
+			if mds.NoETag {
+				return value, "", nil
+			}
+			return value, value, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", "", ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
 func TestQueryMetadata(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Metadata-Flavor") != "Google" {
@@ -98,3 +144,60 @@ func TestQueryUserData(t *testing.T) {
 		assert.Equal(t, json.RawMessage(`{"from-worker-config": true}`), *ud.ProviderWorkerConfig)
 	}
 }
+
+func TestWaitForChange(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, "Metadata-Flavor Missing")
+		} else if r.URL.Path != "/computeMetadata/v1/instance/preempted" {
+			w.WriteHeader(404)
+			fmt.Fprintln(w, "Not Found")
+		} else if query.Get("wait_for_change") == "" {
+			w.Header().Set("ETag", "etag-1")
+			w.WriteHeader(200)
+			fmt.Fprint(w, "FALSE")
+		} else if query.Get("last_etag") == "etag-1" {
+			w.Header().Set("ETag", "etag-2")
+			w.WriteHeader(200)
+			fmt.Fprint(w, "TRUE")
+		} else {
+			// no further changes, so wait until the client gives up
+			<-r.Context().Done()
+		}
+	}))
+	defer ts.Close()
+
+	metadataBaseURL = ts.URL + "/computeMetadata/v1"
+	defer func() {
+		metadataBaseURL = "http://metadata.google.internal/computeMetadata/v1"
+	}()
+
+	ms := realMetadataService{}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	value, etag, err := ms.waitForChange(ctx, "/instance/preempted", "")
+	require.NoError(t, err)
+	require.Equal(t, "FALSE", value)
+	require.Equal(t, "etag-1", etag)
+
+	value, etag, err = ms.waitForChange(ctx, "/instance/preempted", etag)
+	require.NoError(t, err)
+	require.Equal(t, "TRUE", value)
+	require.Equal(t, "etag-2", etag)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, _, err = ms.waitForChange(ctx, "/instance/preempted", etag)
+	require.Error(t, err)
+
+	_, _, err = ms.waitForChange(context.Background(), "/instance/NOSUCH", "")
+	if assert.Error(t, err) {
+		httperr, ok := err.(httpbackoff.BadHttpResponseCode)
+		assert.True(t, ok)
+		assert.Equal(t, 404, httperr.HttpResponseCode)
+	}
+}
@@ -0,0 +1,282 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	tcurls "github.com/taskcluster/taskcluster-lib-urls"
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/metrics"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+	"github.com/taskcluster/taskcluster-worker-runner/provider/provider"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+	"github.com/taskcluster/taskcluster-worker-runner/tc"
+	tcclient "github.com/taskcluster/taskcluster/clients/client-go/v24"
+	"github.com/taskcluster/taskcluster/clients/client-go/v24/tcworkermanager"
+)
+
+// Default locations of the downward API volume and the projected
+// service-account token
+const defaultPodInfoPath = "/etc/podinfo"
+const defaultTokenPath = "/var/run/secrets/taskcluster/token"
+
+// Kubernetes only exposes the node name to the pod via an environment variable
+const nodeNameEnvVar = "NODE_NAME"
+
+type kubernetesProviderConfig struct {
+	RootURL      string
+	ProviderID   string
+	WorkerPoolID string
+}
+
+type KubernetesProvider struct {
+	runnercfg                  *cfg.RunnerConfig
+	workerManagerClientFactory tc.WorkerManagerClientFactory
+	proto                      *protocol.Protocol
+	podInfoPath                string
+	tokenPath                  string
+
+	// receives SIGTERM while the worker is running; stopSignals is closed
+	// to stop the goroutine handling those signals
+	signals     chan os.Signal
+	stopSignals chan struct{}
+	handler     sync.WaitGroup
+
+	// the state for this run, used to remove the worker when it finishes
+	state *run.State
+}
+
+// Read a file from the downward API volume, returning an empty string if it
+// does not exist.
+func (p *KubernetesProvider) readPodInfo(name string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(p.podInfoPath, name))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func (p *KubernetesProvider) ConfigureRun(state *run.State) error {
+	p.state = state
+
+	var pc kubernetesProviderConfig
+	err := p.runnercfg.Provider.Unpack(&pc)
+	if err != nil {
+		return err
+	}
+
+	podName, err := p.readPodInfo("name")
+	if err != nil {
+		return fmt.Errorf("Could not read pod name: %v", err)
+	}
+	if podName == "" {
+		return fmt.Errorf("Pod name not found in %s", p.podInfoPath)
+	}
+
+	namespace, err := p.readPodInfo("namespace")
+	if err != nil {
+		return fmt.Errorf("Could not read pod namespace: %v", err)
+	}
+	if namespace == "" {
+		return fmt.Errorf("Pod namespace not found in %s", p.podInfoPath)
+	}
+
+	podUID, err := p.readPodInfo("uid")
+	if err != nil {
+		return fmt.Errorf("Could not read pod uid: %v", err)
+	}
+
+	nodeName := os.Getenv(nodeNameEnvVar)
+
+	token, err := ioutil.ReadFile(p.tokenPath)
+	if err != nil {
+		return fmt.Errorf("Could not read service-account token: %v", err)
+	}
+
+	workerGroup := namespace
+	if wg, ok := p.runnercfg.Provider.Data["workerGroup"]; ok {
+		workerGroup, ok = wg.(string)
+		if !ok {
+			return errors.New("provider.workerGroup must be a string")
+		}
+	}
+
+	state.RootURL = tcurls.NormalizeRootURL(pc.RootURL)
+
+	// We need a worker manager client for fetching taskcluster credentials.
+	// Ensure auth is disabled in client, since we don't have credentials yet.
+	wm, err := p.workerManagerClientFactory(state.RootURL, nil)
+	if err != nil {
+		return fmt.Errorf("Could not create worker manager client: %v", err)
+	}
+
+	workerIdentityProofMap := map[string]interface{}{"token": interface{}(strings.TrimSpace(string(token)))}
+
+	err = provider.RegisterWorker(state, wm, pc.WorkerPoolID, pc.ProviderID, workerGroup, podName, workerIdentityProofMap)
+	if err != nil {
+		return err
+	}
+
+	state.WorkerLocation = map[string]string{
+		"cloud":     "kubernetes",
+		"namespace": namespace,
+		"node":      nodeName,
+	}
+
+	state.ProviderMetadata = map[string]interface{}{
+		"pod-name":  podName,
+		"pod-uid":   podUID,
+		"namespace": namespace,
+		"node-name": nodeName,
+	}
+
+	return nil
+}
+
+func (p *KubernetesProvider) UseCachedRun(run *run.State) error {
+	p.state = run
+	return nil
+}
+
+func (p *KubernetesProvider) SetProtocol(proto *protocol.Protocol) {
+	p.proto = proto
+}
+
+func (p *KubernetesProvider) handleSignals() {
+	defer p.handler.Done()
+	for {
+		select {
+		case <-p.signals:
+			// the pod's termination grace period is generally short, so
+			// there is no time to finish tasks
+			log.Println("Received SIGTERM; pod is terminating")
+			metrics.TerminationNotice("kubernetes", "sigterm", "")
+			if p.proto != nil && p.proto.Capable("graceful-termination") {
+				p.proto.Send(protocol.Message{
+					Type: "graceful-termination",
+					Properties: map[string]interface{}{
+						"finish-tasks": false,
+					},
+				})
+			}
+		case <-p.stopSignals:
+			return
+		}
+	}
+}
+
+func (p *KubernetesProvider) WorkerStarted() error {
+	// Kubernetes sends SIGTERM to the pod's processes when the pod is
+	// deleted, waiting for the termination grace period before killing them
+	p.signals = make(chan os.Signal, 1)
+	p.stopSignals = make(chan struct{})
+	signal.Notify(p.signals, syscall.SIGTERM)
+
+	p.handler.Add(1)
+	go p.handleSignals()
+
+	return nil
+}
+
+func (p *KubernetesProvider) WorkerFinished() error {
+	if p.signals != nil {
+		signal.Stop(p.signals)
+		close(p.stopSignals)
+		p.handler.Wait()
+		p.signals = nil
+	}
+	return provider.RemoveWorker(p.runnercfg, p.state, p.workerManagerClientFactory)
+}
+
+func clientFactory(rootURL string, credentials *tcclient.Credentials) (tc.WorkerManager, error) {
+	prov := tcworkermanager.New(credentials, rootURL)
+	return prov, nil
+}
+
+func New(runnercfg *cfg.RunnerConfig) (provider.Provider, error) {
+	return new(runnercfg, nil)
+}
+
+func Usage() string {
+	return `
+The providerType "kubernetes" is intended for workers running in Kubernetes
+pods, registered with worker-manager providers using providerType
+"kubernetes".  It requires
+
+` + "```yaml" + `
+provider:
+    providerType: kubernetes
+    rootURL: ..    # note the Golang spelling with capitalized "URL"
+    providerID: .. # ..and similarly capitalized ID
+    workerPoolID: ...
+    # (optional) worker group (defaults to the pod's namespace)
+    workerGroup: ...
+    # (optional) directory containing the downward API volume (default /etc/podinfo)
+    podInfoPath: /etc/podinfo
+    # (optional) path to the projected service-account token
+    # (default /var/run/secrets/taskcluster/token)
+    tokenPath: /var/run/secrets/taskcluster/token
+` + "```" + `
+
+The downward API volume must contain files "name" and "namespace", from
+"metadata.name" and "metadata.namespace", and may contain "uid" from
+"metadata.uid".  Kubernetes only exposes the node name as an environment
+variable, so the pod should set ` + "`NODE_NAME`" + ` from "spec.nodeName".
+
+The projected service-account token is used as the worker's identity proof,
+and should have an audience that worker-manager accepts.  The worker ID is the
+pod name.
+
+When the pod is deleted, Kubernetes sends SIGTERM; this provider responds by
+sending a graceful-termination message with ` + "`finish-tasks: false`" + `.
+
+The [$TASKCLUSTER_WORKER_LOCATION](https://docs.taskcluster.net/docs/manual/design/env-vars#taskcluster_worker_location)
+defined by this provider has the following fields:
+
+* cloud: kubernetes
+* namespace
+* node
+`
+}
+
+// New takes its dependencies as optional arguments, allowing injection of fake dependencies for testing.
+func new(runnercfg *cfg.RunnerConfig, workerManagerClientFactory tc.WorkerManagerClientFactory) (*KubernetesProvider, error) {
+	if workerManagerClientFactory == nil {
+		workerManagerClientFactory = clientFactory
+	}
+
+	podInfoPath := defaultPodInfoPath
+	if v, ok := runnercfg.Provider.Data["podInfoPath"]; ok {
+		podInfoPath, ok = v.(string)
+		if !ok {
+			return nil, errors.New("provider.podInfoPath must be a string")
+		}
+	}
+
+	tokenPath := defaultTokenPath
+	if v, ok := runnercfg.Provider.Data["tokenPath"]; ok {
+		tokenPath, ok = v.(string)
+		if !ok {
+			return nil, errors.New("provider.tokenPath must be a string")
+		}
+	}
+
+	return &KubernetesProvider{
+		runnercfg:                  runnercfg,
+		workerManagerClientFactory: workerManagerClientFactory,
+		proto:                      nil,
+		podInfoPath:                podInfoPath,
+		tokenPath:                  tokenPath,
+	}, nil
+}
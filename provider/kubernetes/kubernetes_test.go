@@ -0,0 +1,150 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Flaque/filet"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+	"github.com/taskcluster/taskcluster-worker-runner/tc"
+)
+
+// Write fixture files representing the downward API volume and a projected
+// service-account token, returning a runner config that refers to them
+func setupFixtures(t *testing.T, podInfo map[string]string) *cfg.RunnerConfig {
+	dir := filet.TmpDir(t, "")
+	podInfoPath := filepath.Join(dir, "podinfo")
+	require.NoError(t, os.Mkdir(podInfoPath, 0755))
+	for name, content := range podInfo {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(podInfoPath, name), []byte(content), 0644))
+	}
+	tokenPath := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenPath, []byte("eyJhbGciOi.sa-token.sig\n"), 0600))
+
+	return &cfg.RunnerConfig{
+		Provider: cfg.ProviderConfig{
+			ProviderType: "kubernetes",
+			Data: map[string]interface{}{
+				"rootURL":      "https://tc.example.com",
+				"providerID":   "k8s-1",
+				"workerPoolID": "w/p",
+				"podInfoPath":  podInfoPath,
+				"tokenPath":    tokenPath,
+			},
+		},
+		WorkerImplementation: cfg.WorkerImplementationConfig{
+			Implementation: "whatever",
+		},
+	}
+}
+
+func TestConfigureRun(t *testing.T) {
+	defer filet.CleanUp(t)
+	runnercfg := setupFixtures(t, map[string]string{
+		"name":      "worker-abc12",
+		"namespace": "workers",
+		"uid":       "4e1b7d3c-0000-4000-8000-000000000000",
+	})
+
+	os.Setenv(nodeNameEnvVar, "node-7")
+	defer os.Unsetenv(nodeNameEnvVar)
+
+	p, err := new(runnercfg, tc.FakeWorkerManagerClientFactory)
+	require.NoError(t, err, "creating provider")
+
+	state := run.State{}
+	require.NoError(t, p.ConfigureRun(&state))
+
+	reg, err := tc.FakeWorkerManagerRegistration()
+	require.NoError(t, err)
+	require.Equal(t, "k8s-1", reg.ProviderID)
+	require.Equal(t, "workers", reg.WorkerGroup)
+	require.Equal(t, "worker-abc12", reg.WorkerID)
+	require.Equal(t, json.RawMessage(`{"token":"eyJhbGciOi.sa-token.sig"}`), reg.WorkerIdentityProof)
+	require.Equal(t, "w/p", reg.WorkerPoolID)
+
+	require.Equal(t, "https://tc.example.com", state.RootURL, "rootURL is correct")
+	require.Equal(t, "testing", state.Credentials.ClientID, "clientID is correct")
+	require.Equal(t, "workers", state.WorkerGroup, "workerGroup is correct")
+	require.Equal(t, "worker-abc12", state.WorkerID, "workerID is correct")
+
+	require.Equal(t, map[string]string{
+		"cloud":     "kubernetes",
+		"namespace": "workers",
+		"node":      "node-7",
+	}, state.WorkerLocation)
+	require.Equal(t, map[string]interface{}{
+		"pod-name":  "worker-abc12",
+		"pod-uid":   "4e1b7d3c-0000-4000-8000-000000000000",
+		"namespace": "workers",
+		"node-name": "node-7",
+	}, state.ProviderMetadata)
+}
+
+func TestConfigureRunWorkerGroup(t *testing.T) {
+	defer filet.CleanUp(t)
+	runnercfg := setupFixtures(t, map[string]string{
+		"name":      "worker-abc12",
+		"namespace": "workers",
+	})
+	runnercfg.Provider.Data["workerGroup"] = "cluster-1"
+
+	p, err := new(runnercfg, tc.FakeWorkerManagerClientFactory)
+	require.NoError(t, err, "creating provider")
+
+	state := run.State{}
+	require.NoError(t, p.ConfigureRun(&state))
+	require.Equal(t, "cluster-1", state.WorkerGroup)
+}
+
+func TestConfigureRunMissingPodInfo(t *testing.T) {
+	defer filet.CleanUp(t)
+	runnercfg := setupFixtures(t, map[string]string{
+		"namespace": "workers",
+	})
+
+	p, err := new(runnercfg, tc.FakeWorkerManagerClientFactory)
+	require.NoError(t, err, "creating provider")
+
+	state := run.State{}
+	require.Error(t, p.ConfigureRun(&state))
+}
+
+func TestSIGTERM(t *testing.T) {
+	transp := protocol.NewFakeTransport()
+	proto := protocol.NewProtocol(transp)
+	proto.Capabilities.Add("graceful-termination")
+	proto.SetInitialized()
+
+	p, err := new(&cfg.RunnerConfig{}, tc.FakeWorkerManagerClientFactory)
+	require.NoError(t, err)
+	p.SetProtocol(proto)
+
+	require.NoError(t, p.WorkerStarted())
+
+	// deliver the signal as signal.Notify would
+	p.signals <- syscall.SIGTERM
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(transp.Messages()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, []protocol.Message{
+		protocol.Message{
+			Type: "graceful-termination",
+			Properties: map[string]interface{}{
+				"finish-tasks": false,
+			},
+		},
+	}, transp.Messages())
+
+	require.NoError(t, p.WorkerFinished())
+}
@@ -0,0 +1,102 @@
+package openstack
+
+// See https://docs.openstack.org/nova/latest/user/metadata.html
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/taskcluster/httpbackoff/v3"
+)
+
+var metadataBaseURL = "http://169.254.169.254/openstack/latest"
+
+// The path at which the config drive is conventionally mounted
+const defaultConfigDrivePath = "/mnt/config"
+
+// user-data sent to us from the worker-manager service
+type UserData struct {
+	WorkerPoolID         string           `json:"workerPoolId"`
+	ProviderID           string           `json:"providerId"`
+	WorkerGroup          string           `json:"workerGroup"`
+	RootURL              string           `json:"rootUrl"`
+	ProviderWorkerConfig *json.RawMessage `json:"workerConfig"`
+	// a single-use token generated by worker-manager for this instance
+	WorkerIdentityToken string `json:"workerIdentityToken"`
+}
+
+// The subset of meta_data.json used by this provider
+type InstanceMetadata struct {
+	UUID             string `json:"uuid"`
+	Name             string `json:"name"`
+	Hostname         string `json:"hostname"`
+	AvailabilityZone string `json:"availability_zone"`
+	ProjectID        string `json:"project_id"`
+}
+
+type MetadataService interface {
+	// Query the UserData and return the parsed contents
+	queryUserData() (*UserData, error)
+
+	// Query the instance metadata and return the parsed contents
+	queryInstanceMetadata() (*InstanceMetadata, error)
+}
+
+// realMetadataService reads from the config drive, if it is mounted at
+// configDrivePath, and otherwise from the metadata service.  Both present the
+// same files under `openstack/latest`.
+type realMetadataService struct {
+	configDrivePath string
+}
+
+func (mds *realMetadataService) queryUserData() (*UserData, error) {
+	content, err := mds.fetch("user_data")
+	if err != nil {
+		return nil, err
+	}
+	userData := &UserData{}
+	err = json.Unmarshal(content, userData)
+	return userData, err
+}
+
+func (mds *realMetadataService) queryInstanceMetadata() (*InstanceMetadata, error) {
+	content, err := mds.fetch("meta_data.json")
+	if err != nil {
+		return nil, err
+	}
+	metadata := &InstanceMetadata{}
+	err = json.Unmarshal(content, metadata)
+	return metadata, err
+}
+
+// Determine whether the config drive is available; it always contains
+// meta_data.json.
+func (mds *realMetadataService) haveConfigDrive() bool {
+	if mds.configDrivePath == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(mds.configDrivePath, "openstack", "latest", "meta_data.json"))
+	return err == nil
+}
+
+func (mds *realMetadataService) fetch(name string) ([]byte, error) {
+	if mds.haveConfigDrive() {
+		return ioutil.ReadFile(filepath.Join(mds.configDrivePath, "openstack", "latest", name))
+	}
+
+	client := http.Client{}
+	req, err := http.NewRequest("GET", metadataBaseURL+"/"+name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, _, err := httpbackoff.ClientDo(&client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,103 @@
+package openstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeMetadataService struct {
+	UserDataError    error
+	UserData         *UserData
+	InstanceMetadata *InstanceMetadata
+}
+
+func (mds *fakeMetadataService) queryUserData() (*UserData, error) {
+	if mds.UserDataError != nil {
+		return nil, mds.UserDataError
+	}
+	return mds.UserData, nil
+}
+
+func (mds *fakeMetadataService) queryInstanceMetadata() (*InstanceMetadata, error) {
+	return mds.InstanceMetadata, nil
+}
+
+const testUserData = `{"workerPoolId": "w/p", "workerConfig": {"from-worker-config": true}}`
+const testMetaData = `{"uuid": "d8e02d56-2648-49a3-bf97-6be8f1204f38", "name": "worker-1", "availability_zone": "nova"}`
+
+func TestQueryConfigDrive(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	latest := filepath.Join(dir, "openstack", "latest")
+	require.NoError(t, os.MkdirAll(latest, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(latest, "user_data"), []byte(testUserData), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(latest, "meta_data.json"), []byte(testMetaData), 0644))
+
+	// the metadata service should not be consulted at all
+	metadataBaseURL = "http://127.0.0.1:1/openstack/latest"
+	defer func() {
+		metadataBaseURL = "http://169.254.169.254/openstack/latest"
+	}()
+
+	ms := realMetadataService{configDrivePath: dir}
+
+	ud, err := ms.queryUserData()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "w/p", ud.WorkerPoolID)
+		assert.Equal(t, json.RawMessage(`{"from-worker-config": true}`), *ud.ProviderWorkerConfig)
+	}
+
+	md, err := ms.queryInstanceMetadata()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "d8e02d56-2648-49a3-bf97-6be8f1204f38", md.UUID)
+		assert.Equal(t, "worker-1", md.Name)
+		assert.Equal(t, "nova", md.AvailabilityZone)
+	}
+}
+
+func TestQueryMetadataService(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/openstack/latest/user_data":
+			w.WriteHeader(200)
+			fmt.Fprint(w, testUserData)
+		case "/openstack/latest/meta_data.json":
+			w.WriteHeader(200)
+			fmt.Fprint(w, testMetaData)
+		default:
+			w.WriteHeader(404)
+			fmt.Fprintf(w, "Not Found: %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	metadataBaseURL = ts.URL + "/openstack/latest"
+	defer func() {
+		metadataBaseURL = "http://169.254.169.254/openstack/latest"
+	}()
+
+	// a config drive path that does not exist falls back to the service
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	ms := realMetadataService{configDrivePath: filepath.Join(dir, "no-such-drive")}
+
+	ud, err := ms.queryUserData()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "w/p", ud.WorkerPoolID)
+	}
+
+	md, err := ms.queryInstanceMetadata()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "d8e02d56-2648-49a3-bf97-6be8f1204f38", md.UUID)
+	}
+}
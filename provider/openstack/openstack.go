@@ -0,0 +1,192 @@
+package openstack
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+	"github.com/taskcluster/taskcluster-worker-runner/provider/provider"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+	"github.com/taskcluster/taskcluster-worker-runner/tc"
+	tcclient "github.com/taskcluster/taskcluster/clients/client-go/v24"
+	"github.com/taskcluster/taskcluster/clients/client-go/v24/tcworkermanager"
+)
+
+type OpenStackProvider struct {
+	runnercfg                  *cfg.RunnerConfig
+	workerManagerClientFactory tc.WorkerManagerClientFactory
+	metadataService            MetadataService
+	proto                      *protocol.Protocol
+
+	// allow registering with only the instance ID as proof of identity
+	insecureInstanceIDProof bool
+
+	// the state for this run, used to remove the worker when it finishes
+	state *run.State
+}
+
+func (p *OpenStackProvider) ConfigureRun(state *run.State) error {
+	p.state = state
+
+	userData, err := p.metadataService.queryUserData()
+	if err != nil {
+		return fmt.Errorf("Could not query user data: %v", err)
+	}
+
+	metadata, err := p.metadataService.queryInstanceMetadata()
+	if err != nil {
+		return fmt.Errorf("Could not query instance metadata: %v", err)
+	}
+
+	state.RootURL = userData.RootURL
+
+	// the instance UUID is not secret, so it only proves the worker's
+	// identity along with the single-use token from the user data
+	workerIdentityProofMap := map[string]interface{}{
+		"instanceId": interface{}(metadata.UUID),
+	}
+	if userData.WorkerIdentityToken != "" {
+		workerIdentityProofMap["token"] = interface{}(userData.WorkerIdentityToken)
+	} else if p.insecureInstanceIDProof {
+		log.Printf("User data has no workerIdentityToken; registering with only the instance ID, as allowed by provider.insecureInstanceIdProof")
+	} else {
+		return errors.New("User data has no workerIdentityToken with which to prove the worker's identity; see provider.insecureInstanceIdProof")
+	}
+
+	// We need a worker manager client for fetching taskcluster credentials.
+	// Ensure auth is disabled in client, since we don't have credentials yet.
+	wm, err := p.workerManagerClientFactory(state.RootURL, nil)
+	if err != nil {
+		return fmt.Errorf("Could not create worker manager client: %v", err)
+	}
+
+	err = provider.RegisterWorker(
+		state,
+		wm,
+		userData.WorkerPoolID,
+		userData.ProviderID,
+		userData.WorkerGroup,
+		metadata.UUID,
+		workerIdentityProofMap)
+	if err != nil {
+		return err
+	}
+
+	state.ProviderMetadata = map[string]interface{}{
+		"instance-id":       metadata.UUID,
+		"instance-name":     metadata.Name,
+		"hostname":          metadata.Hostname,
+		"availability-zone": metadata.AvailabilityZone,
+		"project-id":        metadata.ProjectID,
+	}
+
+	state.WorkerLocation = map[string]string{
+		"cloud":            "openstack",
+		"availabilityZone": metadata.AvailabilityZone,
+	}
+
+	pwc, err := cfg.ParseProviderWorkerConfig(p.runnercfg, userData.ProviderWorkerConfig)
+	if err != nil {
+		return err
+	}
+
+	state.WorkerConfig = state.WorkerConfig.Merge(pwc.Config)
+	state.Files = append(state.Files, pwc.Files...)
+
+	return nil
+}
+
+func (p *OpenStackProvider) UseCachedRun(run *run.State) error {
+	p.state = run
+	return nil
+}
+
+func (p *OpenStackProvider) SetProtocol(proto *protocol.Protocol) {
+	p.proto = proto
+}
+
+func (p *OpenStackProvider) WorkerStarted() error {
+	return nil
+}
+
+func (p *OpenStackProvider) WorkerFinished() error {
+	return provider.RemoveWorker(p.runnercfg, p.state, p.workerManagerClientFactory)
+}
+
+func clientFactory(rootURL string, credentials *tcclient.Credentials) (tc.WorkerManager, error) {
+	prov := tcworkermanager.New(credentials, rootURL)
+	return prov, nil
+}
+
+func New(runnercfg *cfg.RunnerConfig) (provider.Provider, error) {
+	return new(runnercfg, nil, nil)
+}
+
+func Usage() string {
+	return `
+The providerType "openstack" is intended for workers provisioned with
+worker-manager providers using providerType "openstack".  It requires
+
+` + "```yaml" + `
+provider:
+    providerType: openstack
+    # (optional) path at which the config drive is mounted (default /mnt/config)
+    configDrivePath: /mnt/config
+    # (optional, insecure) register even if the user data contains no
+    # workerIdentityToken (default false)
+    insecureInstanceIdProof: false
+` + "```" + `
+
+User data and instance metadata are read from the config drive, if it is
+mounted, and otherwise from the metadata service at 169.254.169.254.  The
+user data must be the JSON document supplied by worker-manager.
+
+The worker proves its identity to worker-manager with the instance's UUID and
+the single-use 'workerIdentityToken' from the user data, which worker-manager
+accepts only once.  The UUID alone is not secret, so anyone who knows or
+guesses it could register as the worker and obtain its credentials.  For
+deployments whose worker-manager does not supply a token, setting
+'insecureInstanceIdProof' allows registering with the UUID alone, accepting
+that risk; it should only be used where every party able to reach
+worker-manager is trusted.
+
+The [$TASKCLUSTER_WORKER_LOCATION](https://docs.taskcluster.net/docs/manual/design/env-vars#taskcluster_worker_location)
+defined by this provider has the following fields:
+
+* cloud: openstack
+* availabilityZone
+`
+}
+
+// New takes its dependencies as optional arguments, allowing injection of fake dependencies for testing.
+func new(runnercfg *cfg.RunnerConfig, workerManagerClientFactory tc.WorkerManagerClientFactory, metadataService MetadataService) (*OpenStackProvider, error) {
+	if workerManagerClientFactory == nil {
+		workerManagerClientFactory = clientFactory
+	}
+	if metadataService == nil {
+		configDrivePath := defaultConfigDrivePath
+		if v, ok := runnercfg.Provider.Data["configDrivePath"]; ok {
+			configDrivePath, ok = v.(string)
+			if !ok {
+				return nil, errors.New("provider.configDrivePath must be a string")
+			}
+		}
+		metadataService = &realMetadataService{configDrivePath: configDrivePath}
+	}
+	insecureInstanceIDProof := false
+	if v, ok := runnercfg.Provider.Data["insecureInstanceIdProof"]; ok {
+		insecureInstanceIDProof, ok = v.(bool)
+		if !ok {
+			return nil, errors.New("provider.insecureInstanceIdProof must be a boolean")
+		}
+	}
+	return &OpenStackProvider{
+		runnercfg:                  runnercfg,
+		workerManagerClientFactory: workerManagerClientFactory,
+		metadataService:            metadataService,
+		proto:                      nil,
+		insecureInstanceIDProof:    insecureInstanceIDProof,
+	}, nil
+}
@@ -0,0 +1,146 @@
+package openstack
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+	"github.com/taskcluster/taskcluster-worker-runner/tc"
+)
+
+func TestOpenStackConfigureRun(t *testing.T) {
+	runnerWorkerConfig := cfg.NewWorkerConfig()
+	runnerWorkerConfig, err := runnerWorkerConfig.Set("from-runner-cfg", true)
+	require.NoError(t, err, "setting config")
+	runnercfg := &cfg.RunnerConfig{
+		Provider: cfg.ProviderConfig{
+			ProviderType: "openstack",
+		},
+		WorkerImplementation: cfg.WorkerImplementationConfig{
+			Implementation: "whatever-worker",
+		},
+		WorkerConfig: runnerWorkerConfig,
+	}
+
+	pwcJson := json.RawMessage(`{
+        "whateverWorker": {
+		    "config": {
+				"from-ud": true
+			},
+			"files": [
+			    {"description": "a file."}
+			]
+		}
+	}`)
+	userData := &UserData{
+		WorkerPoolID:         "w/p",
+		ProviderID:           "os1",
+		WorkerGroup:          "wg",
+		RootURL:              "https://tc.example.com",
+		ProviderWorkerConfig: &pwcJson,
+		WorkerIdentityToken:  "tok",
+	}
+	instanceMetadata := &InstanceMetadata{
+		UUID:             "d8e02d56",
+		Name:             "worker-1",
+		Hostname:         "worker-1.novalocal",
+		AvailabilityZone: "nova",
+		ProjectID:        "proj-1234",
+	}
+	mds := &fakeMetadataService{UserData: userData, InstanceMetadata: instanceMetadata}
+
+	p, err := new(runnercfg, tc.FakeWorkerManagerClientFactory, mds)
+	require.NoError(t, err, "creating provider")
+
+	state := run.State{
+		WorkerConfig: runnercfg.WorkerConfig,
+	}
+	err = p.ConfigureRun(&state)
+	require.NoError(t, err, "ConfigureRun")
+
+	reg, err := tc.FakeWorkerManagerRegistration()
+	if assert.NoError(t, err) {
+		require.Equal(t, userData.ProviderID, reg.ProviderID)
+		require.Equal(t, userData.WorkerGroup, reg.WorkerGroup)
+		require.Equal(t, "d8e02d56", reg.WorkerID)
+		require.Equal(t, json.RawMessage(`{"instanceId":"d8e02d56","token":"tok"}`), reg.WorkerIdentityProof)
+		require.Equal(t, "w/p", reg.WorkerPoolID)
+	}
+
+	require.Equal(t, "https://tc.example.com", state.RootURL, "rootURL is correct")
+	require.Equal(t, "testing", state.Credentials.ClientID, "clientID is correct")
+	require.Equal(t, "w/p", state.WorkerPoolID, "workerPoolID is correct")
+	require.Equal(t, "wg", state.WorkerGroup, "workerGroup is correct")
+	require.Equal(t, "d8e02d56", state.WorkerID, "workerID is correct")
+
+	require.Equal(t, map[string]interface{}{
+		"instance-id":       "d8e02d56",
+		"instance-name":     "worker-1",
+		"hostname":          "worker-1.novalocal",
+		"availability-zone": "nova",
+		"project-id":        "proj-1234",
+	}, state.ProviderMetadata, "providerMetadata is correct")
+
+	require.Equal(t, true, state.WorkerConfig.MustGet("from-runner-cfg"), "value for from-runner-cfg")
+	require.Equal(t, true, state.WorkerConfig.MustGet("from-ud"), "value for worker-config")
+	require.Equal(t, "a file.", state.Files[0].Description)
+
+	require.Equal(t, "openstack", state.WorkerLocation["cloud"])
+	require.Equal(t, "nova", state.WorkerLocation["availabilityZone"])
+}
+
+func TestOpenStackInsecureInstanceIdProof(t *testing.T) {
+	userData := &UserData{
+		WorkerPoolID: "w/p",
+		ProviderID:   "os1",
+		WorkerGroup:  "wg",
+		RootURL:      "https://tc.example.com",
+	}
+	mds := &fakeMetadataService{UserData: userData, InstanceMetadata: &InstanceMetadata{UUID: "d8e02d56"}}
+	runnercfg := &cfg.RunnerConfig{
+		Provider: cfg.ProviderConfig{
+			ProviderType: "openstack",
+			Data:         map[string]interface{}{},
+		},
+		WorkerImplementation: cfg.WorkerImplementationConfig{
+			Implementation: "whatever-worker",
+		},
+	}
+
+	// without a token, registration requires the opt-in
+	p, err := new(runnercfg, tc.FakeWorkerManagerClientFactory, mds)
+	require.NoError(t, err)
+	require.Error(t, p.ConfigureRun(&run.State{}))
+
+	runnercfg.Provider.Data["insecureInstanceIdProof"] = true
+	p, err = new(runnercfg, tc.FakeWorkerManagerClientFactory, mds)
+	require.NoError(t, err)
+	require.NoError(t, p.ConfigureRun(&run.State{}))
+
+	reg, err := tc.FakeWorkerManagerRegistration()
+	require.NoError(t, err)
+	require.Equal(t, json.RawMessage(`{"instanceId":"d8e02d56"}`), reg.WorkerIdentityProof)
+
+	runnercfg.Provider.Data["insecureInstanceIdProof"] = "yes"
+	_, err = new(runnercfg, tc.FakeWorkerManagerClientFactory, mds)
+	require.Error(t, err)
+}
+
+func TestConfigDrivePathOption(t *testing.T) {
+	runnercfg := &cfg.RunnerConfig{
+		Provider: cfg.ProviderConfig{
+			ProviderType: "openstack",
+			Data:         map[string]interface{}{"configDrivePath": "/media/configdrive"},
+		},
+	}
+	p, err := new(runnercfg, tc.FakeWorkerManagerClientFactory, nil)
+	require.NoError(t, err)
+	require.Equal(t, "/media/configdrive", p.metadataService.(*realMetadataService).configDrivePath)
+
+	runnercfg.Provider.Data["configDrivePath"] = 12
+	_, err = new(runnercfg, tc.FakeWorkerManagerClientFactory, nil)
+	require.Error(t, err)
+}
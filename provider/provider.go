@@ -9,6 +9,8 @@ import (
 	"github.com/taskcluster/taskcluster-worker-runner/provider/aws"
 	"github.com/taskcluster/taskcluster-worker-runner/provider/azure"
 	"github.com/taskcluster/taskcluster-worker-runner/provider/google"
+	"github.com/taskcluster/taskcluster-worker-runner/provider/kubernetes"
+	"github.com/taskcluster/taskcluster-worker-runner/provider/openstack"
 	"github.com/taskcluster/taskcluster-worker-runner/provider/provider"
 	"github.com/taskcluster/taskcluster-worker-runner/provider/standalone"
 	"github.com/taskcluster/taskcluster-worker-runner/provider/static"
@@ -25,6 +27,8 @@ var providers map[string]providerInfo = map[string]providerInfo{
 	"static":     providerInfo{static.New, static.Usage},
 	"aws":        providerInfo{aws.New, aws.Usage},
 	"azure":      providerInfo{azure.New, azure.Usage},
+	"openstack":  providerInfo{openstack.New, openstack.Usage},
+	"kubernetes": providerInfo{kubernetes.New, kubernetes.Usage},
 }
 
 func New(runnercfg *cfg.RunnerConfig) (provider.Provider, error) {
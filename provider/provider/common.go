@@ -3,8 +3,10 @@ package provider
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"time"
 
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
 	"github.com/taskcluster/taskcluster-worker-runner/run"
 	"github.com/taskcluster/taskcluster-worker-runner/tc"
 	"github.com/taskcluster/taskcluster/clients/client-go/v24/tcworkermanager"
@@ -40,3 +42,39 @@ func RegisterWorker(state *run.State, wm tc.WorkerManager, workerPoolID, provide
 
 	return nil
 }
+
+// The maximum time to spend informing worker-manager that the worker has
+// stopped.  The client retries intermittent failures on its own, so this
+// bounds the total time spent on those retries.
+var removeWorkerTimeout = 2 * time.Minute
+
+// Inform the worker-manager that this worker has stopped, if configured to do
+// so.  This is intended to be called from the WorkerFinished method of
+// providers that use RegisterWorker.
+func RemoveWorker(runnercfg *cfg.RunnerConfig, state *run.State, factory tc.WorkerManagerClientFactory) error {
+	if !runnercfg.RemoveWorkerOnExit || state == nil {
+		return nil
+	}
+
+	wm, err := factory(state.RootURL, &state.Credentials)
+	if err != nil {
+		return fmt.Errorf("Could not create worker manager client: %v", err)
+	}
+
+	log.Printf("Removing worker %s/%s from worker-manager", state.WorkerGroup, state.WorkerID)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- wm.RemoveWorker(state.WorkerPoolID, state.WorkerGroup, state.WorkerID)
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			return fmt.Errorf("Could not remove worker: %v", err)
+		}
+		return nil
+	case <-time.After(removeWorkerTimeout):
+		return fmt.Errorf("Timed out removing worker after %s", removeWorkerTimeout)
+	}
+}
@@ -0,0 +1,68 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+	"github.com/taskcluster/taskcluster-worker-runner/tc"
+	tcclient "github.com/taskcluster/taskcluster/clients/client-go/v24"
+	"github.com/taskcluster/taskcluster/clients/client-go/v24/tcworkermanager"
+)
+
+// a WorkerManager whose RemoveWorker method never returns
+type hungWorkerManager struct{}
+
+func (wm *hungWorkerManager) RegisterWorker(payload *tcworkermanager.RegisterWorkerRequest) (*tcworkermanager.RegisterWorkerResponse, error) {
+	select {}
+}
+
+func (wm *hungWorkerManager) RemoveWorker(workerPoolID, workerGroup, workerID string) error {
+	select {}
+}
+
+func (wm *hungWorkerManager) ReportWorkerError(workerPoolID string, payload *tcworkermanager.WorkerErrorReport) (*tcworkermanager.WorkerPoolError, error) {
+	select {}
+}
+
+func makeState() *run.State {
+	return &run.State{
+		RootURL:      "https://tc.example.com",
+		Credentials:  tcclient.Credentials{ClientID: "cli"},
+		WorkerPoolID: "w/p",
+		WorkerGroup:  "wg",
+		WorkerID:     "wi",
+	}
+}
+
+func TestRemoveWorker(t *testing.T) {
+	runnercfg := &cfg.RunnerConfig{RemoveWorkerOnExit: true}
+	err := RemoveWorker(runnercfg, makeState(), tc.FakeWorkerManagerClientFactory)
+	require.NoError(t, err)
+	require.Equal(t, []tc.FakeWorkerManagerRemoval{{WorkerPoolID: "w/p", WorkerGroup: "wg", WorkerID: "wi"}}, tc.FakeWorkerManagerRemovals())
+}
+
+func TestRemoveWorkerNotConfigured(t *testing.T) {
+	runnercfg := &cfg.RunnerConfig{}
+	err := RemoveWorker(runnercfg, makeState(), tc.FakeWorkerManagerClientFactory)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(tc.FakeWorkerManagerRemovals()))
+}
+
+func TestRemoveWorkerTimeout(t *testing.T) {
+	oldTimeout := removeWorkerTimeout
+	removeWorkerTimeout = 10 * time.Millisecond
+	defer func() {
+		removeWorkerTimeout = oldTimeout
+	}()
+
+	factory := func(rootURL string, credentials *tcclient.Credentials) (tc.WorkerManager, error) {
+		return &hungWorkerManager{}, nil
+	}
+
+	runnercfg := &cfg.RunnerConfig{RemoveWorkerOnExit: true}
+	err := RemoveWorker(runnercfg, makeState(), factory)
+	require.Error(t, err)
+}
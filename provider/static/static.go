@@ -26,9 +26,14 @@ type StaticProvider struct {
 	runnercfg                  *cfg.RunnerConfig
 	workerManagerClientFactory tc.WorkerManagerClientFactory
 	proto                      *protocol.Protocol
+
+	// the state for this run, used to remove the worker when it finishes
+	state *run.State
 }
 
 func (p *StaticProvider) ConfigureRun(state *run.State) error {
+	p.state = state
+
 	var pc staticProviderConfig
 	err := p.runnercfg.Provider.Unpack(&pc)
 	if err != nil {
@@ -76,6 +81,7 @@ func (p *StaticProvider) ConfigureRun(state *run.State) error {
 }
 
 func (p *StaticProvider) UseCachedRun(run *run.State) error {
+	p.state = run
 	return nil
 }
 
@@ -88,7 +94,7 @@ func (p *StaticProvider) WorkerStarted() error {
 }
 
 func (p *StaticProvider) WorkerFinished() error {
-	return nil
+	return provider.RemoveWorker(p.runnercfg, p.state, p.workerManagerClientFactory)
 }
 
 func clientFactory(rootURL string, credentials *tcclient.Credentials) (tc.WorkerManager, error) {
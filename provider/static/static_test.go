@@ -70,3 +70,33 @@ func TestConfigureRun(t *testing.T) {
 	require.Equal(t, "underworld", state.WorkerLocation["region"])
 	require.Equal(t, "666", state.WorkerLocation["zone"])
 }
+
+func TestWorkerFinishedRemovesWorker(t *testing.T) {
+	runnercfg := &cfg.RunnerConfig{
+		Provider: cfg.ProviderConfig{
+			ProviderType: "static",
+			Data: map[string]interface{}{
+				"rootURL":      "https://tc.example.com",
+				"providerID":   "static-1",
+				"workerPoolID": "w/p",
+				"workerGroup":  "wg",
+				"workerID":     "wi",
+				"staticSecret": "quiet",
+			},
+		},
+		WorkerImplementation: cfg.WorkerImplementationConfig{
+			Implementation: "whatever",
+		},
+		RemoveWorkerOnExit: true,
+	}
+
+	p, err := new(runnercfg, tc.FakeWorkerManagerClientFactory)
+	require.NoError(t, err, "creating provider")
+
+	state := run.State{}
+	require.NoError(t, p.ConfigureRun(&state))
+	require.NoError(t, p.WorkerStarted())
+	require.NoError(t, p.WorkerFinished())
+
+	require.Equal(t, []tc.FakeWorkerManagerRemoval{{WorkerPoolID: "w/p", WorkerGroup: "wg", WorkerID: "wi"}}, tc.FakeWorkerManagerRemovals())
+}
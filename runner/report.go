@@ -0,0 +1,104 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+	"github.com/taskcluster/taskcluster-worker-runner/tc"
+	tcclient "github.com/taskcluster/taskcluster/clients/client-go/v24"
+	"github.com/taskcluster/taskcluster/clients/client-go/v24/tcworkermanager"
+)
+
+// Phases of a run, used to describe where a failure occurred when reporting
+// it to worker-manager.
+const (
+	phaseProvider    = "provider"
+	phaseSecrets     = "secrets"
+	phaseFiles       = "files"
+	phaseWorkerStart = "worker-start"
+	phaseWorkerExit  = "worker-exit"
+)
+
+// The maximum length of an error description accepted by worker-manager
+const maxErrorDescriptionLength = 10240
+
+// The time to wait for worker-manager to accept an error report
+var reportWorkerErrorTimeout = 2 * time.Minute
+
+func clientFactory(rootURL string, credentials *tcclient.Credentials) (tc.WorkerManager, error) {
+	return tcworkermanager.New(credentials, rootURL), nil
+}
+
+// The factory used to create worker-manager clients for error reports; tests
+// replace this with a fake.
+var workerManagerClientFactory tc.WorkerManagerClientFactory = clientFactory
+
+// Report an error that occurred during the given phase of the run to
+// worker-manager, so that it is visible to the worker pool's owners.  This is
+// only possible once the provider has supplied credentials; before that, the
+// error is only logged.  Failures to report are logged and otherwise ignored,
+// so that the original error is what the caller sees.
+func reportWorkerError(state *run.State, phase string, runErr error) {
+	if state.RootURL == "" || state.Credentials.ClientID == "" || state.WorkerPoolID == "" {
+		return
+	}
+
+	wm, err := workerManagerClientFactory(state.RootURL, &state.Credentials)
+	if err != nil {
+		log.Printf("Could not create worker manager client to report error: %v", err)
+		return
+	}
+
+	description := truncate(runErr.Error(), maxErrorDescriptionLength)
+
+	extra, err := json.Marshal(map[string]string{
+		"phase":       phase,
+		"workerGroup": state.WorkerGroup,
+		"workerId":    state.WorkerID,
+	})
+	if err != nil {
+		log.Printf("Could not encode error report: %v", err)
+		return
+	}
+
+	payload := &tcworkermanager.WorkerErrorReport{
+		Description: description,
+		Extra:       extra,
+		Kind:        "worker-runner-" + phase,
+		Title:       fmt.Sprintf("Worker Runner Error (%s)", phase),
+		WorkerGroup: state.WorkerGroup,
+		WorkerID:    state.WorkerID,
+	}
+
+	log.Printf("Reporting %s error to worker-manager", phase)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := wm.ReportWorkerError(state.WorkerPoolID, payload)
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			log.Printf("Could not report error to worker-manager: %v", err)
+		}
+	case <-time.After(reportWorkerErrorTimeout):
+		log.Printf("Timed out reporting error to worker-manager after %s", reportWorkerErrorTimeout)
+	}
+}
+
+// Truncate s to at most max bytes, without splitting a multi-byte character
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
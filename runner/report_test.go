@@ -0,0 +1,24 @@
+package runner
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncate(t *testing.T) {
+	require.Equal(t, "abc", truncate("abc", 10))
+	require.Equal(t, "abc", truncate("abcdef", 3))
+
+	// "é" is two bytes, and is not split
+	require.Equal(t, "a", truncate("aé", 2))
+	require.Equal(t, "aé", truncate("aé", 3))
+
+	// "€" is three bytes
+	long := strings.Repeat("€", maxErrorDescriptionLength)
+	truncated := truncate(long, maxErrorDescriptionLength)
+	require.True(t, utf8.ValidString(truncated))
+	require.Equal(t, maxErrorDescriptionLength/3*3, len(truncated))
+}
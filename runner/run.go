@@ -6,18 +6,29 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"time"
 
+	"github.com/taskcluster/taskcluster-worker-runner/afterexit"
 	"github.com/taskcluster/taskcluster-worker-runner/cfg"
 	"github.com/taskcluster/taskcluster-worker-runner/credexp"
 	"github.com/taskcluster/taskcluster-worker-runner/files"
+	"github.com/taskcluster/taskcluster-worker-runner/hooks"
+	"github.com/taskcluster/taskcluster-worker-runner/lifetime"
+	"github.com/taskcluster/taskcluster-worker-runner/metrics"
 	"github.com/taskcluster/taskcluster-worker-runner/perms"
 	"github.com/taskcluster/taskcluster-worker-runner/protocol"
 	"github.com/taskcluster/taskcluster-worker-runner/provider"
 	"github.com/taskcluster/taskcluster-worker-runner/run"
 	"github.com/taskcluster/taskcluster-worker-runner/secrets"
+	"github.com/taskcluster/taskcluster-worker-runner/status"
+	"github.com/taskcluster/taskcluster-worker-runner/watchdog"
 	"github.com/taskcluster/taskcluster-worker-runner/worker"
 )
 
+// The function used to create the provider; tests replace this to observe the
+// provider's lifecycle.
+var newProvider = provider.New
+
 // Run the worker.  This embodies the execution of the start-worker command.
 func Run(configFile string) (state run.State, err error) {
 	// load configuration
@@ -29,7 +40,52 @@ func Run(configFile string) (state run.State, err error) {
 		return
 	}
 
+	err = hooks.Validate(runnercfg.Hooks)
+	if err != nil {
+		err = fmt.Errorf("Error in runner config file %s: %s", configFile, err)
+		return
+	}
+
+	ae, err := afterexit.New(runnercfg)
+	if err != nil {
+		err = fmt.Errorf("Error in runner config file %s: %s", configFile, err)
+		return
+	}
+
+	st, err := status.New(runnercfg)
+	if err != nil {
+		return
+	}
+	defer st.Close()
+
+	// true if this run's state was loaded from cacheOverRestarts, meaning that
+	// the host was restarted by the worker
 	runCached := false
+
+	// once the worker has exited, and everything else is finished, perform
+	// the afterExit action
+	workerExited := false
+	defer func() {
+		if workerExited {
+			aeErr := ae.Run(err, runCached)
+			if err == nil {
+				err = aeErr
+			}
+		}
+	}()
+
+	// metrics are written out before the afterExit action
+	ms, err := metrics.Start(runnercfg)
+	if err != nil {
+		return
+	}
+	defer func() {
+		msErr := ms.Close()
+		if msErr != nil {
+			log.Printf("%s", msErr)
+		}
+	}()
+
 	if runnercfg.CacheOverRestarts != "" {
 
 		var encoded []byte
@@ -55,19 +111,35 @@ func Run(configFile string) (state run.State, err error) {
 
 	state.WorkerConfig = state.WorkerConfig.Merge(runnercfg.WorkerConfig)
 
+	// once the provider has supplied credentials, any failure is reported to
+	// worker-manager along with the phase in which it occurred
+	var phase string
+	setPhase := func(p string) {
+		phase = p
+		st.SetPhase(p, &state)
+	}
+	setPhase(phaseProvider)
+	defer func() {
+		if err != nil {
+			reportWorkerError(&state, phase, err)
+		}
+	}()
+
 	// initialize provider
 
-	provider, err := provider.New(runnercfg)
+	provider, err := newProvider(runnercfg)
 	if err != nil {
 		return
 	}
 
 	if !runCached {
 		log.Printf("Configuring with provider %s", runnercfg.Provider.ProviderType)
+		started := time.Now()
 		err = provider.ConfigureRun(&state)
 		if err != nil {
 			return
 		}
+		metrics.ObservePhase(phaseProvider, time.Since(started))
 	} else {
 		err = provider.UseCachedRun(&state)
 		if err != nil {
@@ -83,18 +155,32 @@ func Run(configFile string) (state run.State, err error) {
 	// log the worker identity; this is useful for finding the worker in logfiles
 	log.Printf("Identified as worker %s/%s", state.WorkerGroup, state.WorkerID)
 
+	if !state.CredentialsExpire.IsZero() {
+		metrics.SetCredentialsExpire(state.CredentialsExpire)
+	}
+	ms.SetIdentity(&state)
+
+	err = hooks.Run(runnercfg, hooks.AfterProvider, &state)
+	if err != nil {
+		return
+	}
+
 	// fetch secrets
 
+	setPhase(phaseSecrets)
 	if !runCached && runnercfg.GetSecrets {
 		log.Println("Getting secrets from secrets service")
+		started := time.Now()
 		err = secrets.ConfigureRun(runnercfg, &state)
 		if err != nil {
 			return
 		}
+		metrics.ObservePhase(phaseSecrets, time.Since(started))
 	}
 
 	// initialize worker
 
+	setPhase(phaseWorkerStart)
 	worker, err := worker.New(runnercfg)
 	if err != nil {
 		return
@@ -143,31 +229,72 @@ func Run(configFile string) (state run.State, err error) {
 
 	// extract files
 
+	setPhase(phaseFiles)
+	err = hooks.Run(runnercfg, hooks.BeforeFiles, &state)
+	if err != nil {
+		return
+	}
+
 	if !runCached {
 		log.Printf("Writing files")
+		started := time.Now()
 		err = files.ExtractAll(state.Files)
 		if err != nil {
 			return
 		}
+		metrics.ObservePhase(phaseFiles, time.Since(started))
 	}
 
 	// handle credential expiratoin
 	ce := credexp.New(&state)
 
+	// handle maxLifetime and idleTimeout
+	lt := lifetime.New(runnercfg)
+
+	// watch for heartbeats from the worker
+	wd := watchdog.New(runnercfg, worker)
+
 	// start
 
+	setPhase(phaseWorkerStart)
+	err = hooks.Run(runnercfg, hooks.BeforeStart, &state)
+	if err != nil {
+		return
+	}
+
+	var recording *os.File
+	if runnercfg.RecordProtocol != "" {
+		recording, err = os.OpenFile(runnercfg.RecordProtocol, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return
+		}
+		defer recording.Close()
+	}
+
 	log.Printf("Starting worker")
+	started := time.Now()
 	transp, err := worker.StartWorker(&state)
 	if err != nil {
 		return
 	}
+	if recording != nil {
+		log.Printf("Recording protocol session to %s", runnercfg.RecordProtocol)
+		transp = protocol.NewRecorderTransport(transp, recording)
+	}
+	metrics.ObservePhase(phaseWorkerStart, time.Since(started))
+	metrics.WorkerStarted(runCached)
+	st.WorkerStarted(worker)
 
 	// set up protocol
 
-	proto := protocol.NewProtocol(transp)
+	proto := protocol.NewProtocol(metrics.WrapTransport(st.WrapTransport(transp)))
 	provider.SetProtocol(proto)
 	worker.SetProtocol(proto)
 	ce.SetProtocol(proto)
+	lt.SetProtocol(proto)
+	wd.SetProtocol(proto)
+	st.SetProtocol(proto)
+	ms.SetProtocol(proto)
 
 	// call the WorkerStarted methods before starting the proto so that there
 	// are no race conditions around the capabilities negotiation
@@ -176,6 +303,16 @@ func Run(configFile string) (state run.State, err error) {
 		return
 	}
 
+	err = lt.WorkerStarted()
+	if err != nil {
+		return
+	}
+
+	err = wd.WorkerStarted()
+	if err != nil {
+		return
+	}
+
 	err = provider.WorkerStarted()
 	if err != nil {
 		return
@@ -185,22 +322,58 @@ func Run(configFile string) (state run.State, err error) {
 
 	// wait for the worker to terminate
 
+	setPhase(phaseWorkerExit)
 	err = worker.Wait()
-	if err != nil {
-		return
+	workerExited = true
+	metrics.WorkerExited(exitCode(worker, err))
+
+	// stop the watchdog immediately, and include its reason for stopping the
+	// worker, if any, in the error
+	wdErr := wd.WorkerFinished()
+	if reason := wd.Reason(); reason != "" {
+		if err != nil {
+			err = fmt.Errorf("%s: %s", reason, err)
+		} else {
+			err = fmt.Errorf("%s", reason)
+		}
 	}
+	err = combineErrors(err, wdErr)
 
-	// shut things down
+	// after-exit hooks run even if the worker failed, but do not hide that
+	// failure
+	err = combineErrors(err, hooks.Run(runnercfg, hooks.AfterExit, &state))
 
-	err = provider.WorkerFinished()
-	if err != nil {
-		return
-	}
+	// shut things down, whether or not the worker succeeded; in particular, a
+	// worker that crashed or was stopped must still be removed from
+	// worker-manager
 
-	err = ce.WorkerFinished()
-	if err != nil {
-		return
-	}
+	err = combineErrors(err, provider.WorkerFinished())
+	err = combineErrors(err, ce.WorkerFinished())
+	err = combineErrors(err, lt.WorkerFinished())
 
 	return
 }
+
+// Combine two errors, either of which may be nil, keeping the first as the
+// primary error.
+func combineErrors(err, other error) error {
+	if other == nil {
+		return err
+	}
+	if err == nil {
+		return other
+	}
+	return fmt.Errorf("%s; %s", err, other)
+}
+
+// Get the exit code of the worker, if the worker implementation makes it
+// available, or -1.
+func exitCode(w interface{}, waitErr error) int {
+	if e, ok := w.(interface{ ExitCode() int }); ok {
+		return e.ExitCode()
+	}
+	if waitErr == nil {
+		return 0
+	}
+	return -1
+}
@@ -11,6 +11,10 @@ import (
 
 	"github.com/Flaque/filet"
 	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/provider"
+	ptype "github.com/taskcluster/taskcluster-worker-runner/provider/provider"
+	"github.com/taskcluster/taskcluster-worker-runner/tc"
 )
 
 func buildFakeGenericWorker(workerPath string) error {
@@ -140,3 +144,134 @@ worker:
 
 	require.Equal(t, true, run.WorkerConfig.MustGet("fromFirstRun"))
 }
+
+func TestReportWorkerStartError(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	configPath := filepath.Join(dir, "runner.yaml")
+
+	workerManagerClientFactory = tc.FakeWorkerManagerClientFactory
+	defer func() {
+		workerManagerClientFactory = clientFactory
+	}()
+
+	err := ioutil.WriteFile(configPath, []byte(fmt.Sprintf(`
+provider:
+  providerType: standalone
+  rootURL: https://tc.example.com
+  clientID: fake
+  accessToken: fake
+  workerPoolID: pp/ww
+  workerGroup: wg
+  workerID: wi
+getSecrets: false
+worker:
+  implementation: generic-worker
+  configPath: %s
+  path: %s
+`, filepath.Join(dir, "worker.yaml"), filepath.Join(dir, "no-such-worker"))), 0755)
+	require.NoError(t, err)
+
+	_, err = Run(configPath)
+	require.Error(t, err)
+
+	reports := tc.FakeWorkerManagerErrorReports()
+	require.Equal(t, 1, len(reports))
+	require.Equal(t, "worker-runner-worker-start", reports[0].Kind)
+	require.Equal(t, err.Error(), reports[0].Description)
+	require.Equal(t, "wg", reports[0].WorkerGroup)
+	require.Equal(t, "wi", reports[0].WorkerID)
+}
+
+func TestNoReportWithoutCredentials(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	configPath := filepath.Join(dir, "runner.yaml")
+
+	workerManagerClientFactory = tc.FakeWorkerManagerClientFactory
+	defer func() {
+		workerManagerClientFactory = clientFactory
+	}()
+
+	// standalone provider without credentials fails before any are available
+	err := ioutil.WriteFile(configPath, []byte(`
+provider:
+  providerType: standalone
+  rootURL: https://tc.example.com
+  workerPoolID: pp/ww
+  workerGroup: wg
+  workerID: wi
+getSecrets: false
+worker:
+  implementation: dummy
+`), 0755)
+	require.NoError(t, err)
+
+	_, err = Run(configPath)
+	require.Error(t, err)
+
+	require.Equal(t, 0, len(tc.FakeWorkerManagerErrorReports()))
+}
+
+// A provider that records whether WorkerFinished was called
+type finishRecordingProvider struct {
+	ptype.Provider
+	finished bool
+}
+
+func (p *finishRecordingProvider) WorkerFinished() error {
+	p.finished = true
+	return p.Provider.WorkerFinished()
+}
+
+func TestWorkerFinishedAfterFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell command as the worker")
+	}
+
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	configPath := filepath.Join(dir, "runner.yaml")
+
+	var prov *finishRecordingProvider
+	newProvider = func(runnercfg *cfg.RunnerConfig) (ptype.Provider, error) {
+		inner, err := provider.New(runnercfg)
+		prov = &finishRecordingProvider{Provider: inner}
+		return prov, err
+	}
+	defer func() {
+		newProvider = provider.New
+	}()
+
+	workerManagerClientFactory = tc.FakeWorkerManagerClientFactory
+	defer func() {
+		workerManagerClientFactory = clientFactory
+	}()
+
+	err := ioutil.WriteFile(configPath, []byte(`
+provider:
+  providerType: standalone
+  rootURL: https://tc.example.com
+  clientID: fake
+  accessToken: fake
+  workerPoolID: pp/ww
+  workerGroup: wg
+  workerID: wi
+getSecrets: false
+worker:
+  implementation: exec
+  command: [sh, -c, "exit 3"]
+`), 0755)
+	require.NoError(t, err)
+
+	_, err = Run(configPath)
+	require.Error(t, err)
+
+	// the provider was still told that the worker finished, so that it can
+	// remove the worker from worker-manager
+	require.True(t, prov.finished)
+
+	reports := tc.FakeWorkerManagerErrorReports()
+	require.Equal(t, 1, len(reports))
+	require.Equal(t, "worker-runner-worker-exit", reports[0].Kind)
+}
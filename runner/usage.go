@@ -36,6 +36,133 @@ the following fields:
   implementations that restart the system as part of their normal operation
   and expect to start up with the same config after a restart.
 
+* |removeWorkerOnExit|: if true, then when the worker exits, worker-runner
+  calls worker-manager's |removeWorker| method to indicate that this worker
+  has stopped.  This only applies to providers which register the worker
+  with worker-manager, and requires that the worker's credentials have scope
+  |worker-manager:remove-worker:<workerPoolId>/<workerGroup>/<workerId>|.
+
+* |maxLifetime|: if set, the number of seconds after which the worker is
+  asked to stop, by sending a |graceful-termination| message with
+  |finish-tasks: true|.
+
+* |idleTimeout|: if set, the number of seconds a worker may remain idle
+  before it is asked to stop in the same way.  This requires that the worker
+  support the |idle| protocol capability, reporting when it becomes idle or
+  busy.
+
+* |heartbeatInterval|: if set, the number of seconds between heartbeats
+  expected from a worker supporting the |heartbeat| protocol capability.  If
+  the worker misses |maxMissedHeartbeats| (default 3) heartbeats in a row, it
+  is sent a |graceful-termination| message with |finish-tasks: false|, and if
+  it has not exited after the same amount of time again, it is killed.  A
+  worker that does not complete capability negotiation within the same time
+  after starting is killed in the same way.  The reason is included in
+  worker-runner's error.
+
+* |afterExit|: the action to take on the host after the worker exits and
+  worker-runner has finished: |none| (the default), |shutdown|, |reboot|, or
+  |shutdown-on-success-only| (shut down only if the worker and worker-runner
+  succeeded).  With |cacheOverRestarts|, the action is skipped when the run's
+  state was loaded from the cache, as the worker restarted the host on purpose
+  and manages restarts itself.
+
+* |status|: configuration for a local HTTP server reporting the status of
+  worker-runner:
+
+  * |listen|: the address on which to listen, either a loopback address such
+    as |127.0.0.1:9100|, or |unix:<path>| for a unix socket (which is created
+    with mode 0600).  If not set, there is no server.
+
+  * |token|: a secret token for the POST endpoint below.  If not set, that
+    endpoint is disabled.
+
+  |GET /status| returns a JSON object containing the current phase (as for
+  error reports, below), the worker's identity and location, its client ID
+  and credential expiration (but never its credentials), the negotiated
+  protocol capabilities, the worker's process ID and uptime, and any
+  |graceful-termination| messages sent to the worker.
+
+  |POST /graceful-termination|, with header |Authorization: Bearer <token>|,
+  sends a |graceful-termination| message to the worker, with |finish-tasks|
+  true unless the query parameter |finish-tasks=false| is given.
+
+* |metrics|: configuration for Prometheus metrics:
+
+  * |listen|: the address on which to serve metrics at |/metrics|, such as
+    |:9101|.  An address without a host listens only on |127.0.0.1|; use
+    |0.0.0.0:9101| to serve metrics on all interfaces.  If not set, metrics
+    are not served.
+
+  * |textfile|: a file to which metrics are written when worker-runner
+    finishes, suitable for the node exporter's textfile collector.  Since
+    each run of start-worker has its own metrics, this is the best way to
+    observe worker exit codes and restarts.
+
+  * |statsd|: a StatsD server to which metrics forwarded from the worker are
+    pushed, with |address| (|host:port|, over UDP) and an optional |prefix|
+    for metric names.  Labels are sent as DogStatsD tags.
+
+  The metrics are |worker_runner_phase_duration_seconds| (a histogram, by
+  |phase|), |worker_runner_protocol_messages_total| (by |direction| and
+  |type|), |worker_runner_protocol_errors_total| (by |kind|: an
+  |invalid-message| from the worker, a |callback-panic| handling one, or a
+  |queue-full| when messages arrive too quickly),
+  |worker_runner_worker_starts_total| (with |cached="true"| for a
+  restart using cached state), |worker_runner_worker_exits_total| (by exit
+  |code|), |worker_runner_credentials_expiry_seconds|,
+  |worker_runner_termination_notices_total| (by |provider| and |kind|), and
+  |worker_runner_worker_samples_dropped_total| (by |limit|, see below).
+  Workers supporting the |metrics| protocol capability can forward their own
+  metrics, which are included at |/metrics| and in the textfile, and pushed
+  to StatsD, with additional labels |worker_pool_id| and |location_<key>|
+  for each field of the worker location.  At most 100 metrics are forwarded,
+  each with at most 100 distinct sets of labels; samples beyond those limits
+  are dropped, so labels should not include values such as task IDs.
+
+* |recordProtocol|: a file to which every protocol message between
+  worker-runner and the worker is written, one JSON object per line with the
+  message's |time|, |direction| (|sent| to the worker or |received| from
+  it), and the |message| itself.  The file is replaced each time the worker
+  starts.  Use |start-worker protocol-replay| to inspect or replay the
+  recording.
+
+* |hooks|: a list of commands to run at points in the worker's lifecycle.
+  Each hook has the following fields:
+
+  * |phase|: (required) one of |after-provider| (once the provider has
+    identified the worker), |before-files| (before files are extracted),
+    |before-start| (just before the worker starts), or |after-exit| (after the
+    worker exits, even if it failed).
+
+  * |command|: (required) the command to run, as a list of strings.
+
+  * |timeout|: the number of seconds to allow the hook to run (default 600).
+    On Linux and macOS, the hook and any processes it starts in its process
+    group are killed when the timeout expires.
+
+  * |onFailure|: |abort| (the default) to fail worker-runner if the hook fails
+    or times out, or |warn| to log the failure and continue.
+
+  Hooks receive the runner state as JSON on stdin, with credentials, file
+  contents, and worker configuration values that are secret removed.  A
+  worker configuration value is considered secret if it is equal to the
+  credentials or its key contains |password|, |secret|, |token|,
+  |certificate|, |credential|, or |privatekey| (ignoring case).  The environment variables
+  |TASKCLUSTER_WORKER_RUNNER_HOOK| (the phase), |TASKCLUSTER_ROOT_URL|,
+  |TASKCLUSTER_WORKER_POOL_ID|, |TASKCLUSTER_WORKER_GROUP|,
+  |TASKCLUSTER_WORKER_ID|, and |TASKCLUSTER_WORKER_LOCATION| (a JSON object)
+  identify the worker.  A |before-start| hook may write a JSON object to
+  stdout, which is merged into the worker configuration; the output of other
+  hooks is logged.
+
+If worker-runner fails after the provider has supplied credentials, the
+failure is reported to worker-manager's |reportWorkerError| method, with a
+kind indicating the phase in which it occurred (|worker-runner-provider|,
+|worker-runner-secrets|, |worker-runner-files|, |worker-runner-worker-start|,
+or |worker-runner-worker-exit|).  Such reports are visible to anyone who can
+view the worker pool's errors.
+
 **NOTE** for Windows users: the configuration file must be a UNIX-style text file.
 DOS-style newlines and encodings other than utf-8 are not supported.`, "|", "`")
 }
@@ -0,0 +1,306 @@
+package status
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+)
+
+// The prefix of a status listen address indicating a unix socket
+const unixPrefix = "unix:"
+
+// A termination notice, recorded when a graceful-termination message is sent
+// to the worker.
+type TerminationNotice struct {
+	Time        time.Time `json:"time"`
+	FinishTasks bool      `json:"finishTasks"`
+}
+
+// The response to GET /status.  This includes only information identifying
+// the worker; in particular, it never includes credentials.
+type Response struct {
+	Phase              string              `json:"phase"`
+	RootURL            string              `json:"rootURL,omitempty"`
+	ClientID           string              `json:"clientID,omitempty"`
+	CredentialsExpire  *time.Time          `json:"credentialsExpire,omitempty"`
+	WorkerPoolID       string              `json:"workerPoolID,omitempty"`
+	WorkerGroup        string              `json:"workerGroup,omitempty"`
+	WorkerID           string              `json:"workerID,omitempty"`
+	WorkerLocation     map[string]string   `json:"workerLocation,omitempty"`
+	Capabilities       []string            `json:"capabilities"`
+	WorkerPID          int                 `json:"workerPID,omitempty"`
+	RunnerStarted      time.Time           `json:"runnerStarted"`
+	WorkerStarted      *time.Time          `json:"workerStarted,omitempty"`
+	WorkerUptime       float64             `json:"workerUptime,omitempty"`
+	TerminationNotices []TerminationNotice `json:"terminationNotices"`
+}
+
+// Status tracks the state of start-worker and, if configured, serves it over
+// HTTP on a loopback address or unix socket.
+type Status struct {
+	token    string
+	listener net.Listener
+	server   *http.Server
+
+	// protects the remaining fields, which are accessed from the HTTP server
+	mux sync.Mutex
+
+	// the protocol (set in SetProtocol), and whether it has been initialized
+	proto            *protocol.Protocol
+	protoInitialized bool
+
+	// a snapshot of the status, without time-dependent fields
+	resp Response
+}
+
+// Create a new Status, starting the HTTP server if runnercfg.Status.Listen is
+// set.
+func New(runnercfg *cfg.RunnerConfig) (*Status, error) {
+	st := &Status{
+		token: runnercfg.Status.Token,
+		resp: Response{
+			Phase:              "startup",
+			Capabilities:       []string{},
+			RunnerStarted:      time.Now(),
+			TerminationNotices: []TerminationNotice{},
+		},
+	}
+
+	if runnercfg.Status.Listen == "" {
+		return st, nil
+	}
+
+	listener, err := listen(runnercfg.Status.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("Error starting status server: %s", err)
+	}
+	st.listener = listener
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", st.handleStatus)
+	mux.HandleFunc("/graceful-termination", st.handleGracefulTermination)
+	st.server = &http.Server{Handler: mux}
+
+	go func() {
+		err := st.server.Serve(listener)
+		if err != http.ErrServerClosed {
+			log.Printf("Error from status server: %s", err)
+		}
+	}()
+	log.Printf("Serving status on %s", runnercfg.Status.Listen)
+
+	return st, nil
+}
+
+// Listen on the given address, which must be a loopback address or a unix
+// socket.
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		path := strings.TrimPrefix(addr, unixPrefix)
+
+		// remove any socket left over from a previous run
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		err = os.Chmod(path, 0600)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("status.listen must be a loopback address or unix socket, not %s", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Get the address on which the server is listening, or nil if it is not
+// running.
+func (st *Status) Addr() net.Addr {
+	if st.listener == nil {
+		return nil
+	}
+	return st.listener.Addr()
+}
+
+// Stop the HTTP server, if it is running.
+func (st *Status) Close() error {
+	if st.server == nil {
+		return nil
+	}
+	return st.server.Close()
+}
+
+// Set the current phase, updating the worker identity from the given state.
+// This must be called from the same goroutine that modifies the state.
+func (st *Status) SetPhase(phase string, state *run.State) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	st.resp.Phase = phase
+	st.resp.RootURL = state.RootURL
+	st.resp.ClientID = state.Credentials.ClientID
+	if !state.CredentialsExpire.IsZero() {
+		expires := state.CredentialsExpire
+		st.resp.CredentialsExpire = &expires
+	}
+	st.resp.WorkerPoolID = state.WorkerPoolID
+	st.resp.WorkerGroup = state.WorkerGroup
+	st.resp.WorkerID = state.WorkerID
+	st.resp.WorkerLocation = make(map[string]string)
+	for k, v := range state.WorkerLocation {
+		st.resp.WorkerLocation[k] = v
+	}
+}
+
+// Record that the worker has started.  If the worker has a PID method, its
+// result is included in the status.
+func (st *Status) WorkerStarted(w interface{}) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	now := time.Now()
+	st.resp.WorkerStarted = &now
+	if p, ok := w.(interface{ PID() int }); ok {
+		st.resp.WorkerPID = p.PID()
+	}
+}
+
+// Wrap the given transport so that graceful-termination messages sent to the
+// worker are recorded as termination notices.
+func (st *Status) WrapTransport(transp protocol.Transport) protocol.Transport {
+	return &statusTransport{transp, st}
+}
+
+func (st *Status) SetProtocol(proto *protocol.Protocol) {
+	st.mux.Lock()
+	st.proto = proto
+	st.mux.Unlock()
+
+	go func() {
+		proto.WaitUntilInitialized()
+		caps := proto.Capabilities.List()
+
+		st.mux.Lock()
+		defer st.mux.Unlock()
+		st.resp.Capabilities = caps
+		st.protoInitialized = true
+	}()
+}
+
+func (st *Status) recordTerminationNotice(msg protocol.Message) {
+	finishTasks, _ := msg.Properties["finish-tasks"].(bool)
+
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	st.resp.TerminationNotices = append(st.resp.TerminationNotices, TerminationNotice{time.Now(), finishTasks})
+}
+
+// Get the current status
+func (st *Status) Get() Response {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	resp := st.resp
+	resp.Capabilities = append([]string{}, st.resp.Capabilities...)
+	resp.TerminationNotices = append([]TerminationNotice{}, st.resp.TerminationNotices...)
+	if resp.WorkerStarted != nil {
+		resp.WorkerUptime = time.Since(*resp.WorkerStarted).Seconds()
+	}
+	return resp
+}
+
+func (st *Status) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(st.Get())
+	if err != nil {
+		log.Printf("Error writing status response: %s", err)
+	}
+}
+
+func (st *Status) authorized(r *http.Request) bool {
+	if st.token == "" {
+		return false
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(st.token)) == 1
+}
+
+func (st *Status) handleGracefulTermination(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !st.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	finishTasks := r.URL.Query().Get("finish-tasks") != "false"
+
+	st.mux.Lock()
+	proto := st.proto
+	protoInitialized := st.protoInitialized
+	st.mux.Unlock()
+
+	// avoid blocking in proto.Capable if the worker has not yet sent hello
+	if proto == nil || !protoInitialized {
+		http.Error(w, "worker has not started", http.StatusServiceUnavailable)
+		return
+	}
+	if !proto.Capable("graceful-termination") {
+		http.Error(w, "worker does not support graceful-termination", http.StatusConflict)
+		return
+	}
+
+	log.Printf("Graceful termination requested via status server (finish-tasks: %t)", finishTasks)
+	proto.Send(protocol.Message{
+		Type: "graceful-termination",
+		Properties: map[string]interface{}{
+			"finish-tasks": finishTasks,
+		},
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// statusTransport wraps a Transport to record termination notices
+type statusTransport struct {
+	protocol.Transport
+	st *Status
+}
+
+func (transp *statusTransport) Send(msg protocol.Message) {
+	if msg.Type == "graceful-termination" {
+		transp.st.recordTerminationNotice(msg)
+	}
+	transp.Transport.Send(msg)
+}
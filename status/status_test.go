@@ -0,0 +1,222 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+	taskcluster "github.com/taskcluster/taskcluster/clients/client-go/v24"
+)
+
+type fakeWorker struct{}
+
+func (fakeWorker) PID() int {
+	return 1234
+}
+
+func newStatus(t *testing.T, token string) *Status {
+	st, err := New(&cfg.RunnerConfig{
+		Status: cfg.StatusConfig{Listen: "127.0.0.1:0", Token: token},
+	})
+	require.NoError(t, err)
+	return st
+}
+
+func getStatus(t *testing.T, client *http.Client, url string) Response {
+	res, err := client.Get(url)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	var resp Response
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+	return resp
+}
+
+func postTermination(t *testing.T, url, token string) int {
+	req, err := http.NewRequest("POST", url, nil)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestStatus(t *testing.T) {
+	st := newStatus(t, "")
+	defer st.Close()
+	url := "http://" + st.Addr().String() + "/status"
+
+	resp := getStatus(t, http.DefaultClient, url)
+	assert.Equal(t, "startup", resp.Phase)
+	assert.Equal(t, []string{}, resp.Capabilities)
+
+	expires := time.Now().Add(time.Hour).Round(time.Second)
+	st.SetPhase("worker-start", &run.State{
+		RootURL: "https://tc.example.com",
+		Credentials: taskcluster.Credentials{
+			ClientID:    "cli",
+			AccessToken: "secret",
+		},
+		CredentialsExpire: expires,
+		WorkerPoolID:      "pp/ww",
+		WorkerGroup:       "wg",
+		WorkerID:          "wi",
+		WorkerLocation:    map[string]string{"cloud": "here"},
+	})
+	st.WorkerStarted(fakeWorker{})
+
+	transp := protocol.NewFakeTransport()
+	proto := protocol.NewProtocol(st.WrapTransport(transp))
+	proto.Capabilities.Add("graceful-termination")
+	st.SetProtocol(proto)
+	proto.SetInitialized()
+
+	// the graceful-termination message is recorded as a termination notice
+	proto.Send(protocol.Message{
+		Type:       "graceful-termination",
+		Properties: map[string]interface{}{"finish-tasks": false},
+	})
+	assert.Equal(t, 1, len(transp.Messages()))
+
+	// wait for the capabilities to be updated
+	for len(st.Get().Capabilities) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	resp = getStatus(t, http.DefaultClient, url)
+	assert.Equal(t, "worker-start", resp.Phase)
+	assert.Equal(t, "https://tc.example.com", resp.RootURL)
+	assert.Equal(t, "cli", resp.ClientID)
+	assert.True(t, expires.Equal(*resp.CredentialsExpire))
+	assert.Equal(t, "pp/ww", resp.WorkerPoolID)
+	assert.Equal(t, "wg", resp.WorkerGroup)
+	assert.Equal(t, "wi", resp.WorkerID)
+	assert.Equal(t, map[string]string{"cloud": "here"}, resp.WorkerLocation)
+	assert.Equal(t, []string{"graceful-termination"}, resp.Capabilities)
+	assert.Equal(t, 1234, resp.WorkerPID)
+	assert.NotNil(t, resp.WorkerStarted)
+	assert.Equal(t, 1, len(resp.TerminationNotices))
+	assert.False(t, resp.TerminationNotices[0].FinishTasks)
+}
+
+func TestNoCredentials(t *testing.T) {
+	st := newStatus(t, "")
+	defer st.Close()
+
+	st.SetPhase("provider", &run.State{
+		Credentials: taskcluster.Credentials{
+			ClientID:    "cli",
+			AccessToken: "secret-token",
+			Certificate: "secret-cert",
+		},
+	})
+
+	res, err := http.Get("http://" + st.Addr().String() + "/status")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var body map[string]interface{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	encoded, err := json.Marshal(body)
+	require.NoError(t, err)
+	assert.NotContains(t, string(encoded), "secret")
+}
+
+func TestGracefulTermination(t *testing.T) {
+	st := newStatus(t, "sekrit")
+	defer st.Close()
+	url := "http://" + st.Addr().String() + "/graceful-termination"
+
+	// the worker has not started yet
+	assert.Equal(t, http.StatusServiceUnavailable, postTermination(t, url, "sekrit"))
+
+	transp := protocol.NewFakeTransport()
+	proto := protocol.NewProtocol(st.WrapTransport(transp))
+	proto.Capabilities.Add("graceful-termination")
+	st.SetProtocol(proto)
+	proto.SetInitialized()
+	for !func() bool {
+		st.mux.Lock()
+		defer st.mux.Unlock()
+		return st.protoInitialized
+	}() {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, postTermination(t, url, ""))
+	assert.Equal(t, http.StatusUnauthorized, postTermination(t, url, "wrong"))
+	assert.Equal(t, []protocol.Message{}, transp.Messages())
+
+	assert.Equal(t, http.StatusAccepted, postTermination(t, url, "sekrit"))
+	assert.Equal(t, http.StatusAccepted, postTermination(t, url+"?finish-tasks=false", "sekrit"))
+	assert.Equal(t, []protocol.Message{
+		{Type: "graceful-termination", Properties: map[string]interface{}{"finish-tasks": true}},
+		{Type: "graceful-termination", Properties: map[string]interface{}{"finish-tasks": false}},
+	}, transp.Messages())
+
+	res, err := http.Get(url)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
+
+func TestGracefulTerminationWithoutToken(t *testing.T) {
+	st := newStatus(t, "")
+	defer st.Close()
+
+	url := "http://" + st.Addr().String() + "/graceful-termination"
+	assert.Equal(t, http.StatusUnauthorized, postTermination(t, url, ""))
+}
+
+func TestNotLoopback(t *testing.T) {
+	_, err := New(&cfg.RunnerConfig{
+		Status: cfg.StatusConfig{Listen: "0.0.0.0:0"},
+	})
+	require.Error(t, err)
+}
+
+func TestDisabled(t *testing.T) {
+	st, err := New(&cfg.RunnerConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, st.Addr())
+	assert.NoError(t, st.Close())
+}
+
+func TestUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets are not supported on all Windows versions")
+	}
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	path := filepath.Join(dir, "status.sock")
+
+	st, err := New(&cfg.RunnerConfig{
+		Status: cfg.StatusConfig{Listen: "unix:" + path},
+	})
+	require.NoError(t, err)
+	defer st.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("unix", path)
+			},
+		},
+	}
+	resp := getStatus(t, client, "http://status/status")
+	assert.Equal(t, "startup", resp.Phase)
+}
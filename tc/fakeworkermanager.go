@@ -10,8 +10,17 @@ import (
 
 var (
 	wmRegistrations []*tcworkermanager.RegisterWorkerRequest
+	wmRemovals      []FakeWorkerManagerRemoval
+	wmErrorReports  []*tcworkermanager.WorkerErrorReport
 )
 
+// A call to RemoveWorker, as recorded by the fake
+type FakeWorkerManagerRemoval struct {
+	WorkerPoolID string
+	WorkerGroup  string
+	WorkerID     string
+}
+
 type FakeWorkerManager struct {
 	authenticated bool
 }
@@ -33,9 +42,37 @@ func (wm *FakeWorkerManager) RegisterWorker(payload *tcworkermanager.RegisterWor
 	}, nil
 }
 
+func (wm *FakeWorkerManager) RemoveWorker(workerPoolID, workerGroup, workerID string) error {
+	if !wm.authenticated {
+		return fmt.Errorf("must use an authenticated client to remove a worker")
+	}
+
+	wmRemovals = append(wmRemovals, FakeWorkerManagerRemoval{workerPoolID, workerGroup, workerID})
+
+	return nil
+}
+
+func (wm *FakeWorkerManager) ReportWorkerError(workerPoolID string, payload *tcworkermanager.WorkerErrorReport) (*tcworkermanager.WorkerPoolError, error) {
+	if !wm.authenticated {
+		return nil, fmt.Errorf("must use an authenticated client to report an error")
+	}
+
+	wmErrorReports = append(wmErrorReports, payload)
+
+	return &tcworkermanager.WorkerPoolError{
+		Description: payload.Description,
+		Extra:       payload.Extra,
+		Kind:        payload.Kind,
+		Title:       payload.Title,
+	}, nil
+}
+
 // Get the single registration that has occurred, or an error if there are not
 // exactly one.  This resets the list of registrations in the process.
 func FakeWorkerManagerRegistration() (*tcworkermanager.RegisterWorkerRequest, error) {
+	defer func() {
+		wmRegistrations = nil
+	}()
 	if len(wmRegistrations) == 0 {
 		return nil, fmt.Errorf("No registerWorker calls")
 	} else if len(wmRegistrations) == 1 {
@@ -45,6 +82,20 @@ func FakeWorkerManagerRegistration() (*tcworkermanager.RegisterWorkerRequest, er
 	}
 }
 
+// Get the removeWorker calls that have occurred, resetting the list in the process.
+func FakeWorkerManagerRemovals() []FakeWorkerManagerRemoval {
+	rv := wmRemovals
+	wmRemovals = nil
+	return rv
+}
+
+// Get the reportWorkerError calls that have occurred, resetting the list in the process.
+func FakeWorkerManagerErrorReports() []*tcworkermanager.WorkerErrorReport {
+	rv := wmErrorReports
+	wmErrorReports = nil
+	return rv
+}
+
 // A function matching WorkerManagerClientFactory that can be used in testing
 func FakeWorkerManagerClientFactory(rootURL string, credentials *tcclient.Credentials) (WorkerManager, error) {
 	return &FakeWorkerManager{authenticated: credentials != nil}, nil
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	tcclient "github.com/taskcluster/taskcluster/clients/client-go/v24"
 	"github.com/taskcluster/taskcluster/clients/client-go/v24/tcworkermanager"
 )
 
@@ -21,3 +22,39 @@ func TestWorkerManagerRegisterWorker(t *testing.T) {
 		assert.Equal(t, "testing", reg.Credentials.ClientID)
 	}
 }
+
+func TestWorkerManagerRemoveWorker(t *testing.T) {
+	wm, _ := FakeWorkerManagerClientFactory("https://tc.example.com", nil)
+	err := wm.RemoveWorker("w/p", "wg", "wid")
+	assert.Error(t, err, "unauthenticated client should fail")
+
+	wm, _ = FakeWorkerManagerClientFactory("https://tc.example.com", &tcclient.Credentials{})
+	err = wm.RemoveWorker("w/p", "wg", "wid")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []FakeWorkerManagerRemoval{{"w/p", "wg", "wid"}}, FakeWorkerManagerRemovals())
+		assert.Equal(t, 0, len(FakeWorkerManagerRemovals()))
+	}
+}
+
+func TestWorkerManagerReportWorkerError(t *testing.T) {
+	report := &tcworkermanager.WorkerErrorReport{
+		Description: "it broke",
+		Extra:       json.RawMessage(`{}`),
+		Kind:        "oops",
+		Title:       "Oops",
+		WorkerGroup: "wg",
+		WorkerID:    "wid",
+	}
+
+	wm, _ := FakeWorkerManagerClientFactory("https://tc.example.com", nil)
+	_, err := wm.ReportWorkerError("w/p", report)
+	assert.Error(t, err, "unauthenticated client should fail")
+
+	wm, _ = FakeWorkerManagerClientFactory("https://tc.example.com", &tcclient.Credentials{})
+	wpe, err := wm.ReportWorkerError("w/p", report)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "oops", wpe.Kind)
+		assert.Equal(t, []*tcworkermanager.WorkerErrorReport{report}, FakeWorkerManagerErrorReports())
+		assert.Equal(t, 0, len(FakeWorkerManagerErrorReports()))
+	}
+}
@@ -9,6 +9,8 @@ import (
 // use of fakes that also match this interface.
 type WorkerManager interface {
 	RegisterWorker(payload *tcworkermanager.RegisterWorkerRequest) (*tcworkermanager.RegisterWorkerResponse, error)
+	RemoveWorker(workerPoolID, workerGroup, workerID string) error
+	ReportWorkerError(workerPoolID string, payload *tcworkermanager.WorkerErrorReport) (*tcworkermanager.WorkerPoolError, error)
 }
 
 // A factory type that can create new instances of the WorkerManager interface.
@@ -0,0 +1,194 @@
+package watchdog
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+)
+
+// The default number of heartbeats the worker may miss before the watchdog
+// acts
+const defaultMaxMissedHeartbeats = 3
+
+// Killer is the part of worker.Worker that the watchdog uses to stop a hung
+// worker
+type Killer interface {
+	Kill() error
+}
+
+// An object to watch for heartbeat messages from the worker, first asking the
+// worker to terminate gracefully and then killing it if those heartbeats stop.
+type Watchdog struct {
+	interval  time.Duration
+	maxMissed int
+	killer    Killer
+
+	// the protocol (set in SetProtocol)
+	proto *protocol.Protocol
+
+	// protects the remaining fields, which are accessed from timer and
+	// protocol goroutines
+	mux sync.Mutex
+
+	// a timer that fires when too many heartbeats have been missed, or when
+	// the worker has failed to exit after graceful-termination
+	timer *time.Timer
+
+	// true between WorkerStarted and WorkerFinished
+	running bool
+
+	// the reason the watchdog acted, if it has
+	reason string
+}
+
+func New(runnercfg *cfg.RunnerConfig, killer Killer) *Watchdog {
+	maxMissed := runnercfg.MaxMissedHeartbeats
+	if maxMissed <= 0 {
+		maxMissed = defaultMaxMissedHeartbeats
+	}
+	return new(time.Duration(runnercfg.HeartbeatInterval)*time.Second, maxMissed, killer)
+}
+
+// New takes its interval directly, allowing tests to use short durations.
+func new(interval time.Duration, maxMissed int, killer Killer) *Watchdog {
+	return &Watchdog{interval: interval, maxMissed: maxMissed, killer: killer}
+}
+
+// The time after which the watchdog acts
+func (wd *Watchdog) timeout() time.Duration {
+	return wd.interval * time.Duration(wd.maxMissed)
+}
+
+func (wd *Watchdog) SetProtocol(proto *protocol.Protocol) {
+	wd.proto = proto
+	if wd.interval > 0 {
+		proto.Register("heartbeat", func(msg protocol.Message) { wd.heartbeat() })
+		// tell the worker how often to send heartbeats
+		if seconds := int(wd.interval / time.Second); seconds > 0 {
+			proto.LocalCapabilities.SetParameter("heartbeat", "interval", seconds)
+		}
+	}
+}
+
+func (wd *Watchdog) WorkerStarted() error {
+	if wd.interval <= 0 {
+		return nil
+	}
+
+	// start the timer immediately, so that a worker which hangs before
+	// completing capability negotiation is also stopped
+	wd.mux.Lock()
+	wd.running = true
+	wd.timer = time.AfterFunc(wd.timeout(), wd.missedHeartbeats)
+	wd.mux.Unlock()
+
+	// workers without the heartbeat capability are not watched, and that is
+	// not known until the protocol is initialized
+	go func() {
+		if wd.proto.Capable("heartbeat") {
+			return
+		}
+
+		wd.mux.Lock()
+		defer wd.mux.Unlock()
+		if wd.reason != "" {
+			return
+		}
+		if wd.timer != nil {
+			wd.timer.Stop()
+			wd.timer = nil
+		}
+	}()
+	return nil
+}
+
+func (wd *Watchdog) WorkerFinished() error {
+	wd.mux.Lock()
+	defer wd.mux.Unlock()
+
+	wd.running = false
+	if wd.timer != nil {
+		wd.timer.Stop()
+		wd.timer = nil
+	}
+	return nil
+}
+
+// Get the reason the watchdog acted, or an empty string if it did not.  This
+// is suitable for inclusion in the worker's exit error.
+func (wd *Watchdog) Reason() string {
+	wd.mux.Lock()
+	defer wd.mux.Unlock()
+	return wd.reason
+}
+
+// The worker has sent a heartbeat, so reset the timer, unless the watchdog has
+// already acted
+func (wd *Watchdog) heartbeat() {
+	wd.mux.Lock()
+	defer wd.mux.Unlock()
+
+	if !wd.running || wd.reason != "" {
+		return
+	}
+	if wd.timer != nil {
+		wd.timer.Stop()
+	}
+	wd.timer = time.AfterFunc(wd.timeout(), wd.missedHeartbeats)
+}
+
+func (wd *Watchdog) missedHeartbeats() {
+	wd.mux.Lock()
+	if !wd.running || wd.reason != "" {
+		wd.mux.Unlock()
+		return
+	}
+
+	initialized := wd.proto.IsInitialized()
+	if initialized && !wd.proto.Capabilities.Has("heartbeat") {
+		// the worker is not watched
+		wd.mux.Unlock()
+		return
+	}
+
+	if initialized {
+		wd.reason = fmt.Sprintf("worker missed %d heartbeats (no heartbeat in %s)", wd.maxMissed, wd.timeout())
+	} else {
+		wd.reason = fmt.Sprintf("worker did not complete capability negotiation within %s", wd.timeout())
+	}
+	log.Printf("Watchdog: %s; stopping worker", wd.reason)
+
+	// give the worker the same amount of time again to exit on its own
+	wd.timer = time.AfterFunc(wd.timeout(), wd.kill)
+	wd.mux.Unlock()
+
+	if initialized && wd.proto.Capabilities.Has("graceful-termination") {
+		wd.proto.Send(protocol.Message{
+			Type: "graceful-termination",
+			Properties: map[string]interface{}{
+				// the worker is probably hung, so do not wait for tasks
+				"finish-tasks": false,
+			},
+		})
+	}
+}
+
+func (wd *Watchdog) kill() {
+	wd.mux.Lock()
+	if !wd.running {
+		wd.mux.Unlock()
+		return
+	}
+	wd.reason = fmt.Sprintf("%s, and was killed after failing to exit within %s", wd.reason, wd.timeout())
+	log.Printf("Watchdog: killing worker")
+	wd.mux.Unlock()
+
+	err := wd.killer.Kill()
+	if err != nil {
+		log.Printf("Watchdog: error killing worker: %s", err)
+	}
+}
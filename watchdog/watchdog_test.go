@@ -0,0 +1,178 @@
+package watchdog
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+)
+
+type fakeKiller struct {
+	mux    sync.Mutex
+	killed bool
+}
+
+func (k *fakeKiller) Kill() error {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.killed = true
+	return nil
+}
+
+func (k *fakeKiller) Killed() bool {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	return k.killed
+}
+
+func setup(wd *Watchdog, caps ...string) *protocol.FakeTransport {
+	transp := protocol.NewFakeTransport()
+	proto := protocol.NewProtocol(transp)
+	for _, c := range caps {
+		proto.Capabilities.Add(c)
+	}
+	proto.SetInitialized()
+
+	wd.SetProtocol(proto)
+	return transp
+}
+
+var gracefulTermination = protocol.Message{
+	Type: "graceful-termination",
+	Properties: map[string]interface{}{
+		"finish-tasks": false,
+	},
+}
+
+func TestNew(t *testing.T) {
+	wd := New(&cfg.RunnerConfig{HeartbeatInterval: 30}, &fakeKiller{})
+	assert.Equal(t, 30*time.Second, wd.interval)
+	assert.Equal(t, 3, wd.maxMissed)
+
+	wd = New(&cfg.RunnerConfig{HeartbeatInterval: 30, MaxMissedHeartbeats: 5}, &fakeKiller{})
+	assert.Equal(t, 5, wd.maxMissed)
+}
+
+func TestIntervalParameter(t *testing.T) {
+	wd := new(30*time.Second, 3, &fakeKiller{})
+	proto := protocol.NewProtocol(protocol.NewFakeTransport())
+	wd.SetProtocol(proto)
+
+	interval, ok := proto.LocalCapabilities.Parameter("heartbeat", "interval")
+	assert.True(t, ok)
+	assert.Equal(t, 30, interval)
+}
+
+func TestHeartbeatsKeepWorkerAlive(t *testing.T) {
+	killer := &fakeKiller{}
+	wd := new(20*time.Millisecond, 3, killer)
+	transp := setup(wd, "graceful-termination", "heartbeat")
+
+	require.NoError(t, wd.WorkerStarted())
+	for i := 0; i < 10; i++ {
+		time.Sleep(20 * time.Millisecond)
+		wd.heartbeat()
+	}
+	require.NoError(t, wd.WorkerFinished())
+
+	assert.Equal(t, []protocol.Message{}, transp.Messages())
+	assert.False(t, killer.Killed())
+	assert.Equal(t, "", wd.Reason())
+}
+
+func TestMissedHeartbeats(t *testing.T) {
+	killer := &fakeKiller{}
+	wd := new(10*time.Millisecond, 3, killer)
+	transp := setup(wd, "graceful-termination", "heartbeat")
+
+	require.NoError(t, wd.WorkerStarted())
+	wd.heartbeat()
+
+	// wait for the graceful-termination message
+	for len(transp.Messages()) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, []protocol.Message{gracefulTermination}, transp.Messages())
+	assert.Equal(t, "worker missed 3 heartbeats (no heartbeat in 30ms)", wd.Reason())
+
+	// heartbeats no longer help
+	wd.heartbeat()
+
+	// and then for the worker to be killed
+	for !killer.Killed() {
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.NoError(t, wd.WorkerFinished())
+
+	assert.True(t, strings.Contains(wd.Reason(), "was killed"), wd.Reason())
+	assert.Equal(t, []protocol.Message{gracefulTermination}, transp.Messages())
+}
+
+func TestExitAfterGracefulTermination(t *testing.T) {
+	killer := &fakeKiller{}
+	wd := new(10*time.Millisecond, 2, killer)
+	transp := setup(wd, "graceful-termination", "heartbeat")
+
+	require.NoError(t, wd.WorkerStarted())
+	for len(transp.Messages()) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the worker exits in response to graceful-termination
+	require.NoError(t, wd.WorkerFinished())
+	time.Sleep(50 * time.Millisecond)
+
+	assert.False(t, killer.Killed())
+	assert.Equal(t, "worker missed 2 heartbeats (no heartbeat in 20ms)", wd.Reason())
+}
+
+func TestNoHeartbeatCapability(t *testing.T) {
+	killer := &fakeKiller{}
+	wd := new(10*time.Millisecond, 1, killer)
+	transp := setup(wd, "graceful-termination")
+
+	require.NoError(t, wd.WorkerStarted())
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, wd.WorkerFinished())
+
+	assert.Equal(t, []protocol.Message{}, transp.Messages())
+	assert.False(t, killer.Killed())
+	assert.Equal(t, "", wd.Reason())
+}
+
+func TestNoCapabilityNegotiation(t *testing.T) {
+	killer := &fakeKiller{}
+	wd := new(10*time.Millisecond, 2, killer)
+
+	// the worker never sends hello
+	transp := protocol.NewFakeTransport()
+	wd.SetProtocol(protocol.NewProtocol(transp))
+
+	require.NoError(t, wd.WorkerStarted())
+	for !killer.Killed() {
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.NoError(t, wd.WorkerFinished())
+
+	assert.True(t, strings.Contains(wd.Reason(), "did not complete capability negotiation within 20ms"), wd.Reason())
+	// graceful-termination cannot be sent before negotiation
+	assert.Equal(t, []protocol.Message{}, transp.Messages())
+}
+
+func TestDisabled(t *testing.T) {
+	killer := &fakeKiller{}
+	wd := new(0, 3, killer)
+	transp := setup(wd, "graceful-termination", "heartbeat")
+
+	require.NoError(t, wd.WorkerStarted())
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, wd.WorkerFinished())
+
+	assert.Equal(t, []protocol.Message{}, transp.Messages())
+	assert.False(t, killer.Killed())
+}
@@ -17,14 +17,31 @@ import (
 )
 
 type dockerworkerConfig struct {
-	Path       string
-	ConfigPath string
+	Path         string
+	ConfigPath   string
+	ConfigFormat string `workerimpl:",optional"`
+	// pass run state to the worker in environment variables
+	StateEnv bool `workerimpl:",optional"`
+	// not supported, as the worker only reads credentials from its config
+	// file; this is present to give a clear error
+	OmitCredentials bool `workerimpl:",optional"`
+	// run the worker as this user
+	RunAs map[string]interface{} `workerimpl:",optional"`
+	// limit the resources available to the worker
+	Resources map[string]interface{} `workerimpl:",optional"`
+	// options for sending protocol messages to the worker
+	Transport map[string]interface{} `workerimpl:",optional"`
 }
 
 type dockerworker struct {
 	runnercfg *cfg.RunnerConfig
 	wicfg     dockerworkerConfig
 	cmd       *exec.Cmd
+	transp    *protocol.StdioTransport
+	runAs     *worker.RunAs
+	resources *worker.Resources
+
+	transportOptions protocol.StdioTransportOptions
 }
 
 func (d *dockerworker) ConfigureRun(state *run.State) error {
@@ -95,7 +112,7 @@ func (d *dockerworker) UseCachedRun(state *run.State) error {
 
 func (d *dockerworker) StartWorker(state *run.State) (protocol.Transport, error) {
 	// write out the config file
-	content, err := json.MarshalIndent(state.WorkerConfig, "", "  ")
+	content, err := state.WorkerConfig.Encode(d.wicfg.ConfigFormat)
 	if err != nil {
 		return nil, fmt.Errorf("Error constructing worker config: %v", err)
 	}
@@ -104,7 +121,14 @@ func (d *dockerworker) StartWorker(state *run.State) (protocol.Transport, error)
 		return nil, fmt.Errorf("Error writing worker config to %s: %v", d.wicfg.ConfigPath, err)
 	}
 
-	transp := protocol.NewStdioTransport()
+	if d.runAs != nil {
+		err = d.runAs.ChownFiles(d.wicfg.ConfigPath, state.Files)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	transp := protocol.NewStdioTransportWithOptions(d.transportOptions)
 
 	// the --host taskcluster-worker-runner instructs docker-worker to merge
 	// config from $DOCKER_WORKER_CONFIG.
@@ -112,28 +136,40 @@ func (d *dockerworker) StartWorker(state *run.State) (protocol.Transport, error)
 	cmd := exec.Command("node", mainJs, "--host", "taskcluster-worker-runner", "production")
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, "DOCKER_WORKER_CONFIG="+d.wicfg.ConfigPath)
+	if d.wicfg.StateEnv {
+		env, err := worker.StateEnv(state)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Env = append(cmd.Env, env...)
+	}
 	cmd.Stdout = transp
 	cmd.Stderr = os.Stderr
+	if d.runAs != nil {
+		d.runAs.Apply(cmd)
+	}
 	d.cmd = cmd
+	d.transp = transp
 
 	// Unfortunately, cmd.Wait does not handle the case where cmd.Stdin is a writer that remains
-	// open when the process exits.  Instead, we set up our own copy loop.  This loop in fact
-	// runs forever, but for a single-use process like this, that's OK.
+	// open when the process exits.  Instead, we set up our own copy loop, which finishes when
+	// Wait closes the outgoing side of the transport.
 	pipe, err := cmd.StdinPipe()
 	if err != nil {
 		return nil, err
 	}
 	go func() {
-		_, err = io.Copy(pipe, transp)
+		_, err := io.Copy(pipe, transp)
 		if err != nil {
 			// this can occur when the worker exits while we are trying to send a
 			// message to it, so we will consider the message lost and shut down
 			// as usual.
 			log.Printf("Error writing to worker process (ignored): %#v", err)
 		}
+		pipe.Close()
 	}()
 
-	err = cmd.Start()
+	err = d.resources.Start(cmd)
 	if err != nil {
 		return nil, err
 	}
@@ -145,15 +181,49 @@ func (d *dockerworker) SetProtocol(proto *protocol.Protocol) {
 }
 
 func (d *dockerworker) Wait() error {
-	return d.cmd.Wait()
+	err := d.resources.WaitError(d.cmd.Wait())
+	// nothing more can be sent to the worker
+	d.transp.CloseOut()
+	return err
+}
+
+func (d *dockerworker) Kill() error {
+	return d.cmd.Process.Kill()
+}
+
+func (d *dockerworker) PID() int {
+	return d.cmd.Process.Pid
+}
+
+func (d *dockerworker) ExitCode() int {
+	return d.cmd.ProcessState.ExitCode()
 }
 
 func New(runnercfg *cfg.RunnerConfig) (worker.Worker, error) {
-	rv := dockerworker{runnercfg, dockerworkerConfig{}, nil}
+	rv := dockerworker{runnercfg, dockerworkerConfig{}, nil, nil, nil, nil, protocol.StdioTransportOptions{}}
 	err := runnercfg.WorkerImplementation.Unpack(&rv.wicfg)
 	if err != nil {
 		return nil, err
 	}
+	err = cfg.ValidateWorkerConfigFormat(rv.wicfg.ConfigFormat)
+	if err != nil {
+		return nil, err
+	}
+	if rv.wicfg.OmitCredentials {
+		return nil, fmt.Errorf("worker.omitCredentials is not supported by docker-worker, which only reads credentials from its configuration file")
+	}
+	rv.runAs, err = worker.ParseRunAs(rv.wicfg.RunAs)
+	if err != nil {
+		return nil, err
+	}
+	rv.resources, err = worker.ParseResources(rv.wicfg.Resources)
+	if err != nil {
+		return nil, err
+	}
+	rv.transportOptions, err = worker.ParseTransport(rv.wicfg.Transport)
+	if err != nil {
+		return nil, err
+	}
 	return &rv, nil
 }
 
@@ -172,6 +242,56 @@ worker:
     # path where taskcluster-worker-runner should write the generated
     # docker-worker configuration.
     configPath: ..
+    # (optional) format of the generated configuration: json (default),
+    # yaml, toml, or dotenv
+    configFormat: json
+    # (optional) if true, pass the run state to docker-worker in
+    # environment variables (see below)
+    stateEnv: false
+    # (optional, Linux and macOS only) run the worker as this user, giving it
+    # ownership of the generated configuration and any extracted files
+    runAs:
+        user: worker
+        # (optional) defaults to the user's primary group
+        group: worker
+        # (optional) supplementary groups
+        groups: [docker]
+    # (optional, Linux only) limit the memory, CPU, and number of processes
+    # available to the worker and its descendants, using a cgroup v2 subtree;
+    # values are written to memory.max, cpu.max, and pids.max, respectively;
+    # requires a delegated cgroup (see below)
+    resources:
+        memoryMax: 8G
+        cpuMax: 200000 100000
+        pidsMax: 4096
+    # (optional) how start-worker queues protocol messages while the
+    # worker is not reading them (see below)
+    transport:
+        queueSize: 5
+        overflow: drop-oldest
+        sendTimeout: 30
 ` + "```" + `
+
+With 'stateEnv', the worker process receives the environment variables
+TASKCLUSTER_ROOT_URL, TASKCLUSTER_CLIENT_ID, TASKCLUSTER_ACCESS_TOKEN,
+TASKCLUSTER_CERTIFICATE (for temporary credentials),
+TASKCLUSTER_WORKER_POOL_ID, TASKCLUSTER_WORKER_GROUP, TASKCLUSTER_WORKER_ID,
+and TASKCLUSTER_WORKER_LOCATION (a JSON object), for use by wrapper scripts.
+docker-worker itself only reads its credentials from the configuration file,
+so 'omitCredentials' is not supported.
+
+The 'resources' option requires start-worker to be the only process in a cgroup
+delegated to it, such as a systemd service with 'Delegate=yes'.  See
+[linux-services](./docs/linux-services.md) for details.
+
+The 'transport' option configures the queue of protocol messages sent to the
+worker.  'queueSize' is the number of messages queued while the worker is not
+reading its input (default 5).  'overflow' is what happens when the queue is
+full: 'drop-oldest' (the default) drops the oldest queued message, except that
+'welcome' and 'graceful-termination' messages are only dropped while the same
+message is still queued; 'block' waits for room; and 'error' drops the new
+message.  'sendTimeout' is the longest, in seconds, to wait for room, after
+which the message is dropped; by default, sending waits until the worker
+exits.
 `
 }
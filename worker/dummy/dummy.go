@@ -40,6 +40,10 @@ func (d *dummy) Wait() error {
 	return nil
 }
 
+func (d *dummy) Kill() error {
+	return nil
+}
+
 func New(runnercfg *cfg.RunnerConfig) (worker.Worker, error) {
 	return &dummy{runnercfg}, nil
 }
@@ -0,0 +1,375 @@
+package execworker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+	"github.com/taskcluster/taskcluster-worker-runner/worker/worker"
+)
+
+type execworkerConfig struct {
+	Command      []interface{}
+	ConfigPath   string                 `workerimpl:",optional"`
+	ConfigFormat string                 `workerimpl:",optional"`
+	Env          map[string]interface{} `workerimpl:",optional"`
+	StateConfig  map[string]interface{} `workerimpl:",optional"`
+	// pass run state to the worker in environment variables
+	StateEnv bool `workerimpl:",optional"`
+	// do not write credentials to the config file
+	OmitCredentials bool `workerimpl:",optional"`
+	// run the worker as this user
+	RunAs map[string]interface{} `workerimpl:",optional"`
+	// limit the resources available to the worker
+	Resources map[string]interface{} `workerimpl:",optional"`
+	// options for sending protocol messages to the worker
+	Transport map[string]interface{} `workerimpl:",optional"`
+}
+
+type execworker struct {
+	runnercfg *cfg.RunnerConfig
+	wicfg     execworkerConfig
+	command   []string
+	env       []string
+	cmd       *exec.Cmd
+	transp    *protocol.StdioTransport
+	runAs     *worker.RunAs
+	resources *worker.Resources
+
+	transportOptions protocol.StdioTransportOptions
+}
+
+// Get the value of the named run.State field, returning false if it is not
+// set.  Individual provider metadata values are named `providerMetadata.<key>`.
+func stateValue(state *run.State, field string) (interface{}, bool, error) {
+	if strings.HasPrefix(field, "providerMetadata.") {
+		v, ok := state.ProviderMetadata[strings.TrimPrefix(field, "providerMetadata.")]
+		return v, ok, nil
+	}
+
+	var v interface{}
+	switch field {
+	case "rootURL":
+		v = state.RootURL
+	case "clientID":
+		v = state.Credentials.ClientID
+	case "accessToken":
+		v = state.Credentials.AccessToken
+	case "certificate":
+		v = state.Credentials.Certificate
+	case "workerPoolID":
+		v = state.WorkerPoolID
+	case "provisionerID", "workerType":
+		split := strings.SplitN(state.WorkerPoolID, "/", 2)
+		if len(split) != 2 {
+			return nil, false, fmt.Errorf("Invalid workerPoolID %s", state.WorkerPoolID)
+		}
+		if field == "provisionerID" {
+			v = split[0]
+		} else {
+			v = split[1]
+		}
+	case "workerGroup":
+		v = state.WorkerGroup
+	case "workerID":
+		v = state.WorkerID
+	case "workerLocation":
+		if len(state.WorkerLocation) == 0 {
+			return nil, false, nil
+		}
+		v = state.WorkerLocation
+	case "providerMetadata":
+		if len(state.ProviderMetadata) == 0 {
+			return nil, false, nil
+		}
+		v = state.ProviderMetadata
+	default:
+		return nil, false, fmt.Errorf("Unknown run state field %s", field)
+	}
+
+	if s, ok := v.(string); ok && s == "" {
+		return nil, false, nil
+	}
+	return v, true, nil
+}
+
+func (d *execworker) ConfigureRun(state *run.State) error {
+	// apply in a consistent order, so that overlapping paths behave predictably
+	paths := make([]string, 0, len(d.wicfg.StateConfig))
+	for path := range d.wicfg.StateConfig {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		field, ok := d.wicfg.StateConfig[path].(string)
+		if !ok {
+			return fmt.Errorf("worker.stateConfig value for %s must be a string", path)
+		}
+
+		if d.wicfg.OmitCredentials && (field == "clientID" || field == "accessToken" || field == "certificate") {
+			log.Printf("worker.omitCredentials is set; not setting config %s", path)
+			continue
+		}
+
+		v, ok, err := stateValue(state, field)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			log.Printf("run state %s not available; not setting config %s", field, path)
+			continue
+		}
+
+		state.WorkerConfig, err = state.WorkerConfig.Set(path, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *execworker) UseCachedRun(state *run.State) error {
+	return nil
+}
+
+func (d *execworker) StartWorker(state *run.State) (protocol.Transport, error) {
+	// write out the config file
+	if d.wicfg.ConfigPath != "" {
+		content, err := state.WorkerConfig.Encode(d.wicfg.ConfigFormat)
+		if err != nil {
+			return nil, fmt.Errorf("Error constructing worker config: %v", err)
+		}
+		err = ioutil.WriteFile(d.wicfg.ConfigPath, content, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("Error writing worker config to %s: %v", d.wicfg.ConfigPath, err)
+		}
+	}
+
+	if d.runAs != nil {
+		err := d.runAs.ChownFiles(d.wicfg.ConfigPath, state.Files)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	transp := protocol.NewStdioTransportWithOptions(d.transportOptions)
+
+	cmd := exec.Command(d.command[0], d.command[1:]...)
+	cmd.Env = append(os.Environ(), d.env...)
+	if d.wicfg.StateEnv {
+		env, err := worker.StateEnv(state)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Env = append(cmd.Env, env...)
+	}
+	cmd.Stdout = transp
+	cmd.Stderr = os.Stderr
+	if d.runAs != nil {
+		d.runAs.Apply(cmd)
+	}
+	d.cmd = cmd
+	d.transp = transp
+
+	// Unfortunately, cmd.Wait does not handle the case where cmd.Stdin is a writer that remains
+	// open when the process exits.  Instead, we set up our own copy loop, which finishes when
+	// Wait closes the outgoing side of the transport.
+	pipe, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		_, err := io.Copy(pipe, transp)
+		if err != nil {
+			// this can occur when the worker exits while we are trying to send a
+			// message to it, so we will consider the message lost and shut down
+			// as usual.
+			log.Printf("Error writing to worker process (ignored): %#v", err)
+		}
+		pipe.Close()
+	}()
+
+	err = d.resources.Start(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return transp, nil
+}
+
+func (d *execworker) SetProtocol(proto *protocol.Protocol) {
+}
+
+func (d *execworker) Wait() error {
+	err := d.resources.WaitError(d.cmd.Wait())
+	// nothing more can be sent to the worker
+	d.transp.CloseOut()
+	return err
+}
+
+func (d *execworker) Kill() error {
+	return d.cmd.Process.Kill()
+}
+
+func (d *execworker) PID() int {
+	return d.cmd.Process.Pid
+}
+
+func (d *execworker) ExitCode() int {
+	return d.cmd.ProcessState.ExitCode()
+}
+
+func New(runnercfg *cfg.RunnerConfig) (worker.Worker, error) {
+	rv := execworker{runnercfg, execworkerConfig{}, nil, nil, nil, nil, nil, nil, protocol.StdioTransportOptions{}}
+	err := runnercfg.WorkerImplementation.Unpack(&rv.wicfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rv.wicfg.Command) == 0 {
+		return nil, fmt.Errorf("worker.command must not be empty")
+	}
+	for _, arg := range rv.wicfg.Command {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("worker.command must be a list of strings")
+		}
+		rv.command = append(rv.command, s)
+	}
+
+	for name, value := range rv.wicfg.Env {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("worker.env value %s must be a string", name)
+		}
+		rv.env = append(rv.env, name+"="+s)
+	}
+	sort.Strings(rv.env)
+
+	err = cfg.ValidateWorkerConfigFormat(rv.wicfg.ConfigFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	err = worker.CheckOmitCredentials(runnercfg, rv.wicfg.StateEnv, rv.wicfg.OmitCredentials)
+	if err != nil {
+		return nil, err
+	}
+
+	rv.runAs, err = worker.ParseRunAs(rv.wicfg.RunAs)
+	if err != nil {
+		return nil, err
+	}
+	rv.resources, err = worker.ParseResources(rv.wicfg.Resources)
+	if err != nil {
+		return nil, err
+	}
+	rv.transportOptions, err = worker.ParseTransport(rv.wicfg.Transport)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rv, nil
+}
+
+func Usage() string {
+	return `
+
+The "exec" worker implementation starts an arbitrary executable, making it
+possible to run new or in-house workers without changes to worker-runner.  The
+worker must speak the worker-runner protocol on its stdin and stdout.  It
+takes the following values in the 'worker' section of the runner
+configuration:
+
+` + "```yaml" + `
+worker:
+    implementation: exec
+    # command line to run the worker, including any arguments
+    command: [/usr/local/bin/my-worker, --config, /etc/my-worker/config.json]
+    # (optional) path where taskcluster-worker-runner should write the
+    # generated worker configuration; if omitted, no file is written
+    configPath: /etc/my-worker/config.json
+    # (optional) format of the configuration file: json (default), yaml,
+    # toml, or dotenv
+    configFormat: json
+    # (optional) additional environment variables for the worker
+    env:
+        MY_WORKER_LOG_LEVEL: debug
+    # (optional) values from the run state to set in the worker
+    # configuration, keyed by (dotted) configuration path
+    stateConfig:
+        rootUrl: rootURL
+        credentials.clientId: clientID
+        credentials.accessToken: accessToken
+        credentials.certificate: certificate
+        workerId: workerID
+        publicIp: providerMetadata.public-ipv4
+    # (optional) if true, pass the run state to the worker in environment
+    # variables (see below)
+    stateEnv: false
+    # (optional) if true, do not set credentials in the configuration, even
+    # if stateConfig names them; requires stateEnv
+    omitCredentials: false
+    # (optional, Linux and macOS only) run the worker as this user, giving it
+    # ownership of the generated configuration and any extracted files
+    runAs:
+        user: worker
+        # (optional) defaults to the user's primary group
+        group: worker
+        # (optional) supplementary groups
+        groups: [docker]
+    # (optional, Linux only) limit the memory, CPU, and number of processes
+    # available to the worker and its descendants, using a cgroup v2 subtree;
+    # values are written to memory.max, cpu.max, and pids.max, respectively;
+    # requires a delegated cgroup (see below)
+    resources:
+        memoryMax: 8G
+        cpuMax: 200000 100000
+        pidsMax: 4096
+    # (optional) how start-worker queues protocol messages while the
+    # worker is not reading them (see below)
+    transport:
+        queueSize: 5
+        overflow: drop-oldest
+        sendTimeout: 30
+` + "```" + `
+
+The available run state fields are rootURL, clientID, accessToken,
+certificate, workerPoolID, provisionerID, workerType, workerGroup, workerID,
+workerLocation, providerMetadata, and providerMetadata.<key> for an individual
+provider metadata value.  Fields that are not set, such as an empty
+certificate, are omitted from the configuration.
+
+With 'stateEnv', the worker process receives the environment variables
+TASKCLUSTER_ROOT_URL, TASKCLUSTER_CLIENT_ID, TASKCLUSTER_ACCESS_TOKEN,
+TASKCLUSTER_CERTIFICATE (for temporary credentials),
+TASKCLUSTER_WORKER_POOL_ID, TASKCLUSTER_WORKER_GROUP, TASKCLUSTER_WORKER_ID,
+and TASKCLUSTER_WORKER_LOCATION (a JSON object).  Adding 'omitCredentials'
+ensures that credentials are never written to disk; it cannot be combined with
+'cacheOverRestarts', which stores the credentials in the cache file.
+
+The 'resources' option requires start-worker to be the only process in a cgroup
+delegated to it, such as a systemd service with 'Delegate=yes'.  See
+[linux-services](./docs/linux-services.md) for details.
+
+The 'transport' option configures the queue of protocol messages sent to the
+worker.  'queueSize' is the number of messages queued while the worker is not
+reading its input (default 5).  'overflow' is what happens when the queue is
+full: 'drop-oldest' (the default) drops the oldest queued message, except that
+'welcome' and 'graceful-termination' messages are only dropped while the same
+message is still queued; 'block' waits for room; and 'error' drops the new
+message.  'sendTimeout' is the longest, in seconds, to wait for room, after
+which the message is dropped; by default, sending waits until the worker
+exits.
+`
+}
@@ -0,0 +1,128 @@
+// +build linux darwin
+
+package execworker
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Flaque/filet"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker-runner/files"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+)
+
+func TestRunAs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing user requires root")
+	}
+
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	workerPath := filepath.Join(dir, "fake.exe")
+	configPath := filepath.Join(dir, "config.json")
+	extractedPath := filepath.Join(dir, "extracted")
+	existingPath := filepath.Join(dir, "existing")
+
+	// fake just exits 0
+	require.NoError(t, exec.Command("go", "build", "-o", workerPath, "../genericworker/fake").Run())
+	require.NoError(t, os.Chmod(dir, 0755))
+	require.NoError(t, ioutil.WriteFile(existingPath, []byte("hi"), 0644))
+
+	runnercfg := makeRunnerConfig(t, `
+implementation: exec
+command: ["`+filepath.ToSlash(workerPath)+`"]
+configPath: "`+filepath.ToSlash(configPath)+`"
+runAs:
+  user: "65534"
+  group: "65534"
+`)
+	w, err := New(runnercfg)
+	require.NoError(t, err)
+
+	state := makeState()
+	state.Files = []files.File{{
+		Description: "greeting",
+		Path:        extractedPath,
+		Content:     "SGVsbG8sIFdvcmxk",
+		Encoding:    "base64",
+		Format:      "file",
+	}}
+	require.NoError(t, files.ExtractAll(state.Files))
+	require.NoError(t, w.ConfigureRun(state))
+	_, err = w.StartWorker(state)
+	require.NoError(t, err)
+	require.NoError(t, w.Wait())
+
+	require.Equal(t, uint32(65534), w.(*execworker).cmd.SysProcAttr.Credential.Uid)
+	for _, path := range []string{configPath, extractedPath} {
+		stat, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, uint32(65534), stat.Sys().(*syscall.Stat_t).Uid, path)
+	}
+
+	// files that were not extracted, even in the same directory, keep their
+	// owner
+	stat, err := os.Stat(existingPath)
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), stat.Sys().(*syscall.Stat_t).Uid)
+}
+
+func TestKill(t *testing.T) {
+	runnercfg := makeRunnerConfig(t, `
+implementation: exec
+command: [sleep, "60"]
+`)
+	w, err := New(runnercfg)
+	require.NoError(t, err)
+
+	state := makeState()
+	require.NoError(t, w.ConfigureRun(state))
+	_, err = w.StartWorker(state)
+	require.NoError(t, err)
+
+	require.NoError(t, w.Kill())
+	require.Error(t, w.Wait())
+}
+
+func TestWorkerNeverReads(t *testing.T) {
+	runnercfg := makeRunnerConfig(t, `
+implementation: exec
+command: [sleep, "60"]
+`)
+	w, err := New(runnercfg)
+	require.NoError(t, err)
+
+	state := makeState()
+	require.NoError(t, w.ConfigureRun(state))
+	transp, err := w.StartWorker(state)
+	require.NoError(t, err)
+
+	// send far more than fits in the stdin pipe's buffer; this must not block
+	// even though the worker never reads its stdin
+	big := strings.Repeat("x", 1024)
+	sent := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			transp.Send(protocol.Message{Type: "big", Properties: map[string]interface{}{"data": big}})
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Send blocked")
+	}
+
+	require.NoError(t, w.Kill())
+	require.Error(t, w.Wait())
+
+	// sending after the worker has exited does not block or panic
+	transp.Send(protocol.Message{Type: "late"})
+}
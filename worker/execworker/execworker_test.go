@@ -0,0 +1,208 @@
+package execworker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/Flaque/filet"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+	tcclient "github.com/taskcluster/taskcluster/clients/client-go/v24"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func makeRunnerConfig(t *testing.T, workerYaml string) *cfg.RunnerConfig {
+	var runnercfg cfg.RunnerConfig
+	require.NoError(t, yaml.Unmarshal([]byte(workerYaml), &runnercfg.WorkerImplementation))
+	return &runnercfg
+}
+
+func makeState() *run.State {
+	return &run.State{
+		RootURL: "https://tc.example.com",
+		Credentials: tcclient.Credentials{
+			ClientID:    "cli",
+			AccessToken: "at",
+		},
+		WorkerPoolID: "prov/wt",
+		WorkerGroup:  "wg",
+		WorkerID:     "wi",
+		ProviderMetadata: map[string]interface{}{
+			"public-ipv4": "1.2.3.4",
+		},
+		WorkerLocation: map[string]string{"cloud": "somewhere"},
+		WorkerConfig:   cfg.NewWorkerConfig(),
+	}
+}
+
+func TestConfigureRun(t *testing.T) {
+	runnercfg := makeRunnerConfig(t, `
+implementation: exec
+command: [my-worker]
+stateConfig:
+  rootUrl: rootURL
+  credentials.clientId: clientID
+  credentials.accessToken: accessToken
+  credentials.certificate: certificate
+  provisionerId: provisionerID
+  workerType: workerType
+  workerId: workerID
+  publicIp: providerMetadata.public-ipv4
+  privateIp: providerMetadata.local-ipv4
+  location: workerLocation
+`)
+	w, err := New(runnercfg)
+	require.NoError(t, err)
+
+	state := makeState()
+	require.NoError(t, w.ConfigureRun(state))
+
+	require.Equal(t, "https://tc.example.com", state.WorkerConfig.MustGet("rootUrl"))
+	require.Equal(t, "cli", state.WorkerConfig.MustGet("credentials.clientId"))
+	require.Equal(t, "at", state.WorkerConfig.MustGet("credentials.accessToken"))
+	require.Equal(t, "prov", state.WorkerConfig.MustGet("provisionerId"))
+	require.Equal(t, "wt", state.WorkerConfig.MustGet("workerType"))
+	require.Equal(t, "wi", state.WorkerConfig.MustGet("workerId"))
+	require.Equal(t, "1.2.3.4", state.WorkerConfig.MustGet("publicIp"))
+	require.Equal(t, map[string]string{"cloud": "somewhere"}, state.WorkerConfig.MustGet("location"))
+
+	// unset values are omitted
+	_, err = state.WorkerConfig.Get("credentials.certificate")
+	require.Error(t, err)
+	_, err = state.WorkerConfig.Get("privateIp")
+	require.Error(t, err)
+}
+
+func TestConfigureRunUnknownField(t *testing.T) {
+	runnercfg := makeRunnerConfig(t, `
+implementation: exec
+command: [my-worker]
+stateConfig:
+  x: noSuchField
+`)
+	w, err := New(runnercfg)
+	require.NoError(t, err)
+	require.Error(t, w.ConfigureRun(makeState()))
+}
+
+func TestNewValidation(t *testing.T) {
+	for _, workerYaml := range []string{
+		"{implementation: exec}",
+		"{implementation: exec, command: []}",
+		"{implementation: exec, command: [1, 2]}",
+		"{implementation: exec, command: [w], env: {X: 1}}",
+		"{implementation: exec, command: [w], configFormat: ini}",
+	} {
+		_, err := New(makeRunnerConfig(t, workerYaml))
+		require.Error(t, err, workerYaml)
+	}
+}
+
+func TestStartWorker(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	workerPath := filepath.Join(dir, "fake.exe")
+	configPath := filepath.Join(dir, "config.json")
+
+	// fake just exits 0
+	require.NoError(t, exec.Command("go", "build", "-o", workerPath, "../genericworker/fake").Run())
+
+	runnercfg := makeRunnerConfig(t, `
+implementation: exec
+command: ["`+filepath.ToSlash(workerPath)+`", "--some-arg"]
+configPath: "`+filepath.ToSlash(configPath)+`"
+env:
+  MY_WORKER: "yes"
+stateConfig:
+  workerId: workerID
+`)
+	w, err := New(runnercfg)
+	require.NoError(t, err)
+
+	state := makeState()
+	require.NoError(t, w.ConfigureRun(state))
+	_, err = w.StartWorker(state)
+	require.NoError(t, err)
+	require.NoError(t, w.Wait())
+
+	require.Equal(t, []string{"MY_WORKER=yes"}, w.(*execworker).env)
+
+	content, err := ioutil.ReadFile(configPath)
+	require.NoError(t, err)
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(content, &decoded))
+	require.Equal(t, "wi", decoded["workerId"])
+
+	// and again, with a different format
+	runnercfg = makeRunnerConfig(t, `
+implementation: exec
+command: ["`+filepath.ToSlash(workerPath)+`"]
+configPath: "`+filepath.ToSlash(configPath)+`"
+configFormat: toml
+stateConfig:
+  workerId: workerID
+`)
+	w, err = New(runnercfg)
+	require.NoError(t, err)
+
+	state = makeState()
+	require.NoError(t, w.ConfigureRun(state))
+	_, err = w.StartWorker(state)
+	require.NoError(t, err)
+	require.NoError(t, w.Wait())
+
+	content, err = ioutil.ReadFile(configPath)
+	require.NoError(t, err)
+	require.Equal(t, "workerId = \"wi\"\n", string(content))
+}
+
+func TestStateEnvOmitCredentials(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	workerPath := filepath.Join(dir, "fake.exe")
+	configPath := filepath.Join(dir, "config.json")
+
+	// fake just exits 0
+	require.NoError(t, exec.Command("go", "build", "-o", workerPath, "../genericworker/fake").Run())
+
+	runnercfg := makeRunnerConfig(t, `
+implementation: exec
+command: ["`+filepath.ToSlash(workerPath)+`"]
+configPath: "`+filepath.ToSlash(configPath)+`"
+stateEnv: true
+omitCredentials: true
+stateConfig:
+  workerId: workerID
+  clientId: clientID
+  accessToken: accessToken
+`)
+	w, err := New(runnercfg)
+	require.NoError(t, err)
+
+	state := makeState()
+	require.NoError(t, w.ConfigureRun(state))
+	_, err = w.StartWorker(state)
+	require.NoError(t, err)
+	require.NoError(t, w.Wait())
+
+	env := w.(*execworker).cmd.Env
+	require.Contains(t, env, "TASKCLUSTER_CLIENT_ID=cli")
+	require.Contains(t, env, "TASKCLUSTER_ACCESS_TOKEN=at")
+	require.Contains(t, env, "TASKCLUSTER_WORKER_ID=wi")
+	require.Contains(t, env, `TASKCLUSTER_WORKER_LOCATION={"cloud":"somewhere"}`)
+
+	content, err := ioutil.ReadFile(configPath)
+	require.NoError(t, err)
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(content, &decoded))
+	require.Equal(t, map[string]interface{}{"workerId": "wi"}, decoded)
+}
+
+func TestOmitCredentialsRequiresStateEnv(t *testing.T) {
+	_, err := New(makeRunnerConfig(t, "{implementation: exec, command: [w], omitCredentials: true}"))
+	require.Error(t, err)
+}
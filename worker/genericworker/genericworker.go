@@ -1,7 +1,6 @@
 package genericworker
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -18,12 +17,28 @@ type genericworkerConfig struct {
 	Service      string `workerimpl:",optional"`
 	ProtocolPipe string `workerimpl:",optional"`
 	ConfigPath   string
+	ConfigFormat string `workerimpl:",optional"`
+	// pass run state to the worker in environment variables
+	StateEnv bool `workerimpl:",optional"`
+	// not supported, as the worker only reads credentials from its config
+	// file; this is present to give a clear error
+	OmitCredentials bool `workerimpl:",optional"`
+	// run the worker as this user
+	RunAs map[string]interface{} `workerimpl:",optional"`
+	// limit the resources available to the worker
+	Resources map[string]interface{} `workerimpl:",optional"`
+	// options for sending protocol messages to the worker
+	Transport map[string]interface{} `workerimpl:",optional"`
 }
 
 type genericworker struct {
 	runnercfg *cfg.RunnerConfig
 	wicfg     genericworkerConfig
 	runMethod runMethod
+	runAs     *worker.RunAs
+	resources *worker.Resources
+
+	transportOptions protocol.StdioTransportOptions
 }
 
 func (d *genericworker) ConfigureRun(state *run.State) error {
@@ -95,7 +110,7 @@ func (d *genericworker) UseCachedRun(state *run.State) error {
 
 func (d *genericworker) StartWorker(state *run.State) (protocol.Transport, error) {
 	// write out the config file
-	content, err := json.MarshalIndent(state.WorkerConfig, "", "  ")
+	content, err := state.WorkerConfig.Encode(d.wicfg.ConfigFormat)
 	if err != nil {
 		return nil, fmt.Errorf("Error constructing worker config: %v", err)
 	}
@@ -104,6 +119,13 @@ func (d *genericworker) StartWorker(state *run.State) (protocol.Transport, error
 		return nil, fmt.Errorf("Error writing worker config to %s: %v", d.wicfg.ConfigPath, err)
 	}
 
+	if d.runAs != nil {
+		err = d.runAs.ChownFiles(d.wicfg.ConfigPath, state.Files)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if (d.wicfg.Path != "" && d.wicfg.Service != "") || (d.wicfg.Path == "" && d.wicfg.Service == "") {
 		return nil, fmt.Errorf("Specify exactly one of worker.path and worker.windowsService")
 	}
@@ -126,12 +148,52 @@ func (d *genericworker) Wait() error {
 	return d.runMethod.wait()
 }
 
+func (d *genericworker) Kill() error {
+	return d.runMethod.kill()
+}
+
+func (d *genericworker) PID() int {
+	return d.runMethod.pid()
+}
+
+func (d *genericworker) ExitCode() int {
+	return d.runMethod.exitCode()
+}
+
 func New(runnercfg *cfg.RunnerConfig) (worker.Worker, error) {
-	rv := genericworker{runnercfg, genericworkerConfig{}, nil}
+	rv := genericworker{runnercfg, genericworkerConfig{}, nil, nil, nil, protocol.StdioTransportOptions{}}
 	err := runnercfg.WorkerImplementation.Unpack(&rv.wicfg)
 	if err != nil {
 		return nil, err
 	}
+	err = cfg.ValidateWorkerConfigFormat(rv.wicfg.ConfigFormat)
+	if err != nil {
+		return nil, err
+	}
+	if rv.wicfg.StateEnv && rv.wicfg.Service != "" {
+		return nil, fmt.Errorf("worker.stateEnv cannot be used with worker.service")
+	}
+	if rv.wicfg.OmitCredentials {
+		return nil, fmt.Errorf("worker.omitCredentials is not supported by generic-worker, which only reads credentials from its configuration file")
+	}
+	if rv.wicfg.RunAs != nil && rv.wicfg.Service != "" {
+		return nil, fmt.Errorf("worker.runAs cannot be used with worker.service")
+	}
+	if rv.wicfg.Resources != nil && rv.wicfg.Service != "" {
+		return nil, fmt.Errorf("worker.resources cannot be used with worker.service")
+	}
+	rv.runAs, err = worker.ParseRunAs(rv.wicfg.RunAs)
+	if err != nil {
+		return nil, err
+	}
+	rv.resources, err = worker.ParseResources(rv.wicfg.Resources)
+	if err != nil {
+		return nil, err
+	}
+	rv.transportOptions, err = worker.ParseTransport(rv.wicfg.Transport)
+	if err != nil {
+		return nil, err
+	}
 	return &rv, nil
 }
 
@@ -155,6 +217,35 @@ values in the 'worker' section of the runner configuration:
 		# path where taskcluster-worker-runner should write the generated
 		# generic-worker configuration.
 		configPath: /etc/taskcluster/generic-worker/config.yaml
+		# (optional) format of the generated configuration: json (default),
+		# yaml, toml, or dotenv
+		configFormat: json
+		# (optional) if true, pass the run state to generic-worker in
+		# environment variables (see below); not supported with 'service'
+		stateEnv: false
+		# (optional, Linux and macOS only) run the worker as this user, giving it
+		# ownership of the generated configuration and any extracted files;
+		# not supported with 'service'
+		runAs:
+			user: worker
+			# (optional) defaults to the user's primary group
+			group: worker
+			# (optional) supplementary groups
+			groups: [docker]
+		# (optional, Linux only) limit the memory, CPU, and number of processes
+		# available to the worker and its descendants, using a cgroup v2 subtree;
+		# values are written to memory.max, cpu.max, and pids.max, respectively;
+		# requires a delegated cgroup (see below); not supported with 'service'
+		resources:
+			memoryMax: 8G
+			cpuMax: 200000 100000
+			pidsMax: 4096
+		# (optional) how start-worker queues protocol messages while the
+		# worker is not reading them (see below)
+		transport:
+			queueSize: 5
+			overflow: drop-oldest
+			sendTimeout: 30
 
 Specify either 'path' to run the executable directly, or 'service' to name a
 Windows service that will run the worker.  In the latter case, the configPath
@@ -162,5 +253,27 @@ must match the path configured within the service definition.  See
 [windows-services](./docs/windows-services.md) for details.  Note that running
 as a service requires at least generic-worker v16.6.0.
 
+The 'resources' option requires start-worker to be the only process in a cgroup
+delegated to it, such as a systemd service with 'Delegate=yes'.  See
+[linux-services](./docs/linux-services.md) for details.
+
+The 'transport' option configures the queue of protocol messages sent to the
+worker.  'queueSize' is the number of messages queued while the worker is not
+reading its input (default 5).  'overflow' is what happens when the queue is
+full: 'drop-oldest' (the default) drops the oldest queued message, except that
+'welcome' and 'graceful-termination' messages are only dropped while the same
+message is still queued; 'block' waits for room; and 'error' drops the new
+message.  'sendTimeout' is the longest, in seconds, to wait for room, after
+which the message is dropped; by default, sending waits until the worker
+exits.
+
+With 'stateEnv', the worker process receives the environment variables
+TASKCLUSTER_ROOT_URL, TASKCLUSTER_CLIENT_ID, TASKCLUSTER_ACCESS_TOKEN,
+TASKCLUSTER_CERTIFICATE (for temporary credentials),
+TASKCLUSTER_WORKER_POOL_ID, TASKCLUSTER_WORKER_GROUP, TASKCLUSTER_WORKER_ID,
+and TASKCLUSTER_WORKER_LOCATION (a JSON object), for use by wrapper scripts.
+generic-worker itself only reads its credentials from the configuration file,
+so 'omitCredentials' is not supported.
+
 `
 }
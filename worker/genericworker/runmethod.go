@@ -8,12 +8,18 @@ import (
 
 	"github.com/taskcluster/taskcluster-worker-runner/protocol"
 	"github.com/taskcluster/taskcluster-worker-runner/run"
+	"github.com/taskcluster/taskcluster-worker-runner/worker/worker"
 )
 
 // runMethod allows supporting both run-as-a-service and run-as-an-executable modes.
 type runMethod interface {
 	start(w *genericworker, state *run.State) (protocol.Transport, error)
 	wait() error
+	kill() error
+	// the worker's process ID, or 0 if not known
+	pid() int
+	// the worker's exit code, or -1 if not known
+	exitCode() int
 }
 
 // run with a command
@@ -23,26 +29,40 @@ func newCmdRunMethod() (runMethod, error) {
 }
 
 type cmdRunMethod struct {
-	cmd *exec.Cmd
+	cmd       *exec.Cmd
+	transp    *protocol.StdioTransport
+	resources *worker.Resources
 }
 
 func (m *cmdRunMethod) start(w *genericworker, state *run.State) (protocol.Transport, error) {
-	transp := protocol.NewStdioTransport()
+	transp := protocol.NewStdioTransportWithOptions(w.transportOptions)
 
 	// path to generic-worker binary
 	cmd := exec.Command(w.wicfg.Path)
 	cmd.Env = os.Environ()
+	if w.wicfg.StateEnv {
+		env, err := worker.StateEnv(state)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Env = append(cmd.Env, env...)
+	}
 	cmd.Stdout = transp
 	cmd.Stderr = os.Stderr
+	if w.runAs != nil {
+		w.runAs.Apply(cmd)
+	}
 
 	// pass config to generic-worker
 	cmd.Args = append(cmd.Args, "run", "--config", w.wicfg.ConfigPath)
 
 	m.cmd = cmd
+	m.transp = transp
+	m.resources = w.resources
 
 	// Unfortunately, cmd.Wait does not handle the case where cmd.Stdin is a writer that remains
-	// open when the process exits.  Instead, we set up our own copy loop.  This loop in fact
-	// runs forever, but for a single-use process like this, that's OK.
+	// open when the process exits.  Instead, we set up our own copy loop, which finishes when
+	// Wait closes the outgoing side of the transport.
 	pipe, err := cmd.StdinPipe()
 	if err != nil {
 		return nil, err
@@ -56,9 +76,10 @@ func (m *cmdRunMethod) start(w *genericworker, state *run.State) (protocol.Trans
 			// as usual.
 			log.Printf("Error writing to worker process (ignored): %#v", err)
 		}
+		pipe.Close()
 	}()
 
-	err = cmd.Start()
+	err = w.resources.Start(cmd)
 	if err != nil {
 		return nil, err
 	}
@@ -67,5 +88,20 @@ func (m *cmdRunMethod) start(w *genericworker, state *run.State) (protocol.Trans
 }
 
 func (m *cmdRunMethod) wait() error {
-	return m.cmd.Wait()
+	err := m.resources.WaitError(m.cmd.Wait())
+	// nothing more can be sent to the worker
+	m.transp.CloseOut()
+	return err
+}
+
+func (m *cmdRunMethod) kill() error {
+	return m.cmd.Process.Kill()
+}
+
+func (m *cmdRunMethod) pid() int {
+	return m.cmd.Process.Pid
+}
+
+func (m *cmdRunMethod) exitCode() int {
+	return m.cmd.ProcessState.ExitCode()
 }
@@ -21,6 +21,7 @@ func newServiceRunMethod() (runMethod, error) {
 type serviceRunMethod struct {
 	serviceName string
 	mgr         *mgr.Mgr
+	transp      *protocol.StdioTransport
 }
 
 func (m *serviceRunMethod) start(w *genericworker, state *run.State) (protocol.Transport, error) {
@@ -44,7 +45,8 @@ func (m *serviceRunMethod) start(w *genericworker, state *run.State) (protocol.T
 	}
 
 	// connect the transport to the named
-	transp := protocol.NewStdioTransport()
+	transp := protocol.NewStdioTransportWithOptions(w.transportOptions)
+	m.transp = transp
 
 	err = m.connectPipeToProtocol(w.wicfg.ProtocolPipe, transp)
 	if err != nil {
@@ -108,6 +110,8 @@ func (m *serviceRunMethod) connectPipeToProtocol(protocolPipe string, transp *pr
 
 func (m *serviceRunMethod) wait() error {
 	defer m.mgr.Disconnect()
+	// once the service has stopped, nothing more can be sent to the worker
+	defer m.transp.CloseOut()
 
 	// poll until the service stops
 	for {
@@ -129,3 +133,38 @@ func (m *serviceRunMethod) wait() error {
 	}
 	return nil
 }
+
+func (m *serviceRunMethod) kill() error {
+	s, err := m.mgr.OpenService(m.serviceName)
+	if err != nil {
+		return fmt.Errorf("Error getting service %s: %s", m.serviceName, err)
+	}
+	defer s.Close()
+
+	// the service manager will forcibly terminate the service if it does not
+	// stop within its configured timeout
+	_, err = s.Control(svc.Stop)
+	if err != nil {
+		return fmt.Errorf("Error stopping service %s: %s", m.serviceName, err)
+	}
+	return nil
+}
+
+func (m *serviceRunMethod) pid() int {
+	s, err := m.mgr.OpenService(m.serviceName)
+	if err != nil {
+		return 0
+	}
+	defer s.Close()
+
+	status, err := s.Query()
+	if err != nil {
+		return 0
+	}
+	return int(status.ProcessId)
+}
+
+func (m *serviceRunMethod) exitCode() int {
+	// the service manager does not report the service's exit code
+	return -1
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/taskcluster/taskcluster-worker-runner/cfg"
 	"github.com/taskcluster/taskcluster-worker-runner/worker/dockerworker"
 	"github.com/taskcluster/taskcluster-worker-runner/worker/dummy"
+	"github.com/taskcluster/taskcluster-worker-runner/worker/execworker"
 	"github.com/taskcluster/taskcluster-worker-runner/worker/genericworker"
 	"github.com/taskcluster/taskcluster-worker-runner/worker/worker"
 )
@@ -21,6 +22,7 @@ var workers map[string]workerInfo = map[string]workerInfo{
 	"dummy":          workerInfo{dummy.New, dummy.Usage},
 	"docker-worker":  workerInfo{dockerworker.New, dockerworker.Usage},
 	"generic-worker": workerInfo{genericworker.New, genericworker.Usage},
+	"exec":           workerInfo{execworker.New, execworker.Usage},
 }
 
 func New(runnercfg *cfg.RunnerConfig) (worker.Worker, error) {
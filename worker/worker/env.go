@@ -0,0 +1,57 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+)
+
+// Get environment variables, in the form `NAME=value`, describing the given
+// run state.  Worker implementations can pass these to the worker process as
+// an alternative to writing them to a config file.  The certificate is only
+// included if the credentials are temporary.
+func StateEnv(state *run.State) ([]string, error) {
+	env := []string{
+		"TASKCLUSTER_ROOT_URL=" + state.RootURL,
+		"TASKCLUSTER_CLIENT_ID=" + state.Credentials.ClientID,
+		"TASKCLUSTER_ACCESS_TOKEN=" + state.Credentials.AccessToken,
+	}
+	if state.Credentials.Certificate != "" {
+		env = append(env, "TASKCLUSTER_CERTIFICATE="+state.Credentials.Certificate)
+	}
+	env = append(env,
+		"TASKCLUSTER_WORKER_POOL_ID="+state.WorkerPoolID,
+		"TASKCLUSTER_WORKER_GROUP="+state.WorkerGroup,
+		"TASKCLUSTER_WORKER_ID="+state.WorkerID,
+	)
+
+	workerLocation := state.WorkerLocation
+	if workerLocation == nil {
+		workerLocation = map[string]string{}
+	}
+	workerLocationJson, err := json.Marshal(workerLocation)
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding worker location: %v", err)
+	}
+	env = append(env, "TASKCLUSTER_WORKER_LOCATION="+string(workerLocationJson))
+
+	return env, nil
+}
+
+// Check the configuration of a worker implementation's omitCredentials option,
+// which is only useful when the state is passed in the environment, and which
+// cannot keep credentials off of the disk if the runner caches its state.
+func CheckOmitCredentials(runnercfg *cfg.RunnerConfig, stateEnv, omitCredentials bool) error {
+	if !omitCredentials {
+		return nil
+	}
+	if !stateEnv {
+		return fmt.Errorf("worker.omitCredentials requires worker.stateEnv")
+	}
+	if runnercfg.CacheOverRestarts != "" {
+		return fmt.Errorf("worker.omitCredentials cannot be used with cacheOverRestarts, which stores credentials on disk")
+	}
+	return nil
+}
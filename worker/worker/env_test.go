@@ -0,0 +1,65 @@
+package worker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker-runner/cfg"
+	"github.com/taskcluster/taskcluster-worker-runner/run"
+	tcclient "github.com/taskcluster/taskcluster/clients/client-go/v24"
+)
+
+func TestStateEnv(t *testing.T) {
+	state := &run.State{
+		RootURL: "https://tc.example.com",
+		Credentials: tcclient.Credentials{
+			ClientID:    "cli",
+			AccessToken: "at",
+			Certificate: "cert",
+		},
+		WorkerPoolID:   "w/p",
+		WorkerGroup:    "wg",
+		WorkerID:       "wi",
+		WorkerLocation: map[string]string{"cloud": "aws", "region": "us-east-1"},
+	}
+
+	env, err := StateEnv(state)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"TASKCLUSTER_ROOT_URL=https://tc.example.com",
+		"TASKCLUSTER_CLIENT_ID=cli",
+		"TASKCLUSTER_ACCESS_TOKEN=at",
+		"TASKCLUSTER_CERTIFICATE=cert",
+		"TASKCLUSTER_WORKER_POOL_ID=w/p",
+		"TASKCLUSTER_WORKER_GROUP=wg",
+		"TASKCLUSTER_WORKER_ID=wi",
+		`TASKCLUSTER_WORKER_LOCATION={"cloud":"aws","region":"us-east-1"}`,
+	}, env)
+}
+
+func TestStateEnvPermanentCredentials(t *testing.T) {
+	state := &run.State{
+		Credentials: tcclient.Credentials{
+			ClientID:    "cli",
+			AccessToken: "at",
+		},
+	}
+
+	env, err := StateEnv(state)
+	require.NoError(t, err)
+	for _, e := range env {
+		require.NotContains(t, e, "TASKCLUSTER_CERTIFICATE")
+	}
+	require.Contains(t, env, "TASKCLUSTER_WORKER_LOCATION={}")
+}
+
+func TestCheckOmitCredentials(t *testing.T) {
+	runnercfg := &cfg.RunnerConfig{}
+	require.NoError(t, CheckOmitCredentials(runnercfg, false, false))
+	require.NoError(t, CheckOmitCredentials(runnercfg, true, true))
+	require.Error(t, CheckOmitCredentials(runnercfg, false, true))
+
+	runnercfg.CacheOverRestarts = "/var/cache/runner.json"
+	require.NoError(t, CheckOmitCredentials(runnercfg, true, false))
+	require.Error(t, CheckOmitCredentials(runnercfg, true, true))
+}
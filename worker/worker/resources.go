@@ -0,0 +1,93 @@
+package worker
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+)
+
+// Resources describes limits on the resources used by a worker process and
+// its descendants, enforced with a cgroup v2 subtree.  It is configured in the
+// worker implementation's `resources` property.
+type Resources struct {
+	// values for memory.max, cpu.max, and pids.max; empty values are not set
+	MemoryMax string
+	CPUMax    string
+	PidsMax   string
+
+	// the path of the cgroup containing the worker, once started
+	cgroup string
+	// the cgroup's count of OOM kills before the worker started
+	oomKillsBefore int
+}
+
+// Parse the `resources` property of a worker implementation configuration.
+// This returns nil if data is nil.
+func ParseResources(data map[string]interface{}) (*Resources, error) {
+	if data == nil {
+		return nil, nil
+	}
+
+	r := &Resources{}
+	for key, value := range data {
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case int:
+			s = fmt.Sprintf("%d", v)
+		default:
+			return nil, fmt.Errorf("worker.resources.%s must be a string or integer", key)
+		}
+
+		switch key {
+		case "memoryMax":
+			r.MemoryMax = s
+		case "cpuMax":
+			r.CPUMax = s
+		case "pidsMax":
+			r.PidsMax = s
+		default:
+			return nil, fmt.Errorf("Unknown property worker.resources.%s", key)
+		}
+	}
+
+	err := checkResourcesSupported()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Start the given command, within a cgroup enforcing these resource limits.
+// If r is nil, this simply starts the command.
+func (r *Resources) Start(cmd *exec.Cmd) error {
+	if r == nil {
+		return cmd.Start()
+	}
+	return r.startInCgroup(cmd)
+}
+
+// Annotate the error returned from waiting for the worker process with any
+// OOM kills recorded for its cgroup.  If r is nil, this returns err unchanged.
+func (r *Resources) WaitError(err error) error {
+	if r == nil || r.cgroup == "" {
+		return err
+	}
+
+	kills, oomErr := r.oomKills()
+	if oomErr != nil {
+		log.Printf("Could not determine OOM kills for cgroup %s: %v", r.cgroup, oomErr)
+		return err
+	}
+	kills -= r.oomKillsBefore
+	if kills <= 0 {
+		return err
+	}
+
+	if err == nil {
+		log.Printf("The kernel OOM-killed %d process(es) in the worker's cgroup %s", kills, r.cgroup)
+		return nil
+	}
+	return fmt.Errorf("%v (the kernel OOM-killed %d process(es) in the worker's cgroup %s)", err, kills, r.cgroup)
+}
@@ -0,0 +1,191 @@
+// +build linux
+
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The cgroup v2 filesystem, and the file describing this process's cgroup;
+// these are variables so that tests can substitute a temporary directory.
+var cgroupRoot = "/sys/fs/cgroup"
+var procSelfCgroup = "/proc/self/cgroup"
+
+// Names of the cgroups created within this process's cgroup.  A cgroup with
+// controllers enabled for its children cannot itself contain processes, so
+// worker-runner moves itself to a sibling of the worker's cgroup.  These
+// cgroups are not removed when worker-runner exits.
+const runnerCgroupName = "worker-runner"
+const workerCgroupName = "worker"
+
+func checkResourcesSupported() error {
+	return nil
+}
+
+// Get the path of this process's cgroup, relative to cgroupRoot
+func ownCgroup() (string, error) {
+	content, err := ioutil.ReadFile(procSelfCgroup)
+	if err != nil {
+		return "", err
+	}
+	// the cgroup v2 hierarchy has the line `0::<path>`
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", fmt.Errorf("No cgroup v2 hierarchy found in %s", procSelfCgroup)
+}
+
+func writeCgroupFile(cgroup, name, value string) error {
+	err := ioutil.WriteFile(filepath.Join(cgroup, name), []byte(value), 0644)
+	if err != nil {
+		return fmt.Errorf("Could not write %q to %s of cgroup %s: %v", value, name, cgroup, err)
+	}
+	return nil
+}
+
+// The worker is started by a shell, which waits for a line on the given file
+// descriptor before replacing itself with the worker.  worker-runner sends
+// that line once it has moved the shell into the worker's cgroup, so that the
+// worker is subject to the limits from the start, without worker-runner ever
+// being in that cgroup itself.  If worker-runner closes the descriptor without
+// sending a line, the shell exits without starting the worker.
+const cgroupGateScript = `read _ <&%d && exec "$@" %d<&-`
+
+// Check that no other processes are in the given cgroup, as enabling
+// controllers for its children requires it to contain no processes, and
+// worker-runner should not move processes it does not own.
+func checkCgroupExclusive(cgroup string) error {
+	content, err := ioutil.ReadFile(filepath.Join(cgroup, "cgroup.procs"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	pid := strconv.Itoa(os.Getpid())
+	for _, line := range strings.Fields(string(content)) {
+		if line != pid {
+			return fmt.Errorf("cgroup %s contains other processes (such as %s); worker.resources requires start-worker to run in a delegated cgroup of its own", cgroup, line)
+		}
+	}
+	return nil
+}
+
+func (r *Resources) startInCgroup(cmd *exec.Cmd) error {
+	own, err := ownCgroup()
+	if err != nil {
+		return err
+	}
+	if own == "/" {
+		return fmt.Errorf("worker.resources requires start-worker to run in a delegated cgroup, not the root cgroup")
+	}
+	base := filepath.Join(cgroupRoot, own)
+	runnerCgroup := filepath.Join(base, runnerCgroupName)
+	workerCgroup := filepath.Join(base, workerCgroupName)
+	pid := strconv.Itoa(os.Getpid())
+
+	err = checkCgroupExclusive(base)
+	if err != nil {
+		return err
+	}
+
+	for _, cg := range []string{runnerCgroup, workerCgroup} {
+		err = os.MkdirAll(cg, 0755)
+		if err != nil {
+			return fmt.Errorf("Could not create cgroup %s: %v", cg, err)
+		}
+	}
+
+	err = writeCgroupFile(runnerCgroup, "cgroup.procs", pid)
+	if err != nil {
+		return err
+	}
+
+	err = writeCgroupFile(base, "cgroup.subtree_control", "+memory +cpu +pids")
+	if err != nil {
+		return err
+	}
+
+	for _, limit := range []struct {
+		name  string
+		value string
+	}{
+		{"memory.max", r.MemoryMax},
+		{"cpu.max", r.CPUMax},
+		{"pids.max", r.PidsMax},
+	} {
+		if limit.value == "" {
+			continue
+		}
+		err = writeCgroupFile(workerCgroup, limit.name, limit.value)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the worker's cgroup may remain from an earlier run, so only OOM kills
+	// after this point are attributed to this worker
+	r.cgroup = workerCgroup
+	r.oomKillsBefore, err = r.oomKills()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	gateRead, gateWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer gateWrite.Close()
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, gateRead)
+	cmd.Args = append([]string{"sh", "-c", fmt.Sprintf(cgroupGateScript, fd, fd), "sh", cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/bin/sh"
+
+	err = cmd.Start()
+	gateRead.Close()
+	if err != nil {
+		r.cgroup = ""
+		return err
+	}
+
+	err = writeCgroupFile(workerCgroup, "cgroup.procs", strconv.Itoa(cmd.Process.Pid))
+	if err == nil {
+		_, err = gateWrite.Write([]byte("\n"))
+	}
+	if err != nil {
+		// the shell exits when the gate is closed, if it has not already
+		gateWrite.Close()
+		_ = cmd.Wait()
+		r.cgroup = ""
+		return err
+	}
+
+	return nil
+}
+
+// Get the number of processes in the worker's cgroup killed by the OOM killer
+func (r *Resources) oomKills() (int, error) {
+	content, err := ioutil.ReadFile(filepath.Join(r.cgroup, "memory.events"))
+	if err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.Atoi(fields[1])
+		}
+	}
+	return 0, scanner.Err()
+}
@@ -0,0 +1,199 @@
+// +build linux
+
+package worker
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/Flaque/filet"
+	"github.com/stretchr/testify/require"
+)
+
+// Set up a fake cgroup filesystem, returning the path of this process's cgroup
+func fakeCgroups(t *testing.T) string {
+	dir := filet.TmpDir(t, "")
+	cgroupRoot = filepath.Join(dir, "cgroup")
+	procSelfCgroup = filepath.Join(dir, "proc-self-cgroup")
+
+	own := filepath.Join(cgroupRoot, "system.slice", "worker-runner.service")
+	require.NoError(t, os.MkdirAll(own, 0755))
+	require.NoError(t, ioutil.WriteFile(procSelfCgroup, []byte("0::/system.slice/worker-runner.service\n"), 0644))
+	return own
+}
+
+func resetCgroups() {
+	cgroupRoot = "/sys/fs/cgroup"
+	procSelfCgroup = "/proc/self/cgroup"
+}
+
+func readCgroupFile(t *testing.T, path ...string) string {
+	content, err := ioutil.ReadFile(filepath.Join(path...))
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestParseResources(t *testing.T) {
+	r, err := ParseResources(nil)
+	require.NoError(t, err)
+	require.Nil(t, r)
+
+	r, err = ParseResources(map[string]interface{}{
+		"memoryMax": "8G",
+		"cpuMax":    "200000 100000",
+		"pidsMax":   4096,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "8G", r.MemoryMax)
+	require.Equal(t, "200000 100000", r.CPUMax)
+	require.Equal(t, "4096", r.PidsMax)
+
+	_, err = ParseResources(map[string]interface{}{"memoryMax": 1.5})
+	require.Error(t, err)
+	_, err = ParseResources(map[string]interface{}{"ioMax": "8:0 rbps=1"})
+	require.Error(t, err)
+}
+
+func TestStartInCgroup(t *testing.T) {
+	defer filet.CleanUp(t)
+	defer resetCgroups()
+	own := fakeCgroups(t)
+
+	r, err := ParseResources(map[string]interface{}{"memoryMax": "8G", "pidsMax": 100})
+	require.NoError(t, err)
+
+	var output bytes.Buffer
+	cmd := exec.Command("echo", "hello", "world")
+	cmd.Stdout = &output
+	require.NoError(t, r.Start(cmd))
+	require.NoError(t, cmd.Wait())
+	require.Equal(t, "hello world\n", output.String())
+
+	pid := strconv.Itoa(os.Getpid())
+	require.Equal(t, "+memory +cpu +pids", readCgroupFile(t, own, "cgroup.subtree_control"))
+	require.Equal(t, "8G", readCgroupFile(t, own, "worker", "memory.max"))
+	require.Equal(t, "100", readCgroupFile(t, own, "worker", "pids.max"))
+	_, err = os.Stat(filepath.Join(own, "worker", "cpu.max"))
+	require.True(t, os.IsNotExist(err))
+
+	// the worker was moved into the worker cgroup, and this process into a
+	// sibling cgroup
+	require.Equal(t, strconv.Itoa(cmd.Process.Pid), readCgroupFile(t, own, "worker", "cgroup.procs"))
+	require.Equal(t, pid, readCgroupFile(t, own, "worker-runner", "cgroup.procs"))
+	require.Equal(t, filepath.Join(own, "worker"), r.cgroup)
+}
+
+func TestStartCgroupFailure(t *testing.T) {
+	defer filet.CleanUp(t)
+	defer resetCgroups()
+	own := fakeCgroups(t)
+
+	// a directory cannot be written, so the worker cannot be moved into it
+	require.NoError(t, os.MkdirAll(filepath.Join(own, "worker", "cgroup.procs"), 0755))
+
+	r, err := ParseResources(map[string]interface{}{"memoryMax": "8G"})
+	require.NoError(t, err)
+
+	dir := filet.TmpDir(t, "")
+	marker := filepath.Join(dir, "started")
+	cmd := exec.Command("touch", marker)
+	require.Error(t, r.Start(cmd))
+
+	// the worker never ran
+	_, err = os.Stat(marker)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestStartSharedCgroup(t *testing.T) {
+	defer filet.CleanUp(t)
+	defer resetCgroups()
+	own := fakeCgroups(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(own, "cgroup.procs"), []byte("1\n"+strconv.Itoa(os.Getpid())+"\n"), 0644))
+
+	r, err := ParseResources(map[string]interface{}{"memoryMax": "8G"})
+	require.NoError(t, err)
+	err = r.Start(exec.Command("true"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "contains other processes")
+}
+
+func TestStartRootCgroup(t *testing.T) {
+	defer filet.CleanUp(t)
+	defer resetCgroups()
+	fakeCgroups(t)
+	require.NoError(t, ioutil.WriteFile(procSelfCgroup, []byte("0::/\n"), 0644))
+
+	r, err := ParseResources(map[string]interface{}{"memoryMax": "8G"})
+	require.NoError(t, err)
+	require.Error(t, r.Start(exec.Command("true")))
+}
+
+func TestOOMKillsFromEarlierRun(t *testing.T) {
+	defer filet.CleanUp(t)
+	defer resetCgroups()
+	own := fakeCgroups(t)
+
+	// the worker cgroup remains from an earlier run, with OOM kills
+	events := filepath.Join(own, "worker", "memory.events")
+	require.NoError(t, os.MkdirAll(filepath.Join(own, "worker"), 0755))
+	require.NoError(t, ioutil.WriteFile(events, []byte("oom 3\noom_kill 3\n"), 0644))
+
+	r, err := ParseResources(map[string]interface{}{"memoryMax": "8G"})
+	require.NoError(t, err)
+	cmd := exec.Command("true")
+	require.NoError(t, r.Start(cmd))
+	waitErr := cmd.Wait()
+	require.NoError(t, r.WaitError(waitErr))
+
+	waitErr = errors.New("signal: killed")
+	require.Equal(t, waitErr, r.WaitError(waitErr))
+
+	require.NoError(t, ioutil.WriteFile(events, []byte("oom 4\noom_kill 4\n"), 0644))
+	err = r.WaitError(waitErr)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "OOM-killed 1 process(es)")
+}
+
+func TestStartNoCgroupV2(t *testing.T) {
+	defer filet.CleanUp(t)
+	defer resetCgroups()
+	fakeCgroups(t)
+	require.NoError(t, ioutil.WriteFile(procSelfCgroup, []byte("1:name=systemd:/init.scope\n"), 0644))
+
+	r, err := ParseResources(map[string]interface{}{"memoryMax": "8G"})
+	require.NoError(t, err)
+	require.Error(t, r.Start(exec.Command("go", "version")))
+}
+
+func TestWaitErrorOOMKill(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+
+	r := &Resources{cgroup: dir}
+	waitErr := errors.New("signal: killed")
+
+	// no memory.events file
+	require.Equal(t, waitErr, r.WaitError(waitErr))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "memory.events"), []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 0\n"), 0644))
+	require.Equal(t, waitErr, r.WaitError(waitErr))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "memory.events"), []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 2\n"), 0644))
+	err := r.WaitError(waitErr)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "signal: killed")
+	require.Contains(t, err.Error(), "OOM-killed 2 process(es)")
+
+	// a successful exit remains successful
+	require.NoError(t, r.WaitError(nil))
+
+	// nil resources pass errors through
+	var nilResources *Resources
+	require.Equal(t, waitErr, nilResources.WaitError(waitErr))
+}
@@ -0,0 +1,20 @@
+// +build !linux
+
+package worker
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func checkResourcesSupported() error {
+	return fmt.Errorf("worker.resources is only supported on Linux")
+}
+
+func (r *Resources) startInCgroup(cmd *exec.Cmd) error {
+	return checkResourcesSupported()
+}
+
+func (r *Resources) oomKills() (int, error) {
+	return 0, checkResourcesSupported()
+}
@@ -0,0 +1,70 @@
+package worker
+
+import (
+	"fmt"
+)
+
+// RunAs describes the user, group, and supplementary groups as which a worker
+// process should run.  It is configured in the worker implementation's
+// `runAs` property.
+type RunAs struct {
+	// user name or numeric uid
+	User string
+	// group name or numeric gid; defaults to the user's primary group
+	Group string
+	// supplementary group names or numeric gids
+	Groups []string
+
+	// the resolved ids
+	uid    int
+	gid    int
+	groups []int
+}
+
+// Parse the `runAs` property of a worker implementation configuration,
+// looking up the given user and groups.  This returns nil if data is nil.
+func ParseRunAs(data map[string]interface{}) (*RunAs, error) {
+	if data == nil {
+		return nil, nil
+	}
+
+	ra := &RunAs{}
+	for key, value := range data {
+		switch key {
+		case "user", "group":
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("worker.runAs.%s must be a string", key)
+			}
+			if key == "user" {
+				ra.User = s
+			} else {
+				ra.Group = s
+			}
+		case "groups":
+			list, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("worker.runAs.groups must be a list of strings")
+			}
+			for _, item := range list {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("worker.runAs.groups must be a list of strings")
+				}
+				ra.Groups = append(ra.Groups, s)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown property worker.runAs.%s", key)
+		}
+	}
+
+	if ra.User == "" {
+		return nil, fmt.Errorf("worker.runAs.user is required")
+	}
+
+	err := ra.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return ra, nil
+}
@@ -0,0 +1,104 @@
+// +build linux darwin
+
+package worker
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/taskcluster/taskcluster-worker-runner/files"
+	"github.com/taskcluster/taskcluster-worker-runner/perms"
+)
+
+// Look up the given group name, also accepting a numeric gid
+func lookupGID(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, fmt.Errorf("Could not find group %s: %v", group, err)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+func (ra *RunAs) resolve() error {
+	var err error
+
+	if uid, err := strconv.Atoi(ra.User); err == nil {
+		ra.uid = uid
+		ra.gid = -1
+	} else {
+		u, err := user.Lookup(ra.User)
+		if err != nil {
+			return fmt.Errorf("Could not find user %s: %v", ra.User, err)
+		}
+		ra.uid, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			return err
+		}
+		ra.gid, err = strconv.Atoi(u.Gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ra.Group != "" {
+		ra.gid, err = lookupGID(ra.Group)
+		if err != nil {
+			return err
+		}
+	}
+	if ra.gid == -1 {
+		return fmt.Errorf("worker.runAs.group is required when worker.runAs.user is numeric")
+	}
+
+	ra.groups = nil
+	for _, group := range ra.Groups {
+		gid, err := lookupGID(group)
+		if err != nil {
+			return err
+		}
+		ra.groups = append(ra.groups, gid)
+	}
+
+	return nil
+}
+
+// Configure the given command to run as this user.  This must be called
+// before the command is started.
+func (ra *RunAs) Apply(cmd *exec.Cmd) {
+	groups := make([]uint32, len(ra.groups))
+	for i, gid := range ra.groups {
+		groups[i] = uint32(gid)
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    uint32(ra.uid),
+		Gid:    uint32(ra.gid),
+		Groups: groups,
+	}
+}
+
+// Give this user ownership of the given config file, which must remain private
+// to it, and of the given extracted files.
+func (ra *RunAs) ChownFiles(configPath string, extracted []files.File) error {
+	if configPath != "" {
+		err := perms.MakePrivateToUser(configPath, ra.uid, ra.gid)
+		if err != nil {
+			return err
+		}
+		err = perms.VerifyPrivateToUser(configPath, ra.uid)
+		if err != nil {
+			return err
+		}
+	}
+
+	return files.Chown(extracted, ra.uid, ra.gid)
+}
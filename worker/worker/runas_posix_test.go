@@ -0,0 +1,65 @@
+// +build linux darwin
+
+package worker
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRunAsNil(t *testing.T) {
+	ra, err := ParseRunAs(nil)
+	require.NoError(t, err)
+	require.Nil(t, ra)
+}
+
+func TestParseRunAsUserName(t *testing.T) {
+	u, err := user.Current()
+	require.NoError(t, err)
+
+	ra, err := ParseRunAs(map[string]interface{}{"user": u.Username})
+	require.NoError(t, err)
+	require.Equal(t, os.Getuid(), ra.uid)
+	primaryGID, err := strconv.Atoi(u.Gid)
+	require.NoError(t, err)
+	require.Equal(t, primaryGID, ra.gid)
+}
+
+func TestParseRunAsNumeric(t *testing.T) {
+	ra, err := ParseRunAs(map[string]interface{}{
+		"user":   "12345",
+		"group":  "23456",
+		"groups": []interface{}{"34567", "45678"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 12345, ra.uid)
+	require.Equal(t, 23456, ra.gid)
+	require.Equal(t, []int{34567, 45678}, ra.groups)
+
+	cmd := exec.Command("true")
+	ra.Apply(cmd)
+	require.Equal(t, uint32(12345), cmd.SysProcAttr.Credential.Uid)
+	require.Equal(t, uint32(23456), cmd.SysProcAttr.Credential.Gid)
+	require.Equal(t, []uint32{34567, 45678}, cmd.SysProcAttr.Credential.Groups)
+}
+
+func TestParseRunAsErrors(t *testing.T) {
+	for _, data := range []map[string]interface{}{
+		{},
+		{"user": 10},
+		{"user": "12345"},
+		{"user": "12345", "group": "1", "groups": "docker"},
+		{"user": "12345", "group": "1", "groups": []interface{}{1}},
+		{"user": "12345", "group": "1", "shell": "/bin/sh"},
+		{"user": "no-such-user-hopefully"},
+		{"user": "12345", "group": "no-such-group-hopefully"},
+	} {
+		_, err := ParseRunAs(data)
+		require.Error(t, err, "%#v", data)
+	}
+}
@@ -0,0 +1,23 @@
+// +build windows
+
+package worker
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/taskcluster/taskcluster-worker-runner/files"
+)
+
+func (ra *RunAs) resolve() error {
+	return fmt.Errorf("worker.runAs is not supported on Windows")
+}
+
+// Configure the given command to run as this user (unsupported on Windows)
+func (ra *RunAs) Apply(cmd *exec.Cmd) {
+}
+
+// Give this user ownership of the given files (unsupported on Windows)
+func (ra *RunAs) ChownFiles(configPath string, extracted []files.File) error {
+	return fmt.Errorf("worker.runAs is not supported on Windows")
+}
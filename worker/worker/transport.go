@@ -0,0 +1,46 @@
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+)
+
+// Values of the `transport.overflow` property
+var overflowPolicies = map[string]protocol.OverflowPolicy{
+	"drop-oldest": protocol.OverflowDropOldest,
+	"block":       protocol.OverflowBlock,
+	"error":       protocol.OverflowError,
+}
+
+// Parse the `transport` property of a worker implementation configuration,
+// giving the options for the transport over which start-worker sends protocol
+// messages to the worker.  If data is nil, this returns the default options.
+func ParseTransport(data map[string]interface{}) (protocol.StdioTransportOptions, error) {
+	options := protocol.StdioTransportOptions{}
+	for key, value := range data {
+		switch key {
+		case "queueSize", "sendTimeout":
+			n, ok := value.(int)
+			if !ok || n <= 0 {
+				return options, fmt.Errorf("worker.transport.%s must be a positive integer", key)
+			}
+			if key == "queueSize" {
+				options.QueueSize = n
+			} else {
+				options.SendTimeout = time.Duration(n) * time.Second
+			}
+		case "overflow":
+			s, _ := value.(string)
+			policy, ok := overflowPolicies[s]
+			if !ok {
+				return options, fmt.Errorf("worker.transport.overflow must be one of drop-oldest, block, or error")
+			}
+			options.Overflow = policy
+		default:
+			return options, fmt.Errorf("Unknown property worker.transport.%s", key)
+		}
+	}
+	return options, nil
+}
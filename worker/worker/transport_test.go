@@ -0,0 +1,43 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker-runner/protocol"
+)
+
+func TestParseTransportDefault(t *testing.T) {
+	options, err := ParseTransport(nil)
+	require.NoError(t, err)
+	require.Equal(t, protocol.StdioTransportOptions{}, options)
+}
+
+func TestParseTransport(t *testing.T) {
+	options, err := ParseTransport(map[string]interface{}{
+		"queueSize":   10,
+		"overflow":    "block",
+		"sendTimeout": 30,
+	})
+	require.NoError(t, err)
+	require.Equal(t, protocol.StdioTransportOptions{
+		QueueSize:   10,
+		Overflow:    protocol.OverflowBlock,
+		SendTimeout: 30 * time.Second,
+	}, options)
+}
+
+func TestParseTransportInvalid(t *testing.T) {
+	for _, data := range []map[string]interface{}{
+		{"queueSize": 0},
+		{"queueSize": "10"},
+		{"sendTimeout": -1},
+		{"overflow": "drop-newest"},
+		{"overflow": 1},
+		{"queueLength": 10},
+	} {
+		_, err := ParseTransport(data)
+		require.Error(t, err, "%v", data)
+	}
+}
@@ -26,4 +26,9 @@ type Worker interface {
 
 	// Wait for the worker to terminate
 	Wait() error
+
+	// Forcibly stop the worker, after which Wait should return promptly.  This
+	// is only used when the worker has failed to respond to
+	// graceful-termination.
+	Kill() error
 }